@@ -23,38 +23,51 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
 	"runtime"
 	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
+	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
+	"github.com/Brownster/agent-windows/internal/adaptive"
+	"github.com/Brownster/agent-windows/internal/aggregate"
+	"github.com/Brownster/agent-windows/internal/buffer"
 	"github.com/Brownster/agent-windows/internal/config"
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/derive"
+	"github.com/Brownster/agent-windows/internal/filter"
+	"github.com/Brownster/agent-windows/internal/grouping"
+	"github.com/Brownster/agent-windows/internal/labels"
 	"github.com/Brownster/agent-windows/internal/log"
 	"github.com/Brownster/agent-windows/internal/log/flag"
+	"github.com/Brownster/agent-windows/internal/osversion"
+	"github.com/Brownster/agent-windows/internal/rate"
+	"github.com/Brownster/agent-windows/internal/relabel"
+	"github.com/Brownster/agent-windows/internal/sink/file"
+	"github.com/Brownster/agent-windows/internal/sink/influxdb"
+	"github.com/Brownster/agent-windows/internal/sink/mqtt"
+	"github.com/Brownster/agent-windows/internal/sink/statsd"
+	"github.com/Brownster/agent-windows/internal/types"
 	"github.com/Brownster/agent-windows/internal/utils"
+	"github.com/Brownster/agent-windows/internal/validate"
+	"github.com/Brownster/agent-windows/internal/web"
 	"github.com/Brownster/agent-windows/pkg/collector"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
-type PushConfig struct {
-	URL      string
-	Username string
-	Password string
-	Interval time.Duration
-	AgentID  string
-	JobName  string
-}
-
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 
@@ -92,6 +105,116 @@ func run(ctx context.Context, args []string) int {
 			"Prometheus Push Gateway URL",
 		).String()
 
+		pushMode = app.Flag(
+			"push.mode",
+			"Push protocol. One of [\"pushgateway\", \"remote_write\", \"otlp\", \"influxdb\", \"statsd\", \"mqtt\", \"file\"]",
+		).Default(pushModePushgateway).Enum(pushModePushgateway, pushModeRemoteWrite, pushModeOTLP, pushModeInfluxDB, pushModeStatsD, pushModeMQTT, pushModeFile)
+
+		pushRemoteWriteURL = app.Flag(
+			"push.remote-write-url",
+			"Prometheus remote write endpoint URL, used if push.mode is remote_write",
+		).String()
+
+		pushOTLPURL = app.Flag(
+			"push.otlp-url",
+			"OTLP/HTTP metrics endpoint URL, for example http://otel-collector:4318/v1/metrics, used if push.mode is otlp",
+		).String()
+
+		pushInfluxDBURL = app.Flag(
+			"push.influxdb-url",
+			"InfluxDB base URL, for example http://influxdb:8086, or UDP listener address, for example udp://telegraf:8094, used if push.mode is influxdb",
+		).String()
+
+		pushInfluxDBOrg = app.Flag(
+			"push.influxdb.org",
+			"InfluxDB organization",
+		).String()
+
+		pushInfluxDBBucket = app.Flag(
+			"push.influxdb.bucket",
+			"InfluxDB bucket",
+		).String()
+
+		pushInfluxDBToken = app.Flag(
+			"push.influxdb.token",
+			"InfluxDB API token",
+		).String()
+
+		pushInfluxDBTokenFile = app.Flag(
+			"push.influxdb.token-file",
+			"File containing the InfluxDB API token, read for every write",
+		).String()
+
+		pushInfluxDBBatchSize = app.Flag(
+			"push.influxdb.batch-size",
+			"Maximum number of lines per InfluxDB write request",
+		).Default(strconv.Itoa(influxdb.DefaultBatchSize)).Int()
+
+		pushStatsDURL = app.Flag(
+			"push.statsd-url",
+			"StatsD server address, for example udp://127.0.0.1:8125, used if push.mode is statsd",
+		).String()
+
+		pushStatsDMaxPacketSize = app.Flag(
+			"push.statsd.max-packet-size",
+			"Maximum size of a StatsD UDP packet in bytes",
+		).Default(strconv.Itoa(statsd.DefaultMaxPacketSize)).Int()
+
+		pushMQTTURL = app.Flag(
+			"push.mqtt-url",
+			"MQTT broker URL, for example mqtt://broker:1883 or mqtts://broker:8883, used if push.mode is mqtt",
+		).String()
+
+		pushMQTTClientID = app.Flag(
+			"push.mqtt.client-id",
+			"MQTT client ID. Defaults to windows_agent_collector_<agent-id>",
+		).String()
+
+		pushMQTTTopic = app.Flag(
+			"push.mqtt.topic",
+			"MQTT topic of the metrics. {name} is replaced by the value of the label name",
+		).Default(mqtt.DefaultTopic).String()
+
+		pushMQTTStatusTopic = app.Flag(
+			"push.mqtt.status-topic",
+			"Retained MQTT topic of the agent status, set to offline by the last will. Empty to disable",
+		).Default(mqtt.DefaultStatusTopic).String()
+
+		pushMQTTFormat = app.Flag(
+			"push.mqtt.format",
+			"MQTT payload format. One of [\"json\", \"text\"]",
+		).Default(mqtt.FormatJSON).Enum(mqtt.FormatJSON, mqtt.FormatText)
+
+		pushMQTTQoS = app.Flag(
+			"push.mqtt.qos",
+			"MQTT QoS level of the published messages. One of [0, 1, 2]",
+		).Default("1").Enum("0", "1", "2")
+
+		pushMQTTKeepAlive = app.Flag(
+			"push.mqtt.keep-alive",
+			"Interval of MQTT keep alive pings. The broker publishes the last will after 1.5 intervals without a ping",
+		).Default(mqtt.DefaultKeepAlive.String()).Duration()
+
+		pushFilePath = app.Flag(
+			"push.file-path",
+			"Path of the OpenMetrics file the snapshots are appended to, used if push.mode is file",
+		).String()
+
+		pushFileMaxSize = app.Flag(
+			"push.file.max-size",
+			"Size in bytes at which the file is rotated",
+		).Default(strconv.Itoa(file.DefaultMaxSize)).Int64()
+
+		pushFileMaxFiles = app.Flag(
+			"push.file.max-files",
+			"Number of rotated files that are kept",
+		).Default(strconv.Itoa(file.DefaultMaxFiles)).Int()
+
+		pushFileCompress = app.Flag(
+			"push.file.compress",
+			"Compress rotated files with gzip",
+		).Default("false").Bool()
+
 		pushUsername = app.Flag(
 			"push.username",
 			"Basic auth username for push gateway",
@@ -102,22 +225,216 @@ func run(ctx context.Context, args []string) int {
 			"Basic auth password for push gateway",
 		).String()
 
+		pushBearerToken = app.Flag(
+			"push.bearer-token",
+			"Bearer token for push gateway",
+		).String()
+
+		pushBearerTokenFile = app.Flag(
+			"push.bearer-token-file",
+			"File containing the bearer token for push gateway. The file is read for every push",
+		).String()
+
+		pushOAuth2TokenURL = app.Flag(
+			"push.oauth2.token-url",
+			"OAuth2 token endpoint. If set, pushes are authenticated with the OAuth2 client credentials flow",
+		).String()
+
+		pushOAuth2ClientID = app.Flag(
+			"push.oauth2.client-id",
+			"OAuth2 client ID",
+		).String()
+
+		pushOAuth2ClientSecretFile = app.Flag(
+			"push.oauth2.client-secret-file",
+			"File containing the OAuth2 client secret",
+		).String()
+
+		pushOAuth2Scopes = app.Flag(
+			"push.oauth2.scopes",
+			"Comma-separated list of OAuth2 scopes",
+		).String()
+
 		pushInterval = app.Flag(
 			"push.interval",
 			"Interval for pushing metrics to gateway",
 		).Default("30s").Duration()
 
+		pushTimeout = app.Flag(
+			"push.timeout",
+			"Timeout for a single push attempt. 0 means the attempt is only bounded by the push interval",
+		).Default("0s").Duration()
+
 		pushJobName = app.Flag(
 			"push.job-name",
 			"Job name for push gateway",
 		).Default("windows_agent").String()
 
+		pushTLSCAFile = app.Flag(
+			"push.tls.ca-file",
+			"PEM bundle of the CAs used to verify the push target. Empty uses the system roots",
+		).String()
+
+		pushTLSCertFile = app.Flag(
+			"push.tls.cert-file",
+			"PEM client certificate for mutual TLS",
+		).String()
+
+		pushTLSKeyFile = app.Flag(
+			"push.tls.key-file",
+			"PEM client key for mutual TLS",
+		).String()
+
+		pushTLSServerName = app.Flag(
+			"push.tls.server-name",
+			"Server name used to verify the certificate of the push target",
+		).String()
+
+		pushTLSMinVersion = app.Flag(
+			"push.tls.min-version",
+			"Minimum TLS version. One of [\"TLS10\", \"TLS11\", \"TLS12\", \"TLS13\"]",
+		).Default("TLS12").Enum("TLS10", "TLS11", "TLS12", "TLS13")
+
+		pushTLSInsecureSkipVerify = app.Flag(
+			"push.tls.insecure-skip-verify",
+			"Disable verification of the push target certificate. Do not use in production",
+		).Default("false").Bool()
+
+		pushMethod = app.Flag(
+			"push.method",
+			"HTTP method for pushing to the push gateway. \"put\" replaces all metrics of the agent, \"post\" only replaces metrics with the same name",
+		).Default(pushMethodPut).Enum(pushMethodPut, pushMethodPost)
+
+		pushDeleteOnShutdown = app.Flag(
+			"push.delete-on-shutdown",
+			"Delete the metrics of the agent from the push gateway when the agent stops",
+		).Default("false").Bool()
+
+		pushShutdownTimeout = app.Flag(
+			"push.shutdown-timeout",
+			"Time allowed for the final push and the delete when the agent stops",
+		).Default("5s").Duration()
+
+		pushMaxRetries = app.Flag(
+			"push.retry.max-retries",
+			"Number of retries for a failed push within one push interval",
+		).Default("3").Int()
+
+		pushInitialBackoff = app.Flag(
+			"push.retry.initial-backoff",
+			"Delay before the first retry. Delays grow exponentially with jitter, within and across push intervals",
+		).Default("1s").Duration()
+
+		pushMaxBackoff = app.Flag(
+			"push.retry.max-backoff",
+			"Upper bound for the delay between retries",
+		).Default("5m").Duration()
+
+		pushBreakerThreshold = app.Flag(
+			"push.circuit-breaker.threshold",
+			"Number of consecutive failed push intervals after which pushes are suspended. 0 disables the circuit breaker",
+		).Default("5").Int()
+
+		pushBreakerTimeout = app.Flag(
+			"push.circuit-breaker.timeout",
+			"Time the circuit breaker stays open before a probe push is sent",
+		).Default("2m").Duration()
+
+		pushBufferPath = app.Flag(
+			"push.buffer.path",
+			"Directory for buffering metrics on disk while the push gateway is unreachable. Empty disables buffering. Only the remote_write, otlp, influxdb and file modes keep all snapshots; other modes keep only the latest",
+		).String()
+
+		pushBufferMaxSize = app.Flag(
+			"push.buffer.max-size",
+			"Maximum size of the offline buffer in bytes. The oldest snapshots are dropped first",
+		).Default("104857600").Int64()
+
+		pushBufferMaxAge = app.Flag(
+			"push.buffer.max-age",
+			"Maximum age of buffered snapshots",
+		).Default("24h").Duration()
+
+		pushBurstInterval = app.Flag(
+			"push.burst.interval",
+			"Push interval in burst mode, for example during WebRTC calls. 0 disables burst mode.",
+		).Default("0s").Duration()
+
+		pushBurstDuration = app.Flag(
+			"push.burst.duration",
+			"Time burst mode lasts after it was last triggered.",
+		).Default(adaptive.DefaultBurstDuration.String()).Duration()
+
+		pushBurstCondition = app.Flag(
+			"push.burst.condition",
+			"Condition on the pushed metrics that triggers burst mode, for example 'rate(windows_net_bytes_received_total{nic=\"Ethernet\"}) > 125000'.",
+		).Default("").String()
+
+		pushDisableRuntimeMetrics = app.Flag(
+			"push.disable-runtime-metrics",
+			"Exclude the Go runtime and process metrics of the agent (go_*, process_*) from the pushed and served metrics.",
+		).Default("false").Bool()
+
+		// Aggregation
+		aggregationSampleInterval = app.Flag(
+			"aggregation.sample-interval",
+			"Interval at which the metrics of the aggregation rules are sampled.",
+		).Default(aggregate.DefaultSampleInterval.String()).Duration()
+
+		aggregationWindow = app.Flag(
+			"aggregation.window",
+			"Time over which the statistics of the aggregation rules are computed. 0 uses the push interval.",
+		).Default("0s").Duration()
+
+		// Rates
+		rateMinInterval = app.Flag(
+			"rate.min-interval",
+			"Minimum time between the samples of a rate, also of rates in push.burst.condition. Gathers within this time repeat the previous rate.",
+		).Default(rate.DefaultMinInterval.String()).Duration()
+
+		// Filter
+		filterMaxSeries = app.Flag(
+			"filter.max-series",
+			"Maximum number of series of a push. Families with the lowest priority are dropped first. 0 disables the limit.",
+		).Default("0").Int()
+
+		// Local Metrics Endpoint
+		webEnabled = app.Flag(
+			"web.enabled",
+			"Serve the metrics on a local HTTP endpoint in addition to pushing them.",
+		).Default("false").Bool()
+
+		webListenAddress = app.Flag(
+			"web.listen-address",
+			"Address on which to expose the metrics. Listen on all interfaces only for Prometheus servers that scrape the agent.",
+		).Default("localhost:9182").String()
+
+		webConfigFile = app.Flag(
+			"web.config.file",
+			"Path to a web configuration file with TLS and basic authentication settings.",
+		).Default("").String()
+
+		webCacheMaxAge = app.Flag(
+			"web.cache-max-age",
+			"Maximum age of gathered metrics that are shared by scrapes of the local endpoint.",
+		).Default("5s").Duration()
+
+		telemetryPath = app.Flag(
+			"telemetry.path",
+			"URL path under which to expose the metrics.",
+		).Default("/metrics").String()
+
 		// Agent Configuration
 		agentID = app.Flag(
 			"agent-id",
 			"Agent identifier for correlation with WebRTC stats",
 		).String()
 
+		labelCollision = app.Flag(
+			"label-collision",
+			"How to handle a metric that already has the agent_id label or one of the labels of the configuration file. One of [error, rename]",
+		).Default(labels.CollisionError).Enum(labels.CollisionError, labels.CollisionRename)
+
 		enabledCollectors = app.Flag(
 			"collectors.enabled",
 			"Comma-separated list of collectors to use. Available: cpu,memory,net,pagefile",
@@ -151,6 +468,19 @@ func run(ctx context.Context, args []string) int {
 	collectors := collector.NewWithFlags(app)
 
 	// Parse configuration and command line arguments
+	var (
+		constLabels  map[string]string
+		pushGrouping map[string]string
+		pushHeaders  map[string]string
+		pushTargets  []config.PushTarget
+
+		aggregationRules     []config.AggregationRule
+		rateRules            []config.RateRule
+		derivedRules         []config.DerivedRule
+		metricRelabelConfigs []*relabel.Config
+		filterConfig         config.FilterConfig
+	)
+
 	configFilePath := config.ParseConfigFile(args)
 	if configFilePath != "" {
 		resolver, err := config.NewConfigFileResolver(configFilePath)
@@ -169,6 +499,16 @@ func run(ctx context.Context, args []string) int {
 			)
 			return 1
 		}
+
+		constLabels = resolver.Labels()
+		pushGrouping = resolver.PushGrouping()
+		pushHeaders = resolver.PushHeaders()
+		pushTargets = resolver.PushTargets()
+		aggregationRules = resolver.AggregationRules()
+		rateRules = resolver.RateRules()
+		derivedRules = resolver.DerivedRules()
+		metricRelabelConfigs = resolver.MetricRelabelConfigs()
+		filterConfig = resolver.Filter()
 	}
 
 	// Parse command line arguments to get the selected command
@@ -231,8 +571,39 @@ func run(ctx context.Context, args []string) int {
 	}
 
 	// Validate required flags for normal operation
-	if *pushGatewayURL == "" {
-		fmt.Println("Error: --push.gateway-url is required")
+	pushURL := *pushGatewayURL
+	switch *pushMode {
+	case pushModeRemoteWrite:
+		pushURL = *pushRemoteWriteURL
+	case pushModeOTLP:
+		pushURL = *pushOTLPURL
+	case pushModeInfluxDB:
+		pushURL = *pushInfluxDBURL
+	case pushModeStatsD:
+		pushURL = *pushStatsDURL
+	case pushModeMQTT:
+		pushURL = *pushMQTTURL
+	case pushModeFile:
+		pushURL = *pushFilePath
+	}
+
+	if pushURL == "" && len(pushTargets) == 0 {
+		switch *pushMode {
+		case pushModeRemoteWrite:
+			fmt.Println("Error: --push.remote-write-url is required if --push.mode is remote_write")
+		case pushModeOTLP:
+			fmt.Println("Error: --push.otlp-url is required if --push.mode is otlp")
+		case pushModeInfluxDB:
+			fmt.Println("Error: --push.influxdb-url is required if --push.mode is influxdb")
+		case pushModeStatsD:
+			fmt.Println("Error: --push.statsd-url is required if --push.mode is statsd")
+		case pushModeMQTT:
+			fmt.Println("Error: --push.mqtt-url is required if --push.mode is mqtt")
+		case pushModeFile:
+			fmt.Println("Error: --push.file-path is required if --push.mode is file")
+		default:
+			fmt.Println("Error: --push.gateway-url is required")
+		}
 		fmt.Println("Use --help for usage information")
 		return 1
 	}
@@ -265,14 +636,86 @@ func run(ctx context.Context, args []string) int {
 		return 1
 	}
 
+	pushTLSMinVersionNumber, err := delivery.ParseTLSVersion(*pushTLSMinVersion)
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelError, "invalid push TLS configuration",
+			slog.Any("err", err),
+		)
+		return 1
+	}
+
 	// Create push gateway configuration
-	pushConfig := PushConfig{
-		URL:      *pushGatewayURL,
-		Username: *pushUsername,
-		Password: *pushPassword,
-		Interval: *pushInterval,
-		AgentID:  *agentID,
-		JobName:  *pushJobName,
+	pushConfigs, err := buildPushConfigs(PushConfig{
+		Mode:            *pushMode,
+		URL:             pushURL,
+		Username:        *pushUsername,
+		Password:        *pushPassword,
+		BearerToken:     *pushBearerToken,
+		BearerTokenFile: *pushBearerTokenFile,
+		Headers:         pushHeaders,
+		OAuth2: delivery.OAuth2Config{
+			TokenURL:         *pushOAuth2TokenURL,
+			ClientID:         *pushOAuth2ClientID,
+			ClientSecretFile: *pushOAuth2ClientSecretFile,
+			Scopes:           splitList(*pushOAuth2Scopes),
+		},
+		InfluxDB: influxdb.Config{
+			Org:       *pushInfluxDBOrg,
+			Bucket:    *pushInfluxDBBucket,
+			Token:     *pushInfluxDBToken,
+			TokenFile: *pushInfluxDBTokenFile,
+			BatchSize: *pushInfluxDBBatchSize,
+		},
+		StatsD: statsd.Config{
+			MaxPacketSize: *pushStatsDMaxPacketSize,
+		},
+		MQTT: mqtt.Config{
+			ClientID:    *pushMQTTClientID,
+			Topic:       *pushMQTTTopic,
+			StatusTopic: *pushMQTTStatusTopic,
+			Format:      *pushMQTTFormat,
+			QoS:         (*pushMQTTQoS)[0] - '0', // The enum only allows single digits.
+			KeepAlive:   *pushMQTTKeepAlive,
+		},
+		File: file.Config{
+			MaxSize:  *pushFileMaxSize,
+			MaxFiles: *pushFileMaxFiles,
+			Compress: *pushFileCompress,
+		},
+		Grouping:         pushGrouping,
+		Method:           *pushMethod,
+		DeleteOnShutdown: *pushDeleteOnShutdown,
+		ShutdownTimeout:  *pushShutdownTimeout,
+		Interval:         *pushInterval,
+		Timeout:          *pushTimeout,
+		AgentID:          *agentID,
+		JobName:          *pushJobName,
+		TLS: delivery.TLSConfig{
+			CAFile:             *pushTLSCAFile,
+			CertFile:           *pushTLSCertFile,
+			KeyFile:            *pushTLSKeyFile,
+			ServerName:         *pushTLSServerName,
+			MinVersion:         pushTLSMinVersionNumber,
+			InsecureSkipVerify: *pushTLSInsecureSkipVerify,
+		},
+		Retry: delivery.RetryConfig{
+			MaxRetries:       *pushMaxRetries,
+			InitialBackoff:   *pushInitialBackoff,
+			MaxBackoff:       *pushMaxBackoff,
+			BreakerThreshold: *pushBreakerThreshold,
+			BreakerTimeout:   *pushBreakerTimeout,
+		},
+		Buffer: buffer.Config{
+			Path:    *pushBufferPath,
+			MaxSize: *pushBufferMaxSize,
+			MaxAge:  *pushBufferMaxAge,
+		},
+	}, pushTargets, groupingData(*agentID))
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelError, "invalid push target configuration",
+			slog.Any("err", err),
+		)
+		return 1
 	}
 
 	enabledCollectorList := expandEnabledCollectors(*enabledCollectors)
@@ -296,21 +739,74 @@ func run(ctx context.Context, args []string) int {
 	logCurrentUser(ctx, logger)
 
 	logger.InfoContext(ctx, "Enabled collectors: "+strings.Join(enabledCollectorList, ", "))
-	logger.InfoContext(ctx, fmt.Sprintf("Agent ID: %s", pushConfig.AgentID))
-	logger.InfoContext(ctx, fmt.Sprintf("Push Gateway URL: %s", pushConfig.URL))
-	logger.InfoContext(ctx, fmt.Sprintf("Push Interval: %s", pushConfig.Interval))
+	logger.InfoContext(ctx, fmt.Sprintf("Agent ID: %s", *agentID))
+
+	for _, pushConfig := range pushConfigs {
+		logger.LogAttrs(ctx, slog.LevelInfo, "Push target "+pushConfig.Name,
+			slog.String("mode", pushConfig.Mode),
+			slog.String("url", pushConfig.URL),
+			slog.Duration("interval", pushConfig.Interval),
+			slog.Any("grouping", pushConfig.Grouping),
+		)
+	}
 
 	// Create Prometheus registry
 	registry := prometheus.NewRegistry()
 
-	// Create collector wrapper that adds agent_id label
-	agentCollector := &AgentCollectorWrapper{
-		collectors: collectors,
-		agentID:    pushConfig.AgentID,
-		logger:     logger,
+	// Create collector wrapper that adds agent_id and the constant labels
+	agentCollector, err := newAgentCollectorWrapper(collectors, *agentID, constLabels, *labelCollision, logger)
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelError, "invalid labels configuration",
+			slog.Any("err", err),
+		)
+		return 1
+	}
+
+	if err = agentCollector.Register(registry); err != nil {
+		logger.LogAttrs(ctx, slog.LevelError, "Failed to register collectors",
+			slog.Any("err", err),
+		)
+		return 1
+	}
+
+	if !*pushDisableRuntimeMetrics {
+		// go_gc_gomemlimit_bytes reports the process.memory-limit budget.
+		registry.MustRegister(
+			promcollectors.NewGoCollector(),
+			promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	pushTelemetry := make([]*delivery.Telemetry, len(pushConfigs))
+
+	for i, pushConfig := range pushConfigs {
+		pushTelemetry[i] = delivery.NewTelemetry()
+
+		prometheus.WrapRegistererWith(prometheus.Labels{"target": pushConfig.Name}, registry).
+			MustRegister(pushTelemetry[i])
 	}
 
-	registry.MustRegister(agentCollector)
+	offlineBuffers := make([]*buffer.Buffer, len(pushConfigs))
+
+	for i, pushConfig := range pushConfigs {
+		if pushConfig.Buffer.Path == "" {
+			continue
+		}
+
+		offlineBuffers[i], err = buffer.New(logger, pushConfig.Buffer)
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "Failed to open offline buffer",
+				slog.String("target", pushConfig.Name),
+				slog.Any("err", err),
+			)
+			return 1
+		}
+
+		prometheus.WrapRegistererWith(prometheus.Labels{"target": pushConfig.Name}, registry).
+			MustRegister(offlineBuffers[i])
+
+		logger.InfoContext(ctx, fmt.Sprintf("Offline buffer: %s (%d snapshots)", pushConfig.Buffer.Path, offlineBuffers[i].Len()))
+	}
 
 	logger.LogAttrs(ctx, slog.LevelInfo, fmt.Sprintf("starting windows_agent_collector in %s", time.Since(startTime)),
 		slog.String("version", version.Version),
@@ -321,84 +817,284 @@ func run(ctx context.Context, args []string) int {
 		slog.Int("maxprocs", runtime.GOMAXPROCS(0)),
 	)
 
-	// Start push gateway client
-	if err := runPushGateway(ctx, logger, pushConfig, registry); err != nil {
-		logger.LogAttrs(ctx, slog.LevelError, "Failed to run push gateway client",
-			slog.Any("err", err),
-		)
-		return 1
-	}
+	var controller *adaptive.Controller
 
-	logger.LogAttrs(ctx, slog.LevelInfo, "windows_agent_collector has shut down")
-	return 0
-}
+	if *pushBurstInterval > 0 {
+		// Without the web server, there is no /-/burst endpoint, and the condition is the only trigger.
+		if !*webEnabled {
+			if *pushBurstCondition == "" {
+				logger.LogAttrs(ctx, slog.LevelError, "invalid burst mode configuration: push.burst.interval requires push.burst.condition or web.enabled")
+				return 1
+			}
 
-func runPushGateway(ctx context.Context, logger *slog.Logger, config PushConfig, registry *prometheus.Registry) error {
-	ticker := time.NewTicker(config.Interval)
-	defer ticker.Stop()
+			logger.LogAttrs(ctx, slog.LevelInfo, "Burst mode can only be triggered by push.burst.condition, the /-/burst endpoint requires web.enabled")
+		}
 
-	// Initial push
-	if err := pushMetrics(ctx, logger, config, registry); err != nil {
-		logger.LogAttrs(ctx, slog.LevelWarn, "Initial metrics push failed",
-			slog.Any("err", err),
-		)
+		controller, err = adaptive.New(logger, adaptive.Config{
+			BurstInterval: *pushBurstInterval,
+			BurstDuration: *pushBurstDuration,
+			Condition:     *pushBurstCondition,
+			MinInterval:   *rateMinInterval,
+		})
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "invalid burst mode configuration",
+				slog.Any("err", err),
+			)
+			return 1
+		}
+
+		registry.MustRegister(controller)
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-stopCh:
-			return nil
-		case <-ticker.C:
-			if err := pushMetrics(ctx, logger, config, registry); err != nil {
-				logger.LogAttrs(ctx, slog.LevelWarn, "Metrics push failed",
+	var gatherer prometheus.Gatherer = registry
+
+	if len(aggregationRules) > 0 {
+		rules := make([]aggregate.Rule, 0, len(aggregationRules))
+		for _, rule := range aggregationRules {
+			rules = append(rules, aggregate.Rule(rule))
+		}
+
+		window := *aggregationWindow
+		if window <= 0 {
+			window = *pushInterval
+		}
+
+		var sampler prometheus.Gatherer
+
+		// The samples only run the collectors of the rules, unless a rule selects another metric.
+		if names := aggregationCollectors(collectors.Collectors(), rules); names != nil {
+			samplerRegistry := prometheus.NewRegistry()
+
+			samplerCollector, err := agentCollector.Subset(names)
+			if err == nil {
+				err = samplerCollector.Register(samplerRegistry)
+			}
+
+			if err != nil {
+				logger.LogAttrs(ctx, slog.LevelError, "Failed to register aggregation collectors",
 					slog.Any("err", err),
 				)
+				return 1
 			}
+
+			sampler = samplerRegistry
+		}
+
+		aggregator, err := aggregate.New(logger, registry, aggregate.Config{
+			SampleInterval: *aggregationSampleInterval,
+			Window:         window,
+			Rules:          rules,
+			Sampler:        sampler,
+		})
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "invalid aggregation configuration",
+				slog.Any("err", err),
+			)
+			return 1
 		}
+
+		aggregatorCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go aggregator.Run(aggregatorCtx)
+
+		gatherer = aggregator
+	}
+
+	if len(rateRules) > 0 {
+		rules := make([]rate.Rule, 0, len(rateRules))
+		for _, rule := range rateRules {
+			rules = append(rules, rate.Rule(rule))
+		}
+
+		rates, err := rate.New(logger, gatherer, rate.Config{
+			MinInterval: *rateMinInterval,
+			Rules:       rules,
+		})
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "invalid rate configuration",
+				slog.Any("err", err),
+			)
+			return 1
+		}
+
+		gatherer = rates
 	}
-}
 
-func pushMetrics(ctx context.Context, logger *slog.Logger, config PushConfig, registry *prometheus.Registry) error {
-	pusher := push.New(config.URL, config.JobName).
-		Gatherer(registry).
-		Grouping("agent_id", config.AgentID)
+	if len(derivedRules) > 0 {
+		rules := make([]derive.Rule, 0, len(derivedRules))
+		for _, rule := range derivedRules {
+			rules = append(rules, derive.Rule(rule))
+		}
 
-	if config.Username != "" && config.Password != "" {
-		pusher = pusher.BasicAuth(config.Username, config.Password)
+		derived, err := derive.New(logger, gatherer, rules)
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "invalid derived metric configuration",
+				slog.Any("err", err),
+			)
+			return 1
+		}
+
+		gatherer = derived
 	}
 
-	start := time.Now()
-	err := pusher.Push()
-	duration := time.Since(start)
+	if len(metricRelabelConfigs) > 0 {
+		gatherer = relabel.Gatherer(gatherer, metricRelabelConfigs)
+	}
 
-	if err != nil {
-		if logger != nil {
-			logger.LogAttrs(ctx, slog.LevelError, "Failed to push metrics",
+	validator := validate.New(logger, gatherer)
+	registry.MustRegister(validator)
+
+	gatherer = validator
+
+	if *filterMaxSeries > 0 || len(filterConfig.Allow) > 0 || len(filterConfig.Deny) > 0 || len(filterConfig.Collectors) > 0 {
+		collectorRules := make(map[string]filter.Rules, len(filterConfig.Collectors))
+		for name, rules := range filterConfig.Collectors {
+			collectorRules[name] = filter.Rules(rules)
+		}
+
+		metricFilter, err := filter.New(logger, gatherer, filter.Config{
+			Rules:      filter.Rules(filterConfig.FilterRules),
+			Collectors: collectorRules,
+			Priorities: filterConfig.Priorities,
+			MaxSeries:  *filterMaxSeries,
+		})
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "invalid filter configuration",
 				slog.Any("err", err),
-				slog.Duration("duration", duration),
+			)
+			return 1
+		}
+
+		registry.MustRegister(metricFilter)
+
+		gatherer = metricFilter
+	}
+
+	if *webEnabled {
+		// The collectors are not safe for concurrent use, so scrapes and pushes gather under one
+		// lock. Only scrapes share the cached metrics; every push gathers, so it never repeats
+		// a stale snapshot however short its interval.
+		gatherer = &lockedGatherer{gatherer: gatherer}
+		cachedGatherer := delivery.NewCachedGatherer(gatherer, *webCacheMaxAge)
+
+		mux := http.NewServeMux()
+		mux.Handle(*telemetryPath, promhttp.HandlerFor(cachedGatherer, promhttp.HandlerOpts{
+			ErrorLog:      slog.NewLogLogger(logger.Handler(), slog.LevelError),
+			ErrorHandling: promhttp.ContinueOnError,
+		}))
+
+		if controller != nil {
+			mux.Handle("/-/burst", controller)
+		}
+
+		server, err := web.New(logger, *webListenAddress, *webConfigFile, mux)
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelError, "Failed to start the metrics endpoint",
+				slog.Any("err", err),
+			)
+			return 1
+		}
+
+		if !web.IsLocal(*webListenAddress) && *webConfigFile == "" {
+			logger.LogAttrs(ctx, slog.LevelWarn, "The metrics endpoint is reachable from other machines without TLS or authentication",
+				slog.String("address", *webListenAddress),
 			)
 		}
-		return err
+
+		webCtx, cancel := context.WithCancel(ctx)
+		webDone := make(chan struct{})
+
+		// The endpoint is stopped after the final pushes.
+		defer func() {
+			cancel()
+			<-webDone
+		}()
+
+		go func() {
+			defer close(webDone)
+
+			if err := server.Serve(webCtx); err != nil {
+				logger.LogAttrs(ctx, slog.LevelError, "Metrics endpoint failed",
+					slog.Any("err", err),
+				)
+			}
+		}()
 	}
 
-	if logger != nil {
-		logger.LogAttrs(ctx, slog.LevelDebug, "Successfully pushed metrics",
-			slog.Duration("duration", duration),
+	// Start push gateway client
+	if err := runPushTargets(ctx, logger, pushConfigs, gatherer, offlineBuffers, pushTelemetry, controller); err != nil {
+		logger.LogAttrs(ctx, slog.LevelError, "Failed to run push gateway client",
+			slog.Any("err", err),
 		)
+		return 1
 	}
 
-	return nil
+	logger.LogAttrs(ctx, slog.LevelInfo, "windows_agent_collector has shut down")
+	return 0
 }
 
-// AgentCollectorWrapper wraps the collector and adds agent_id label to all metrics
+// AgentCollectorWrapper wraps the collector and adds agent_id and the constant labels to all metrics
 type AgentCollectorWrapper struct {
 	collectors collector.Collection
 	agentID    string
+	wrapper    *labels.Wrapper
 	logger     *slog.Logger
+
+	mu sync.Mutex
+	// dropped holds the descriptors of the metrics that were logged as dropped.
+	dropped map[string]bool
+}
+
+// newAgentCollectorWrapper returns an AgentCollectorWrapper that adds agent_id and constLabels to all metrics.
+// collision is one of labels.CollisionError or labels.CollisionRename.
+func newAgentCollectorWrapper(collectors collector.Collection, agentID string, constLabels map[string]string, collision string, logger *slog.Logger) (*AgentCollectorWrapper, error) {
+	if _, ok := constLabels[grouping.AgentIDLabel]; ok {
+		return nil, fmt.Errorf("label %q is set by the agent", grouping.AgentIDLabel)
+	}
+
+	agentLabels := map[string]string{grouping.AgentIDLabel: agentID}
+	for name, value := range constLabels {
+		agentLabels[name] = value
+	}
+
+	wrapper, err := labels.New(agentLabels, collision)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AgentCollectorWrapper{
+		collectors: collectors,
+		agentID:    agentID,
+		wrapper:    wrapper,
+		logger:     logger,
+		dropped:    map[string]bool{},
+	}, nil
+}
+
+// Register registers the wrapper with registerer. In the error collision mode, the registry rejects
+// descriptors of the collectors that already have one of the labels.
+func (a *AgentCollectorWrapper) Register(registerer prometheus.Registerer) error {
+	return a.wrapper.Register(registerer, a)
+}
+
+// Subset returns a wrapper of the named collectors that adds the same labels.
+func (a *AgentCollectorWrapper) Subset(collectors []string) (*AgentCollectorWrapper, error) {
+	subset, err := a.collectors.Subset(collectors)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AgentCollectorWrapper{
+		collectors: subset,
+		agentID:    a.agentID,
+		wrapper:    a.wrapper,
+		logger:     a.logger,
+		dropped:    map[string]bool{},
+	}, nil
 }
 
+// Describe sends the descriptors of the collectors. The labels are added by Register.
 func (a *AgentCollectorWrapper) Describe(ch chan<- *prometheus.Desc) {
 	a.collectors.Describe(ch)
 }
@@ -411,8 +1107,55 @@ func (a *AgentCollectorWrapper) Collect(ch chan<- prometheus.Metric) {
 	}()
 
 	for metric := range originalCh {
-		ch <- metric
+		wrapped, err := a.wrapper.Metric(metric)
+		if err != nil {
+			// A single metric must not fail the whole push. It fails the same way on every
+			// collect, so it is logged once.
+			a.logDropped(metric.Desc(), err)
+			continue
+		}
+
+		ch <- wrapped
+	}
+}
+
+// logDropped logs a dropped metric once per descriptor.
+func (a *AgentCollectorWrapper) logDropped(desc *prometheus.Desc, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := desc.String()
+	if a.dropped[key] {
+		return
+	}
+
+	a.dropped[key] = true
+
+	a.logger.LogAttrs(context.Background(), slog.LevelWarn, "Dropping metric",
+		slog.String("desc", key),
+		slog.Any("err", err),
+	)
+}
+
+// aggregationCollectors returns the collectors whose metrics are selected by the aggregation rules,
+// or nil if a rule selects a metric that is not from one of the collectors.
+func aggregationCollectors(collectors []string, rules []aggregate.Rule) []string {
+	var names []string
+
+	for _, rule := range rules {
+		i := slices.IndexFunc(collectors, func(name string) bool {
+			return strings.HasPrefix(rule.Metric, types.Namespace+"_"+name+"_")
+		})
+		if i < 0 {
+			return nil
+		}
+
+		if !slices.Contains(names, collectors[i]) {
+			names = append(names, collectors[i])
+		}
 	}
+
+	return names
 }
 
 func logCurrentUser(ctx context.Context, logger *slog.Logger) {
@@ -472,6 +1215,17 @@ func setPriorityWindows(ctx context.Context, logger *slog.Logger, pid int, prior
 	return nil
 }
 
+// groupingData returns the data available to the grouping templates of the push targets.
+func groupingData(agentID string) grouping.Data {
+	hostname, _ := os.Hostname()
+
+	return grouping.Data{
+		AgentID:   agentID,
+		Hostname:  hostname,
+		OSVersion: osversion.Get().String(),
+	}
+}
+
 func expandEnabledCollectors(enabled string) []string {
 	// For our lightweight agent, we only support specific collectors
 	supportedCollectors := []string{"cpu", "memory", "net", "pagefile"}
@@ -26,6 +26,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Brownster/agent-windows/internal/aggregate"
+	"github.com/Brownster/agent-windows/internal/labels"
+	"github.com/Brownster/agent-windows/pkg/collector"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 )
@@ -134,7 +137,7 @@ func TestPushMetrics(t *testing.T) {
 			mu.Unlock()
 
 			ctx := context.Background()
-			err := pushMetrics(ctx, nil, tt.config, registry)
+			err := pushMetrics(ctx, nil, tt.config, nil, registry)
 			require.NoError(t, err)
 
 			mu.Lock()
@@ -188,6 +191,22 @@ func TestRunBasicValidation(t *testing.T) {
 	}
 }
 
+func TestAggregationCollectors(t *testing.T) {
+	collectors := []string{"cpu", "memory", "net", "pagefile"}
+
+	require.Equal(t, []string{"net", "cpu"}, aggregationCollectors(collectors, []aggregate.Rule{
+		{Metric: "windows_net_output_queue_length_packets"},
+		{Metric: "windows_cpu_processor_utility_total", Rate: true},
+		{Metric: "windows_net_bytes_received_total", Rate: true},
+	}))
+
+	// Metrics of the agent itself need all metrics to be gathered.
+	require.Nil(t, aggregationCollectors(collectors, []aggregate.Rule{
+		{Metric: "windows_net_output_queue_length_packets"},
+		{Metric: "go_memstats_heap_inuse_bytes"},
+	}))
+}
+
 func TestAgentCollectorWrapper(t *testing.T) {
 	// Create a mock collector
 	mockRegistry := prometheus.NewRegistry()
@@ -199,25 +218,41 @@ func TestAgentCollectorWrapper(t *testing.T) {
 	mockRegistry.MustRegister(testGauge)
 
 	// Create agent wrapper
-	wrapper := &AgentCollectorWrapper{
-		agentID: "test_agent_123",
-	}
+	wrapper, err := newAgentCollectorWrapper(collector.NewCollection(collector.Map{}), "test_agent_123",
+		map[string]string{"site": "berlin"}, labels.CollisionError, nil)
+	require.NoError(t, err)
 
-	// Test Describe
-	descs := make(chan *prometheus.Desc, 10)
-	go func() {
-		defer close(descs)
-		wrapper.Describe(descs)
-	}()
-
-	// Collect descriptions
-	var descriptions []*prometheus.Desc
-	for desc := range descs {
-		descriptions = append(descriptions, desc)
+	registry := prometheus.NewRegistry()
+	require.NoError(t, wrapper.Register(registry))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	// Should have at least some metrics
+	require.NotEmpty(t, families)
+
+	// The metrics carry the agent labels
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			got := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				got[lp.GetName()] = lp.GetValue()
+			}
+
+			require.Equal(t, "test_agent_123", got["agent_id"])
+			require.Equal(t, "berlin", got["site"])
+		}
 	}
 
-	// Should have at least some descriptions
-	require.NotEmpty(t, descriptions)
+	// The registry rejects descriptions that already have one of the labels
+	wrapper, err = newAgentCollectorWrapper(collector.NewCollection(collector.Map{}), "test_agent_123",
+		map[string]string{"collector": "cpu"}, labels.CollisionError, nil)
+	require.NoError(t, err)
+	require.Error(t, wrapper.Register(prometheus.NewRegistry()))
+
+	_, err = newAgentCollectorWrapper(collector.NewCollection(collector.Map{}), "test_agent_123",
+		map[string]string{"agent_id": "other"}, labels.CollisionError, nil)
+	require.Error(t, err)
 }
 
 func TestPushConfig(t *testing.T) {
@@ -0,0 +1,916 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/adaptive"
+	"github.com/Brownster/agent-windows/internal/buffer"
+	"github.com/Brownster/agent-windows/internal/config"
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/grouping"
+	"github.com/Brownster/agent-windows/internal/sink/file"
+	"github.com/Brownster/agent-windows/internal/sink/influxdb"
+	"github.com/Brownster/agent-windows/internal/sink/mqtt"
+	"github.com/Brownster/agent-windows/internal/sink/otlp"
+	"github.com/Brownster/agent-windows/internal/sink/remotewrite"
+	"github.com/Brownster/agent-windows/internal/sink/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	pushModePushgateway = "pushgateway"
+	pushModeRemoteWrite = "remote_write"
+	pushModeOTLP        = "otlp"
+	pushModeInfluxDB    = "influxdb"
+	pushModeStatsD      = "statsd"
+	pushModeMQTT        = "mqtt"
+	pushModeFile        = "file"
+
+	// pushMethodPut replaces all metrics of the grouping key, pushMethodPost only replaces metrics with the same name.
+	pushMethodPut  = "put"
+	pushMethodPost = "post"
+
+	// defaultTargetName is the name of the target configured by the push.* flags.
+	defaultTargetName = "default"
+)
+
+//nolint:gochecknoglobals
+var targetNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+type PushConfig struct {
+	Name     string
+	Mode     string
+	URL      string
+	Username string
+	Password string
+	// BearerToken and BearerTokenFile authenticate with a bearer token instead of basic auth.
+	BearerToken     string
+	BearerTokenFile string
+	// Headers are extra HTTP headers sent with every push.
+	Headers map[string]string
+	// OAuth2 authenticates with the OAuth2 client credentials flow if TokenURL is set.
+	OAuth2 delivery.OAuth2Config
+	// Grouping holds the grouping labels in addition to job and agent_id. Before buildPushConfigs,
+	// the values are templates.
+	Grouping map[string]string
+	// InfluxDB holds the org, bucket, token and batch size of the influxdb mode.
+	InfluxDB influxdb.Config
+	// StatsD holds the packet size of the statsd mode.
+	StatsD statsd.Config
+	// MQTT holds the client ID, topics, payload format, QoS and keep alive of the mqtt mode.
+	MQTT mqtt.Config
+	// File holds the rotation settings of the file mode. The URL is the path of the file.
+	File file.Config
+	// ResourceAttributes describe the agent in OTLP pushes. They are set by buildPushConfigs.
+	ResourceAttributes map[string]string
+	// Method is the HTTP method used to push to the Pushgateway.
+	Method string
+	// DeleteOnShutdown deletes the grouping key from the Pushgateway when the agent stops.
+	DeleteOnShutdown bool
+	// ShutdownTimeout bounds the final push and the delete when the agent stops.
+	ShutdownTimeout time.Duration
+	Interval        time.Duration
+	Timeout         time.Duration
+	AgentID         string
+	JobName         string
+	TLS             delivery.TLSConfig
+	Retry           delivery.RetryConfig
+	Buffer          buffer.Config
+}
+
+// buildPushConfigs returns the configuration of all push targets. The target configured by
+// the push.* flags is only included if it has a URL. Additional targets from the configuration
+// file inherit the interval, job name, mode, retry and buffer settings of the flags unless they
+// set their own. Credentials, headers and TLS settings are never inherited.
+//
+// The grouping templates are expanded with data.
+func buildPushConfigs(defaults PushConfig, targets []config.PushTarget, data grouping.Data) ([]PushConfig, error) {
+	var configs []PushConfig
+
+	if defaults.URL != "" {
+		defaults.Name = defaultTargetName
+		configs = append(configs, defaults)
+	}
+
+	for i, target := range targets {
+		c := defaults
+		c.Name = target.Name
+		c.URL = target.URL
+		c.Username = target.Username
+		c.Password = target.Password
+		c.BearerToken = target.BearerToken
+		c.BearerTokenFile = target.BearerTokenFile
+		c.Headers = target.Headers
+		c.OAuth2 = delivery.OAuth2Config{
+			TokenURL:         target.OAuth2.TokenURL,
+			ClientID:         target.OAuth2.ClientID,
+			ClientSecretFile: target.OAuth2.ClientSecretFile,
+			Scopes:           splitList(target.OAuth2.Scopes),
+		}
+		c.InfluxDB = influxdb.Config{
+			Org:       target.InfluxDB.Org,
+			Bucket:    target.InfluxDB.Bucket,
+			Token:     target.InfluxDB.Token,
+			TokenFile: target.InfluxDB.TokenFile,
+			BatchSize: target.InfluxDB.BatchSize,
+		}
+		c.StatsD = statsd.Config{
+			MaxPacketSize: target.StatsD.MaxPacketSize,
+		}
+		c.MQTT.ClientID = target.MQTT.ClientID
+		c.File = file.Config{
+			MaxSize:  target.File.MaxSize,
+			MaxFiles: target.File.MaxFiles,
+			Compress: target.File.Compress,
+		}
+		c.TLS = delivery.TLSConfig{
+			CAFile:             target.TLS.CAFile,
+			CertFile:           target.TLS.CertFile,
+			KeyFile:            target.TLS.KeyFile,
+			ServerName:         target.TLS.ServerName,
+			InsecureSkipVerify: target.TLS.InsecureSkipVerify,
+		}
+
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("target-%d", i+1)
+		}
+
+		if target.TLS.MinVersion != "" {
+			minVersion, err := delivery.ParseTLSVersion(target.TLS.MinVersion)
+			if err != nil {
+				return nil, fmt.Errorf("push target %q: %w", c.Name, err)
+			}
+
+			c.TLS.MinVersion = minVersion
+		}
+
+		if target.Mode != "" {
+			c.Mode = target.Mode
+		}
+
+		if target.Grouping != nil {
+			c.Grouping = target.Grouping
+		}
+
+		if target.Method != "" {
+			c.Method = target.Method
+		}
+
+		if target.DeleteOnShutdown != nil {
+			c.DeleteOnShutdown = *target.DeleteOnShutdown
+		}
+
+		if target.Interval > 0 {
+			c.Interval = target.Interval
+		}
+
+		if target.Timeout > 0 {
+			c.Timeout = target.Timeout
+		}
+
+		if target.JobName != "" {
+			c.JobName = target.JobName
+		}
+
+		if target.MQTT.Topic != "" {
+			c.MQTT.Topic = target.MQTT.Topic
+		}
+
+		if target.MQTT.StatusTopic != "" {
+			c.MQTT.StatusTopic = target.MQTT.StatusTopic
+		}
+
+		if target.MQTT.Format != "" {
+			c.MQTT.Format = target.MQTT.Format
+		}
+
+		if target.MQTT.QoS != nil {
+			if *target.MQTT.QoS < 0 || *target.MQTT.QoS > 2 {
+				return nil, fmt.Errorf("push target %q: invalid MQTT QoS %d", c.Name, *target.MQTT.QoS)
+			}
+
+			c.MQTT.QoS = byte(*target.MQTT.QoS)
+		}
+
+		if target.MQTT.KeepAlive > 0 {
+			c.MQTT.KeepAlive = target.MQTT.KeepAlive
+		}
+
+		switch {
+		case !targetNameRegexp.MatchString(c.Name):
+			return nil, fmt.Errorf("push target %q: name may only contain letters, digits, '_', '.' and '-'", c.Name)
+		case c.URL == "":
+			return nil, fmt.Errorf("push target %q: url is required", c.Name)
+		case !slices.Contains([]string{pushModePushgateway, pushModeRemoteWrite, pushModeOTLP, pushModeInfluxDB, pushModeStatsD, pushModeMQTT, pushModeFile}, c.Mode):
+			return nil, fmt.Errorf("push target %q: unknown mode %q", c.Name, c.Mode)
+		case c.Method != "" && c.Method != pushMethodPut && c.Method != pushMethodPost:
+			return nil, fmt.Errorf("push target %q: unknown method %q", c.Name, c.Method)
+		}
+
+		configs = append(configs, c)
+	}
+
+	seen := map[string]bool{}
+
+	for i, c := range configs {
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate push target name %q", c.Name)
+		}
+
+		if c.Interval <= 0 {
+			return nil, fmt.Errorf("push target %q: interval must be positive", c.Name)
+		}
+
+		if c.BearerToken != "" && c.BearerTokenFile != "" {
+			return nil, fmt.Errorf("push target %q: bearer token and bearer token file are mutually exclusive", c.Name)
+		}
+
+		bearer := c.BearerToken != "" || c.BearerTokenFile != ""
+		oauth2 := c.OAuth2.TokenURL != ""
+
+		if (c.Username != "" && (bearer || oauth2)) || (bearer && oauth2) {
+			return nil, fmt.Errorf("push target %q: basic auth, bearer token and OAuth2 are mutually exclusive", c.Name)
+		}
+
+		if (c.InfluxDB.Token != "" || c.InfluxDB.TokenFile != "") && (c.Username != "" || bearer || oauth2) {
+			return nil, fmt.Errorf("push target %q: the InfluxDB token can't be combined with other authentication", c.Name)
+		}
+
+		if c.Mode == pushModeMQTT && (bearer || oauth2 || len(c.Headers) > 0) {
+			return nil, fmt.Errorf("push target %q: MQTT only supports basic auth", c.Name)
+		}
+
+		if c.OAuth2.TokenURL != "" && (c.OAuth2.ClientID == "" || c.OAuth2.ClientSecretFile == "") {
+			return nil, fmt.Errorf("push target %q: OAuth2 requires a client ID and a client secret file", c.Name)
+		}
+
+		seen[c.Name] = true
+
+		groupingLabels, err := grouping.Expand(c.Grouping, data)
+		if err != nil {
+			return nil, fmt.Errorf("push target %q: %w", c.Name, err)
+		}
+
+		configs[i].Grouping = groupingLabels
+
+		if c.Mode == pushModeOTLP {
+			configs[i].ResourceAttributes = resourceAttributes(configs[i], data)
+		}
+
+		// Each target replays its own backlog, so each needs its own buffer directory.
+		if c.Buffer.Path != "" {
+			configs[i].Buffer.Path = filepath.Join(c.Buffer.Path, c.Name)
+			configs[i].Buffer.LatestOnly = !preservesTimestamps(c.Mode)
+		}
+	}
+
+	return configs, nil
+}
+
+// preservesTimestamps reports whether the target of a push mode stores the snapshots with their
+// timestamps. Other targets keep only the latest value of a series, so replaying older snapshots
+// to them does not fill any gaps.
+func preservesTimestamps(mode string) bool {
+	switch mode {
+	case pushModeRemoteWrite, pushModeOTLP, pushModeInfluxDB, pushModeFile:
+		return true
+	default:
+		return false
+	}
+}
+
+// resourceAttributes returns the OTLP resource attributes of the agent, following the OpenTelemetry
+// semantic conventions. The grouping labels are added as well, so they identify the agent like
+// they do on the Pushgateway.
+func resourceAttributes(config PushConfig, data grouping.Data) map[string]string {
+	attributes := map[string]string{
+		"service.name":        config.JobName,
+		"service.instance.id": config.AgentID,
+		grouping.AgentIDLabel: config.AgentID,
+		"host.name":           data.Hostname,
+		"os.type":             "windows",
+		"os.version":          data.OSVersion,
+	}
+
+	for name, value := range config.Grouping {
+		attributes[name] = value
+	}
+
+	for name, value := range attributes {
+		if value == "" {
+			delete(attributes, name)
+		}
+	}
+
+	return attributes
+}
+
+// runPushTargets runs an independent push loop for each target until ctx is done or the service is stopped.
+// buffers holds the offline buffer of each target, or nil if buffering is disabled.
+// telemetry records the pushes of each target.
+// controller switches the push intervals to burst mode, or is nil if adaptive intervals are disabled.
+func runPushTargets(ctx context.Context, logger *slog.Logger, configs []PushConfig, gatherer prometheus.Gatherer, buffers []*buffer.Buffer, telemetry []*delivery.Telemetry, controller *adaptive.Controller) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	clients := make([]*http.Client, len(configs))
+	senders := make([]delivery.Sender, len(configs))
+
+	for i, config := range configs {
+		client, err := newHTTPClient(config)
+		if err != nil {
+			return fmt.Errorf("push target %s: %w", config.Name, err)
+		}
+
+		client.Transport = telemetry[i].RoundTripper(client.Transport)
+
+		clients[i] = client
+
+		senders[i], err = newSender(logger, config, client)
+		if err != nil {
+			return fmt.Errorf("push target %s: %w", config.Name, err)
+		}
+
+		senders[i] = telemetry[i].Sender(senders[i])
+	}
+
+	// The collectors are not safe for concurrent use. The gatherer is already locked if it is
+	// shared with the local endpoint.
+	if _, ok := gatherer.(*lockedGatherer); !ok {
+		gatherer = &lockedGatherer{gatherer: gatherer}
+	}
+
+	errCh := make(chan error, len(configs))
+	wg := sync.WaitGroup{}
+
+	for i, config := range configs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			targetLogger := logger.With(slog.String("target", config.Name))
+
+			if err := runPushGateway(ctx, targetLogger, config, gatherer, senders[i], buffers[i], controller); err != nil {
+				errCh <- fmt.Errorf("push target %s: %w", config.Name, err)
+			}
+
+			// The push loop only stops when the agent is stopped. The final push must not be canceled as well.
+			shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.ShutdownTimeout)
+			defer cancel()
+
+			shutdownPushTarget(shutdownCtx, targetLogger, config, gatherer, senders[i], clients[i], buffers[i])
+		}()
+	}
+
+	wg.Wait()
+	close(errCh)
+
+	var errs []error
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// lockedGatherer serializes calls to Gather of the wrapped gatherer.
+type lockedGatherer struct {
+	mu       sync.Mutex
+	gatherer prometheus.Gatherer
+}
+
+func (g *lockedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.gatherer.Gather()
+}
+
+// runPushGateway pushes the metrics once at startup, and then on the wall-clock aligned schedule
+// of the agent. A push that takes longer than the interval skips the pushes it overlapped,
+// instead of starting them late. When the mode of the controller changes, the schedule of the
+// new interval takes effect immediately.
+func runPushGateway(ctx context.Context, logger *slog.Logger, config PushConfig, gatherer prometheus.Gatherer, sender delivery.Sender, offlineBuffer *buffer.Buffer, controller *adaptive.Controller) error {
+	retrier := delivery.NewRetrier(config.Retry)
+
+	// Initial push
+	controller.Observe(deliverMetrics(ctx, logger, config, gatherer, sender, retrier, offlineBuffer))
+
+	for {
+		// The interval bounds the time of a push, so a push in burst mode is bounded by the burst interval.
+		current := config
+		current.Interval = controller.Interval(config.Interval)
+
+		schedule := delivery.NewSchedule(current.Interval, config.AgentID)
+		next := schedule.Next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil
+		case <-controller.Changed():
+			timer.Stop()
+
+			continue
+		case <-timer.C:
+			controller.Observe(deliverMetrics(ctx, logger, current, gatherer, sender, retrier, offlineBuffer))
+		}
+
+		if missed := schedule.Missed(next, time.Now()); missed > 0 {
+			logger.LogAttrs(ctx, slog.LevelWarn, "Push took longer than the interval, skipping overlapped pushes",
+				slog.Int("skipped", missed),
+			)
+		}
+	}
+}
+
+// deliverMetrics pushes the metrics once per interval. Retries are bounded by the push interval,
+// so a slow or flapping gateway never delays the next interval.
+//
+// If an offline buffer is configured, snapshots that could not be delivered are stored on disk.
+// While the buffer is not empty, new snapshots are appended to it and the buffer is replayed
+// oldest first, so the gateway always receives the snapshots in the order they were taken.
+//
+// It returns the gathered snapshot, which is empty if the metrics could not be gathered.
+func deliverMetrics(ctx context.Context, logger *slog.Logger, config PushConfig, gatherer prometheus.Gatherer, sender delivery.Sender, retrier *delivery.Retrier, offlineBuffer *buffer.Buffer) delivery.Snapshot {
+	pushCtx, cancel := context.WithTimeout(ctx, config.Interval)
+	defer cancel()
+
+	snapshot, err := delivery.Gather(gatherer)
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "Failed to gather metrics",
+			slog.Any("err", err),
+		)
+
+		return delivery.Snapshot{}
+	}
+
+	stateBefore := retrier.State()
+
+	if offlineBuffer != nil && offlineBuffer.Len() > 0 {
+		if err = offlineBuffer.Append(snapshot); err != nil {
+			logger.LogAttrs(ctx, slog.LevelWarn, "Failed to buffer metrics",
+				slog.Any("err", err),
+			)
+		}
+
+		err = retrier.Do(pushCtx, func(ctx context.Context) error {
+			return offlineBuffer.Replay(ctx, sender.Send)
+		})
+	} else {
+		err = retrier.Do(pushCtx, func(ctx context.Context) error {
+			return sender.Send(ctx, snapshot)
+		})
+
+		if offlineBuffer != nil && delivery.IsRetryable(err) {
+			if bufferErr := offlineBuffer.Append(snapshot); bufferErr != nil {
+				logger.LogAttrs(ctx, slog.LevelWarn, "Failed to buffer metrics",
+					slog.Any("err", bufferErr),
+				)
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, delivery.ErrBackoff), errors.Is(err, delivery.ErrCircuitOpen):
+		logger.LogAttrs(ctx, slog.LevelDebug, "Skipping metrics push",
+			slog.Any("err", err),
+		)
+	case delivery.IsRetryable(err):
+		logger.LogAttrs(ctx, slog.LevelWarn, "Metrics push failed",
+			slog.Any("err", err),
+		)
+	default:
+		logger.LogAttrs(ctx, slog.LevelError, "Metrics push failed with a non-retryable error",
+			slog.Any("err", err),
+		)
+	}
+
+	if stateAfter := retrier.State(); stateAfter != stateBefore {
+		level := slog.LevelInfo
+		if stateAfter == delivery.BreakerOpen {
+			level = slog.LevelWarn
+		}
+
+		logger.LogAttrs(ctx, level, "Push circuit breaker is "+stateAfter.String(),
+			slog.Duration("timeout", config.Retry.BreakerTimeout),
+		)
+	}
+
+	return snapshot
+}
+
+// shutdownPushTarget pushes the current metrics a last time, so the latest values are not lost when the
+// agent stops. Snapshots that can't be delivered before ctx is done are kept in the offline buffer.
+// Afterward, the grouping key is deleted from the Pushgateway if DeleteOnShutdown is set.
+func shutdownPushTarget(ctx context.Context, logger *slog.Logger, config PushConfig, gatherer prometheus.Gatherer, sender delivery.Sender, client delivery.Doer, offlineBuffer *buffer.Buffer) {
+	snapshot, err := delivery.Gather(gatherer)
+	if err != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "Failed to gather metrics for the final push",
+			slog.Any("err", err),
+		)
+	} else {
+		// There is no next interval to back off to, so the retrier is bypassed.
+		if offlineBuffer != nil && offlineBuffer.Len() > 0 {
+			if err = offlineBuffer.Append(snapshot); err == nil {
+				err = offlineBuffer.Replay(ctx, sender.Send)
+			}
+		} else if err = sender.Send(ctx, snapshot); err != nil && offlineBuffer != nil && delivery.IsRetryable(err) {
+			if bufferErr := offlineBuffer.Append(snapshot); bufferErr != nil {
+				err = errors.Join(err, bufferErr)
+			}
+		}
+
+		if err == nil && offlineBuffer != nil && offlineBuffer.Len() > 0 {
+			err = fmt.Errorf("%d snapshots remain in the offline buffer: %w", offlineBuffer.Len(), ctx.Err())
+		}
+
+		if err != nil {
+			logger.LogAttrs(ctx, slog.LevelWarn, "Final metrics push failed",
+				slog.Any("err", err),
+			)
+		} else {
+			logger.LogAttrs(ctx, slog.LevelDebug, "Pushed metrics before shutdown")
+		}
+	}
+
+	if closer, ok := sender.(closingSender); ok {
+		if err = closer.Close(ctx); err != nil {
+			logger.LogAttrs(ctx, slog.LevelWarn, "Failed to close the connection to the push target",
+				slog.Any("err", err),
+			)
+		}
+	}
+
+	if !config.DeleteOnShutdown || config.Mode != pushModePushgateway {
+		return
+	}
+
+	if err = deleteMetrics(ctx, config, client); err != nil {
+		logger.LogAttrs(ctx, slog.LevelWarn, "Failed to delete metrics from the push gateway",
+			slog.Any("err", err),
+		)
+
+		return
+	}
+
+	logger.LogAttrs(ctx, slog.LevelInfo, "Deleted metrics from the push gateway")
+}
+
+// newSender returns the delivery.Sender for the configured push mode.
+// Each attempt is bounded by the timeout of the target, if one is set.
+func newSender(logger *slog.Logger, config PushConfig, client *http.Client) (delivery.Sender, error) {
+	var sender delivery.Sender
+
+	switch config.Mode {
+	case pushModeRemoteWrite:
+		sender = remotewrite.New(remotewrite.Config{
+			URL:            config.URL,
+			Username:       config.Username,
+			Password:       config.Password,
+			ExternalLabels: externalLabels(config),
+		}, client)
+	case pushModeOTLP:
+		sender = otlp.New(otlp.Config{
+			URL:                config.URL,
+			Username:           config.Username,
+			Password:           config.Password,
+			ResourceAttributes: config.ResourceAttributes,
+		}, client)
+	case pushModeInfluxDB:
+		influxConfig := config.InfluxDB
+		influxConfig.URL = config.URL
+		influxConfig.Tags = externalLabels(config)
+
+		influxClient, err := influxdb.New(influxConfig, client)
+		if err != nil {
+			return nil, err
+		}
+
+		sender = influxClient
+	case pushModeStatsD:
+		statsdConfig := config.StatsD
+		statsdConfig.URL = config.URL
+		statsdConfig.Tags = externalLabels(config)
+
+		statsdClient, err := statsd.New(statsdConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		sender = statsdClient
+	case pushModeMQTT:
+		tlsConfig, err := delivery.NewTLSConfig(targetTLS(config))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+
+		mqttConfig := config.MQTT
+		mqttConfig.URL = config.URL
+		mqttConfig.Username = config.Username
+		mqttConfig.Password = config.Password
+		mqttConfig.TLS = tlsConfig
+		mqttConfig.Labels = externalLabels(config)
+
+		// Brokers disconnect an existing client when another one connects with the same ID.
+		if mqttConfig.ClientID == "" {
+			mqttConfig.ClientID = "windows_agent_collector_" + config.AgentID
+			if config.Name != defaultTargetName {
+				mqttConfig.ClientID += "_" + config.Name
+			}
+		}
+
+		mqttClient, err := mqtt.New(mqttConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		sender = mqttClient
+	case pushModeFile:
+		fileConfig := config.File
+		fileConfig.Path = config.URL
+
+		fileClient, err := file.New(fileConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		sender = fileClient
+	default:
+		sender = delivery.SenderFunc(func(ctx context.Context, snapshot delivery.Snapshot) error {
+			return pushMetrics(ctx, logger, config, client, snapshot.Gatherer())
+		})
+	}
+
+	if config.Timeout <= 0 {
+		return sender, nil
+	}
+
+	return &timeoutSender{sender: sender, timeout: config.Timeout}, nil
+}
+
+// closingSender is implemented by senders that keep a connection to the target, such as MQTT.
+// The connection is closed when the agent stops.
+type closingSender interface {
+	delivery.Sender
+	Close(ctx context.Context) error
+}
+
+// timeoutSender bounds each attempt of the wrapped sender by a timeout.
+type timeoutSender struct {
+	sender  delivery.Sender
+	timeout time.Duration
+}
+
+func (s *timeoutSender) Send(ctx context.Context, snapshot delivery.Snapshot) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.sender.Send(ctx, snapshot)
+}
+
+func (s *timeoutSender) Close(ctx context.Context) error {
+	if closer, ok := s.sender.(closingSender); ok {
+		return closer.Close(ctx)
+	}
+
+	return nil
+}
+
+// externalLabels returns the labels that the Pushgateway derives from the grouping key.
+// Other push modes add them to every series.
+func externalLabels(config PushConfig) map[string]string {
+	labels := map[string]string{
+		"job":                 config.JobName,
+		grouping.AgentIDLabel: config.AgentID,
+	}
+
+	for name, value := range config.Grouping {
+		labels[name] = value
+	}
+
+	return labels
+}
+
+// targetTLS returns the TLS configuration of the target with the host of its URL, so the server
+// certificate can also be verified for URLs with an IP address.
+func targetTLS(config PushConfig) delivery.TLSConfig {
+	tlsConfig := config.TLS
+
+	if u, err := url.Parse(config.URL); err == nil {
+		tlsConfig.Host = u.Hostname()
+	}
+
+	return tlsConfig
+}
+
+// newHTTPClient returns the HTTP client used to push to the target.
+// Basic auth is set by the push clients, all other authentication is handled by the client.
+func newHTTPClient(config PushConfig) (*http.Client, error) {
+	transport, err := delivery.NewTransport(targetTLS(config))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	var rt http.RoundTripper = transport
+
+	if len(config.Headers) > 0 {
+		rt, err = delivery.NewHeadersRoundTripper(config.Headers, rt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid headers: %w", err)
+		}
+	}
+
+	switch {
+	case config.BearerToken != "" || config.BearerTokenFile != "":
+		rt = delivery.NewBearerTokenRoundTripper(config.BearerToken, config.BearerTokenFile, rt)
+	case config.OAuth2.TokenURL != "":
+		rt = delivery.NewOAuth2RoundTripper(config.OAuth2, rt)
+	}
+
+	return &http.Client{Transport: rt}, nil
+}
+
+// newPusher returns a push.Pusher for the grouping key of the agent. If client is nil, http.DefaultClient is used.
+func newPusher(config PushConfig, client delivery.Doer) *push.Pusher {
+	pusher := push.New(config.URL, config.JobName).
+		Client(delivery.NewStatusClient(client)).
+		Grouping(grouping.AgentIDLabel, config.AgentID)
+
+	for name, value := range config.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	if config.Username != "" && config.Password != "" {
+		pusher = pusher.BasicAuth(config.Username, config.Password)
+	}
+
+	return pusher
+}
+
+// pushMetrics pushes the metrics of gatherer to the Pushgateway. If client is nil, http.DefaultClient is used.
+//
+// With the post method, only metrics with the same name as the pushed metrics are replaced.
+// Otherwise, all metrics of the grouping key are replaced.
+func pushMetrics(ctx context.Context, logger *slog.Logger, config PushConfig, client delivery.Doer, gatherer prometheus.Gatherer) error {
+	groupingKey := map[string]string{grouping.AgentIDLabel: config.AgentID}
+	for name, value := range config.Grouping {
+		groupingKey[name] = value
+	}
+
+	pusher := newPusher(config, client).Gatherer(withoutGroupingLabels(gatherer, groupingKey))
+
+	start := time.Now()
+
+	var err error
+	if config.Method == pushMethodPost {
+		err = pusher.AddContext(ctx)
+	} else {
+		err = pusher.PushContext(ctx)
+	}
+
+	duration := time.Since(start)
+
+	if err != nil {
+		// Failures are reported once per interval by deliverMetrics.
+		if logger != nil {
+			logger.LogAttrs(ctx, slog.LevelDebug, "Failed to push metrics",
+				slog.Any("err", err),
+				slog.Duration("duration", duration),
+			)
+		}
+		return err
+	}
+
+	if logger != nil {
+		logger.LogAttrs(ctx, slog.LevelDebug, "Successfully pushed metrics",
+			slog.Duration("duration", duration),
+		)
+	}
+
+	return nil
+}
+
+// withoutGroupingLabels returns a gatherer that removes the labels of the grouping key from the metrics of g.
+// The Pushgateway adds them to all metrics, but rejects pushed metrics that already have one of them.
+// Labels with a different value than in the grouping key are kept, so the push fails instead of
+// silently changing the value. The families of g are not modified.
+func withoutGroupingLabels(g prometheus.Gatherer, groupingKey map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]*dto.MetricFamily, len(families))
+
+		for i, family := range families {
+			metrics := make([]*dto.Metric, len(family.GetMetric()))
+
+			for j, m := range family.GetMetric() {
+				labels := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+
+				for _, lp := range m.GetLabel() {
+					if value, ok := groupingKey[lp.GetName()]; !ok || value != lp.GetValue() {
+						labels = append(labels, lp)
+					}
+				}
+
+				metrics[j] = &dto.Metric{
+					Label:       labels,
+					Gauge:       m.Gauge,
+					Counter:     m.Counter,
+					Summary:     m.Summary,
+					Untyped:     m.Untyped,
+					Histogram:   m.Histogram,
+					TimestampMs: m.TimestampMs,
+				}
+			}
+
+			result[i] = &dto.MetricFamily{
+				Name:   family.Name,
+				Help:   family.Help,
+				Type:   family.Type,
+				Unit:   family.Unit,
+				Metric: metrics,
+			}
+		}
+
+		return result, nil
+	})
+}
+
+// deleteMetrics deletes all metrics of the grouping key of the agent from the Pushgateway.
+func deleteMetrics(ctx context.Context, config PushConfig, client delivery.Doer) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// Pusher.Delete does not take a context, so the client attaches it to the request.
+	return newPusher(config, &contextDoer{ctx: ctx, client: client}).Delete()
+}
+
+// contextDoer sends all requests with ctx.
+type contextDoer struct {
+	ctx    context.Context //nolint:containedctx
+	client delivery.Doer
+}
+
+func (d *contextDoer) Do(req *http.Request) (*http.Response, error) {
+	return d.client.Do(req.WithContext(d.ctx))
+}
+
+// splitList splits a comma-separated list and drops empty elements.
+func splitList(s string) []string {
+	var list []string
+
+	for _, element := range strings.Split(s, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+
+	return list
+}
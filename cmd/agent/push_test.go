@@ -0,0 +1,533 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/adaptive"
+	"github.com/Brownster/agent-windows/internal/buffer"
+	"github.com/Brownster/agent-windows/internal/config"
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/grouping"
+	"github.com/Brownster/agent-windows/internal/sink/mqtt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+)
+
+// sortGroupingKey sorts the grouping labels after the job in a Pushgateway URL path.
+// The push client adds them in random order.
+func sortGroupingKey(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+
+	var pairs []string
+	for i := 2; i+1 < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+"/"+parts[i+1])
+	}
+
+	slices.Sort(pairs)
+
+	return "/metrics/" + strings.Join(append(parts[:2:2], pairs...), "/")
+}
+
+// testTelemetry returns unregistered push telemetry for n targets.
+func testTelemetry(n int) []*delivery.Telemetry {
+	telemetry := make([]*delivery.Telemetry, n)
+	for i := range telemetry {
+		telemetry[i] = delivery.NewTelemetry()
+	}
+
+	return telemetry
+}
+
+func TestBuildPushConfigs(t *testing.T) {
+	defaults := PushConfig{
+		Mode:     pushModePushgateway,
+		URL:      "http://gateway:9091",
+		Username: "user",
+		Password: "pass",
+		Interval: 30 * time.Second,
+		AgentID:  "agent_001",
+		JobName:  "windows_agent",
+		Grouping: map[string]string{"hostname": "{{ .Hostname | lower }}"},
+		Buffer:   buffer.Config{Path: "buffer"},
+	}
+
+	configs, err := buildPushConfigs(defaults, []config.PushTarget{
+		{
+			Name:     "central",
+			Mode:     pushModeRemoteWrite,
+			URL:      "http://central/api/v1/write",
+			Interval: time.Minute,
+			OAuth2: config.PushOAuth2Config{
+				TokenURL:         "http://idp/token",
+				ClientID:         "agent",
+				ClientSecretFile: "secret",
+				Scopes:           "metrics.write, metrics.read",
+			},
+		},
+		{URL: "http://backup:9091", Grouping: map[string]string{"site": "backup"}},
+		{Name: "otel", Mode: pushModeOTLP, URL: "http://otel-collector:4318/v1/metrics"},
+	}, grouping.Data{AgentID: "agent_001", Hostname: "WS-0042", OSVersion: "10.0.22631"})
+	require.NoError(t, err)
+	require.Len(t, configs, 4)
+
+	require.Equal(t, defaultTargetName, configs[0].Name)
+	require.Equal(t, "user", configs[0].Username)
+	require.Equal(t, filepath.Join("buffer", defaultTargetName), configs[0].Buffer.Path)
+	require.True(t, configs[0].Buffer.LatestOnly, "the Pushgateway keeps only the latest snapshot")
+	require.Equal(t, map[string]string{"hostname": "ws-0042"}, configs[0].Grouping)
+
+	require.Equal(t, "central", configs[1].Name)
+	require.Equal(t, pushModeRemoteWrite, configs[1].Mode)
+	require.Equal(t, time.Minute, configs[1].Interval)
+	require.Empty(t, configs[1].Username)
+	require.Equal(t, "agent_001", configs[1].AgentID)
+	require.Equal(t, filepath.Join("buffer", "central"), configs[1].Buffer.Path)
+	require.False(t, configs[1].Buffer.LatestOnly)
+	require.Equal(t, []string{"metrics.write", "metrics.read"}, configs[1].OAuth2.Scopes)
+
+	require.Equal(t, "target-2", configs[2].Name)
+	require.Equal(t, pushModePushgateway, configs[2].Mode)
+	require.Equal(t, 30*time.Second, configs[2].Interval)
+	require.Equal(t, "windows_agent", configs[2].JobName)
+	require.Equal(t, map[string]string{"site": "backup"}, configs[2].Grouping)
+	require.Nil(t, configs[2].ResourceAttributes)
+
+	require.Equal(t, pushModeOTLP, configs[3].Mode)
+	require.Equal(t, map[string]string{
+		"service.name":        "windows_agent",
+		"service.instance.id": "agent_001",
+		"agent_id":            "agent_001",
+		"host.name":           "WS-0042",
+		"os.type":             "windows",
+		"os.version":          "10.0.22631",
+		"hostname":            "ws-0042",
+	}, configs[3].ResourceAttributes)
+}
+
+func TestNewSenderAuthentication(t *testing.T) {
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	config := PushConfig{
+		Mode:            pushModePushgateway,
+		URL:             server.URL,
+		BearerTokenFile: tokenFile,
+		Headers:         map[string]string{"X-Scope-OrgID": "tenant-1"},
+		AgentID:         "agent",
+		JobName:         "job",
+	}
+
+	client, err := newHTTPClient(config)
+	require.NoError(t, err)
+
+	sender, err := newSender(nil, config, client)
+	require.NoError(t, err)
+
+	snapshot, err := delivery.Gather(prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, sender.Send(context.Background(), snapshot))
+
+	require.Equal(t, "Bearer secret", header.Get("Authorization"))
+	require.Equal(t, "tenant-1", header.Get("X-Scope-OrgID"))
+}
+
+func TestBuildPushConfigsMQTT(t *testing.T) {
+	defaults := PushConfig{
+		Mode:     pushModeMQTT,
+		URL:      "mqtt://broker:1883",
+		Interval: 30 * time.Second,
+		MQTT: mqtt.Config{
+			ClientID:    "agent",
+			Topic:       mqtt.DefaultTopic,
+			StatusTopic: mqtt.DefaultStatusTopic,
+			Format:      mqtt.FormatJSON,
+			QoS:         1,
+		},
+	}
+
+	qos := 0
+
+	configs, err := buildPushConfigs(defaults, []config.PushTarget{{
+		Name: "backup",
+		URL:  "mqtts://backup:8883",
+		MQTT: config.PushMQTTConfig{Format: mqtt.FormatText, QoS: &qos},
+	}}, grouping.Data{})
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	// The topics are inherited, the client ID is not.
+	require.Equal(t, mqtt.Config{
+		Topic:       mqtt.DefaultTopic,
+		StatusTopic: mqtt.DefaultStatusTopic,
+		Format:      mqtt.FormatText,
+		QoS:         0,
+	}, configs[1].MQTT)
+}
+
+func TestNewSenderStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	sender, err := newSender(nil, PushConfig{
+		Mode:     pushModeStatsD,
+		URL:      "udp://" + conn.LocalAddr().String(),
+		Grouping: map[string]string{"site": "berlin"},
+		AgentID:  "agent",
+		JobName:  "job",
+	}, nil)
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"}))
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+	require.NoError(t, sender.Send(context.Background(), snapshot))
+
+	buf := make([]byte, 65536)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "test_gauge:0|g|#agent_id:agent,job:job,site:berlin", string(buf[:n]))
+}
+
+func TestRunPushTargetsShutdown(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+sortGroupingKey(r.URL.Path))
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_metric", Help: "A test metric"}))
+
+	configs := []PushConfig{{
+		Name:             "gateway",
+		Mode:             pushModePushgateway,
+		URL:              server.URL,
+		Grouping:         map[string]string{"site": "berlin/dc-1"},
+		Method:           pushMethodPost,
+		DeleteOnShutdown: true,
+		ShutdownTimeout:  time.Second,
+		Interval:         time.Hour,
+		AgentID:          "agent",
+		JobName:          "job",
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := runPushTargets(ctx, slog.New(slog.DiscardHandler), configs, registry, make([]*buffer.Buffer, len(configs)), testTelemetry(len(configs)), nil)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The initial push, the final push and the delete.
+	require.Equal(t, []string{
+		"POST /metrics/job/job/agent_id/agent/site@base64/YmVybGluL2RjLTE",
+		"POST /metrics/job/job/agent_id/agent/site@base64/YmVybGluL2RjLTE",
+		"DELETE /metrics/job/job/agent_id/agent/site@base64/YmVybGluL2RjLTE",
+	}, requests)
+}
+
+func TestRunPushTargetsTelemetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures []float64
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+
+		for {
+			var mf dto.MetricFamily
+			if err := decoder.Decode(&mf); err != nil {
+				break
+			}
+
+			if mf.GetName() != "windows_agent_push_failures_total" {
+				continue
+			}
+
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "reason" && lp.GetValue() == delivery.FailureHTTP5xx {
+						failures = append(failures, m.GetCounter().GetValue())
+					}
+				}
+			}
+		}
+
+		// The initial push fails, the final push succeeds.
+		if len(failures) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	configs := []PushConfig{{
+		Name:            "gateway",
+		Mode:            pushModePushgateway,
+		URL:             server.URL,
+		Method:          pushMethodPut,
+		ShutdownTimeout: time.Second,
+		Interval:        time.Hour,
+		AgentID:         "agent",
+		JobName:         "job",
+	}}
+
+	telemetry := []*delivery.Telemetry{delivery.NewTelemetry()}
+
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(prometheus.Labels{"target": "gateway"}, registry).MustRegister(telemetry[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := runPushTargets(ctx, slog.New(slog.DiscardHandler), configs, registry, make([]*buffer.Buffer, len(configs)), telemetry, nil)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The final push reports the failure of the initial push.
+	require.Equal(t, []float64{0, 1}, failures)
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`# HELP windows_agent_push_attempts_total Number of push attempts, including retries and replays of the offline buffer.
+# TYPE windows_agent_push_attempts_total counter
+windows_agent_push_attempts_total{target="gateway"} 2
+`), "windows_agent_push_attempts_total"))
+}
+
+func TestRunPushTargetsInvalidTLS(t *testing.T) {
+	configs := []PushConfig{{
+		Name:     "secure",
+		Mode:     pushModePushgateway,
+		URL:      "https://gateway:9091",
+		Interval: time.Second,
+		TLS:      delivery.TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	}}
+
+	err := runPushTargets(context.Background(), slog.New(slog.DiscardHandler), configs, prometheus.NewRegistry(), make([]*buffer.Buffer, len(configs)), testTelemetry(len(configs)), nil)
+	require.ErrorContains(t, err, "invalid TLS configuration")
+}
+
+func TestBuildPushConfigsInvalid(t *testing.T) {
+	defaults := PushConfig{
+		Mode:     pushModePushgateway,
+		URL:      "http://gateway:9091",
+		Interval: 30 * time.Second,
+	}
+
+	tests := []struct {
+		name   string
+		target config.PushTarget
+	}{
+		{name: "missing url", target: config.PushTarget{Name: "a"}},
+		{name: "invalid name", target: config.PushTarget{Name: "a/b", URL: "http://a"}},
+		{name: "duplicate name", target: config.PushTarget{Name: defaultTargetName, URL: "http://a"}},
+		{name: "unknown mode", target: config.PushTarget{Name: "a", URL: "http://a", Mode: "carrier_pigeon"}},
+		{name: "basic auth and bearer token", target: config.PushTarget{Name: "a", URL: "http://a", Username: "user", BearerToken: "token"}},
+		{name: "basic auth and OAuth2", target: config.PushTarget{Name: "a", URL: "http://a", Username: "user", OAuth2: config.PushOAuth2Config{TokenURL: "http://idp/token", ClientID: "agent", ClientSecretFile: "secret"}}},
+		{name: "OAuth2 without client ID", target: config.PushTarget{Name: "a", URL: "http://a", OAuth2: config.PushOAuth2Config{TokenURL: "http://idp/token", ClientSecretFile: "secret"}}},
+		{name: "invalid grouping label", target: config.PushTarget{Name: "a", URL: "http://a", Grouping: map[string]string{"job": "other"}}},
+		{name: "unknown TLS version", target: config.PushTarget{Name: "a", URL: "https://a", TLS: config.PushTLSConfig{MinVersion: "SSL3"}}},
+		{name: "MQTT and bearer token", target: config.PushTarget{Name: "a", URL: "mqtt://a", Mode: pushModeMQTT, BearerToken: "token"}},
+		{name: "invalid MQTT QoS", target: config.PushTarget{Name: "a", URL: "mqtt://a", Mode: pushModeMQTT, MQTT: config.PushMQTTConfig{QoS: &[]int{3}[0]}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildPushConfigs(defaults, []config.PushTarget{tt.target}, grouping.Data{})
+			require.Error(t, err)
+		})
+	}
+
+	// The target of the push.* flags needs a positive interval as well.
+	defaults.Interval = 0
+
+	_, err := buildPushConfigs(defaults, nil, grouping.Data{})
+	require.ErrorContains(t, err, "interval must be positive")
+}
+
+func TestRunPushTargets(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushes int
+	)
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		pushes++
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	// A hanging target must not delay the other targets.
+	hanging := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_metric", Help: "A test metric"}))
+
+	configs := []PushConfig{
+		{Name: "healthy", Mode: pushModePushgateway, URL: healthy.URL, Interval: 50 * time.Millisecond, AgentID: "agent", JobName: "job"},
+		{Name: "hanging", Mode: pushModePushgateway, URL: hanging.URL, Interval: time.Second, AgentID: "agent", JobName: "job"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := runPushTargets(ctx, slog.New(slog.DiscardHandler), configs, registry, make([]*buffer.Buffer, len(configs)), testTelemetry(len(configs)), nil)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.GreaterOrEqual(t, pushes, 3)
+}
+
+func TestRunPushTargetsBurst(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushes int
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		pushes++
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	controller, err := adaptive.New(slog.New(slog.DiscardHandler), adaptive.Config{BurstInterval: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	configs := []PushConfig{{Name: "gateway", Mode: pushModePushgateway, URL: server.URL, Interval: time.Hour, AgentID: "agent", JobName: "job"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// The burst starts while the push loop waits for the next idle push.
+	time.AfterFunc(100*time.Millisecond, func() {
+		controller.Start(adaptive.TriggerAPI, time.Minute)
+	})
+
+	err = runPushTargets(ctx, slog.New(slog.DiscardHandler), configs, prometheus.NewRegistry(), make([]*buffer.Buffer, len(configs)), testTelemetry(len(configs)), controller)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The initial push, at least 3 pushes in burst mode and the final push.
+	require.GreaterOrEqual(t, pushes, 5)
+}
+
+func TestPushMetricsGroupingLabels(t *testing.T) {
+	var paths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		paths = append(paths, sortGroupingKey(r.URL.Path))
+	}))
+	defer server.Close()
+
+	config := PushConfig{
+		Mode:     pushModePushgateway,
+		URL:      server.URL,
+		AgentID:  "agent_001",
+		JobName:  "windows_agent",
+		Grouping: map[string]string{"site": "berlin"},
+	}
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "test_metric",
+		Help:        "A test metric",
+		ConstLabels: prometheus.Labels{grouping.AgentIDLabel: "agent_001"},
+	}, []string{"site"})
+	gauge.WithLabelValues("berlin").Set(1)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+
+	// Labels of the grouping key are removed, as the Pushgateway adds them again.
+	require.NoError(t, pushMetrics(context.Background(), nil, config, nil, registry))
+	require.Equal(t, []string{"/metrics/job/windows_agent/agent_id/agent_001/site/berlin"}, paths)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Len(t, families[0].GetMetric()[0].GetLabel(), 2, "the gathered metrics must not be modified")
+
+	// A label with a different value than the grouping key is rejected.
+	gauge.WithLabelValues("paris").Set(1)
+	require.ErrorContains(t, pushMetrics(context.Background(), nil, config, nil, registry), "grouping label site")
+}
@@ -0,0 +1,305 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package adaptive switches the push interval between an idle mode and a burst mode, so
+// WebRTC calls are recorded in high resolution while idle agents push rarely.
+//
+// A burst is started by a request to the local API, or when a condition on the pushed metrics
+// matches. It ends when it was not triggered again for the burst duration, or by a request to
+// the local API.
+package adaptive
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ModeIdle  = "idle"
+	ModeBurst = "burst"
+
+	TriggerAPI       = "api"
+	TriggerCondition = "condition"
+
+	// DefaultBurstDuration is the default time a burst lasts after it was last triggered.
+	DefaultBurstDuration = 5 * time.Minute
+	// DefaultMinInterval is the default minimum time between the samples of a rate in the condition.
+	DefaultMinInterval = time.Second
+)
+
+// Config configures a Controller.
+type Config struct {
+	// BurstInterval is the push interval during bursts.
+	BurstInterval time.Duration
+	// BurstDuration is the time a burst lasts after it was last triggered. Defaults to DefaultBurstDuration.
+	BurstDuration time.Duration
+	// Condition starts a burst when it matches a pushed snapshot. Empty disables it. See ParseCondition.
+	Condition string
+	// MinInterval is the minimum time between the samples of a rate in the condition. Defaults to
+	// DefaultMinInterval.
+	MinInterval time.Duration
+}
+
+// Controller tracks the mode of the agent. A nil Controller is always idle.
+// It implements prometheus.Collector to report the mode and the triggers of bursts.
+type Controller struct {
+	config    Config
+	condition *Condition
+	logger    *slog.Logger
+	now       func() time.Time
+
+	mu sync.Mutex
+	// until is the end of the current burst.
+	until    time.Time
+	burst    bool
+	triggers map[string]float64
+	// changed is closed and replaced when the mode changes.
+	changed chan struct{}
+
+	modeDesc     *prometheus.Desc
+	triggersDesc *prometheus.Desc
+}
+
+// New returns a Controller in idle mode.
+func New(logger *slog.Logger, config Config) (*Controller, error) {
+	if config.BurstInterval <= 0 {
+		return nil, errors.New("burst interval must be positive")
+	}
+
+	if config.BurstDuration <= 0 {
+		config.BurstDuration = DefaultBurstDuration
+	}
+
+	c := &Controller{
+		config:   config,
+		logger:   logger,
+		now:      time.Now,
+		triggers: map[string]float64{},
+		changed:  make(chan struct{}),
+
+		modeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_mode"),
+			"The current push mode. 1 for the active mode, 0 for the others.",
+			[]string{"mode"},
+			nil,
+		),
+		triggersDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_burst_triggers_total"),
+			"Number of times a burst was started or extended.",
+			[]string{"trigger"},
+			nil,
+		),
+	}
+
+	if config.Condition != "" {
+		var err error
+
+		if c.condition, err = ParseCondition(config.Condition); err != nil {
+			return nil, err
+		}
+
+		if config.MinInterval > 0 {
+			c.condition.minInterval = config.MinInterval
+		}
+	}
+
+	return c, nil
+}
+
+// Mode returns ModeBurst during a burst and ModeIdle otherwise.
+func (c *Controller) Mode() string {
+	if c == nil {
+		return ModeIdle
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mode()
+}
+
+// mode returns the current mode and ends an expired burst. c.mu must be held.
+func (c *Controller) mode() string {
+	if c.burst && !c.now().Before(c.until) {
+		c.setBurst(false)
+	}
+
+	if c.burst {
+		return ModeBurst
+	}
+
+	return ModeIdle
+}
+
+// setBurst changes the mode and notifies the waiting push loops. c.mu must be held.
+func (c *Controller) setBurst(burst bool) {
+	if c.burst == burst {
+		return
+	}
+
+	c.burst = burst
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	if burst {
+		c.logger.Info("Burst mode started",
+			slog.Duration("interval", c.config.BurstInterval),
+			slog.Time("until", c.until),
+		)
+	} else {
+		c.logger.Info("Burst mode ended")
+	}
+}
+
+// Interval returns the push interval of a target with the given idle interval. During a burst,
+// the burst interval is used, unless the idle interval is shorter.
+func (c *Controller) Interval(idle time.Duration) time.Duration {
+	if c.Mode() == ModeBurst {
+		return min(idle, c.config.BurstInterval)
+	}
+
+	return idle
+}
+
+// Changed returns a channel that is closed when the mode changes. An expired burst is only
+// noticed by the next call to Mode or Interval. The channel of a nil Controller is never closed.
+func (c *Controller) Changed() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.changed
+}
+
+// Start starts a burst, or extends the current one, so it lasts for at least d.
+func (c *Controller) Start(trigger string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mode()
+
+	if until := c.now().Add(d); until.After(c.until) || !c.burst {
+		c.until = until
+	}
+
+	c.triggers[trigger]++
+	c.setBurst(true)
+}
+
+// Stop ends the current burst.
+func (c *Controller) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.until = time.Time{}
+	c.setBurst(false)
+}
+
+// Observe starts or extends a burst if the condition matches the snapshot.
+func (c *Controller) Observe(snapshot delivery.Snapshot) {
+	if c == nil || c.condition == nil || snapshot.Timestamp.IsZero() {
+		return
+	}
+
+	c.mu.Lock()
+	matched := c.condition.Match(snapshot)
+	c.mu.Unlock()
+
+	if matched {
+		c.Start(TriggerCondition, c.config.BurstDuration)
+	}
+}
+
+// ServeHTTP implements the local API. POST starts a burst, for the duration in the optional
+// duration query parameter, DELETE ends it. All methods respond with the current mode.
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		d := c.config.BurstDuration
+
+		if s := r.URL.Query().Get("duration"); s != "" {
+			var err error
+
+			if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid duration %q", s), http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		c.Start(TriggerAPI, d)
+	case http.MethodDelete:
+		c.Stop()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	c.mu.Lock()
+	mode, until := c.mode(), c.until
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if mode == ModeBurst {
+		_, _ = fmt.Fprintf(w, "%s until %s\n", mode, until.UTC().Format(time.RFC3339))
+	} else {
+		_, _ = fmt.Fprintln(w, mode)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Controller) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.modeDesc
+	ch <- c.triggersDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Controller) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mode := c.mode()
+
+	for _, m := range []string{ModeIdle, ModeBurst} {
+		var value float64
+		if m == mode {
+			value = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.modeDesc, prometheus.GaugeValue, value, m)
+	}
+
+	for _, trigger := range []string{TriggerAPI, TriggerCondition} {
+		ch <- prometheus.MustNewConstMetric(c.triggersDesc, prometheus.CounterValue, c.triggers[trigger], trigger)
+	}
+}
@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package adaptive
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestController(t *testing.T) {
+	t.Parallel()
+
+	c, err := New(slog.New(slog.DiscardHandler), Config{BurstInterval: 5 * time.Second, BurstDuration: time.Minute})
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+
+	require.Equal(t, ModeIdle, c.Mode())
+	require.Equal(t, time.Minute, c.Interval(time.Minute))
+
+	changed := c.Changed()
+
+	c.Start(TriggerAPI, 2*time.Minute)
+	require.Equal(t, ModeBurst, c.Mode())
+	require.Equal(t, 5*time.Second, c.Interval(time.Minute))
+	require.Equal(t, time.Second, c.Interval(time.Second))
+
+	select {
+	case <-changed:
+	default:
+		require.Fail(t, "mode change was not notified")
+	}
+
+	// A shorter trigger does not shorten the burst.
+	c.Start(TriggerAPI, time.Second)
+
+	now = now.Add(119 * time.Second)
+	require.Equal(t, ModeBurst, c.Mode())
+
+	now = now.Add(time.Second)
+	require.Equal(t, ModeIdle, c.Mode())
+
+	c.Start(TriggerAPI, time.Minute)
+	c.Stop()
+	require.Equal(t, ModeIdle, c.Mode())
+
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`# HELP windows_agent_push_burst_triggers_total Number of times a burst was started or extended.
+# TYPE windows_agent_push_burst_triggers_total counter
+windows_agent_push_burst_triggers_total{trigger="api"} 3
+windows_agent_push_burst_triggers_total{trigger="condition"} 0
+# HELP windows_agent_push_mode The current push mode. 1 for the active mode, 0 for the others.
+# TYPE windows_agent_push_mode gauge
+windows_agent_push_mode{mode="burst"} 0
+windows_agent_push_mode{mode="idle"} 1
+`)))
+}
+
+func TestControllerNil(t *testing.T) {
+	t.Parallel()
+
+	var c *Controller
+
+	require.Equal(t, ModeIdle, c.Mode())
+	require.Equal(t, time.Minute, c.Interval(time.Minute))
+	require.Nil(t, c.Changed())
+
+	c.Observe(delivery.Snapshot{Timestamp: time.Now()})
+}
+
+func TestControllerObserve(t *testing.T) {
+	t.Parallel()
+
+	c, err := New(slog.New(slog.DiscardHandler), Config{
+		BurstInterval: time.Second,
+		Condition:     `rate(test_bytes_total{nic="Ethernet"}) > 1000`,
+		MinInterval:   5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_bytes_total", Help: "A test counter"}, []string{"nic"})
+	registry.MustRegister(counter)
+
+	observe := func(timestamp time.Time, ethernet, wifi float64) {
+		counter.Reset()
+		counter.WithLabelValues("Ethernet").Add(ethernet)
+		counter.WithLabelValues("Wi-Fi").Add(wifi)
+
+		snapshot, err := delivery.Gather(registry)
+		require.NoError(t, err)
+
+		snapshot.Timestamp = timestamp
+		c.now = func() time.Time { return timestamp }
+		c.Observe(snapshot)
+	}
+
+	start := time.Unix(1700000000, 0)
+
+	observe(start, 0, 0)
+
+	// The snapshot of another push target within the minimum interval is skipped.
+	observe(start.Add(10*time.Millisecond), 100, 0)
+	require.Equal(t, ModeIdle, c.Mode())
+
+	observe(start.Add(10*time.Second), 5000, 1e9)
+	require.Equal(t, ModeIdle, c.Mode())
+
+	observe(start.Add(20*time.Second), 25000, 1e9)
+	require.Equal(t, ModeBurst, c.Mode())
+
+	// A counter reset is skipped.
+	observe(start.Add(30*time.Second), 0, 0)
+	observe(start.Add(40*time.Second), 500, 0)
+	require.Equal(t, ModeBurst, c.Mode())
+
+	c.now = func() time.Time { return start.Add(20*time.Second + DefaultBurstDuration) }
+	require.Equal(t, ModeIdle, c.Mode())
+}
+
+func TestControllerServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	c, err := New(slog.New(slog.DiscardHandler), Config{BurstInterval: time.Second})
+	require.NoError(t, err)
+
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	for _, tc := range []struct {
+		method, target string
+		status         int
+		body           string
+	}{
+		{http.MethodGet, "/-/burst", http.StatusOK, "idle\n"},
+		{http.MethodPost, "/-/burst?duration=10m", http.StatusOK, "burst until 2023-11-14T22:23:20Z\n"},
+		{http.MethodPost, "/-/burst?duration=soon", http.StatusBadRequest, "invalid duration \"soon\"\n"},
+		{http.MethodDelete, "/-/burst", http.StatusOK, "idle\n"},
+		{http.MethodPut, "/-/burst", http.StatusMethodNotAllowed, "Method Not Allowed\n"},
+	} {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+
+		require.Equal(t, tc.status, w.Code, tc.method+" "+tc.target)
+		require.Equal(t, tc.body, w.Body.String(), tc.method+" "+tc.target)
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		`windows_cpu_time_total > 5`,
+		`rate(windows_net_bytes_received_total{nic="Ethernet"}) > 125000`,
+		`windows_memory_available_bytes{a="1",b="x\"y"} <= 1e+08`,
+	} {
+		c, err := ParseCondition(s)
+		require.NoError(t, err, s)
+		require.Equal(t, s, c.String())
+	}
+
+	c, err := ParseCondition(` rate( test_total { nic = "a" , } )>=1 `)
+	require.NoError(t, err)
+	require.Equal(t, `rate(test_total{nic="a"}) >= 1`, c.String())
+
+	for _, s := range []string{
+		"",
+		"test_total",
+		"test_total == 1",
+		"test_total > many",
+		"rate(test_total > 1",
+		"test_total) > 1",
+		`test_total{nic=~"a"} > 1`,
+		`test_total{nic="a" b="c"} > 1`,
+	} {
+		_, err := ParseCondition(s)
+		require.Error(t, err, s)
+	}
+}
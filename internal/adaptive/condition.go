@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package adaptive
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/series"
+	dto "github.com/prometheus/client_model/go"
+)
+
+//nolint:gochecknoglobals
+var (
+	conditionRegexp = regexp.MustCompile(`^\s*(rate\(\s*)?([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(\{[^}]*\})?\s*(\))?\s*(>=|<=|>|<)\s*(\S+)\s*$`)
+	matcherRegexp   = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*("(?:[^"\\]|\\.)*")\s*(?:,|$)`)
+)
+
+// Condition is a threshold on the value, or the per-second rate, of a series, for example
+//
+//	rate(windows_net_bytes_received_total{nic="Ethernet"}) > 125000
+//
+// The condition matches if any series with the name and labels of the selector passes the threshold.
+// Only equality label matchers are supported.
+type Condition struct {
+	name     string
+	labels   map[string]string
+	rate     bool
+	operator string
+	value    float64
+
+	// minInterval is the minimum time between the samples of a rate.
+	minInterval time.Duration
+	// previous holds the last sample of each series, to compute rates.
+	previous map[string]sample
+}
+
+type sample struct {
+	value     float64
+	timestamp time.Time
+}
+
+// ParseCondition parses a condition in the form [rate(]name[{label="value",...}][)] operator threshold.
+// Rates are computed over at least DefaultMinInterval.
+func ParseCondition(s string) (*Condition, error) {
+	m := conditionRegexp.FindStringSubmatch(s)
+	if m == nil || (m[1] == "") != (m[4] == "") {
+		return nil, fmt.Errorf("invalid condition %q", s)
+	}
+
+	value, err := strconv.ParseFloat(m[6], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid threshold in condition %q", s)
+	}
+
+	c := &Condition{
+		name:        m[2],
+		labels:      map[string]string{},
+		rate:        m[1] != "",
+		operator:    m[5],
+		value:       value,
+		minInterval: DefaultMinInterval,
+		previous:    map[string]sample{},
+	}
+
+	if m[3] != "" {
+		matchers := strings.TrimSpace(m[3][1 : len(m[3])-1])
+
+		for matchers != "" {
+			lm := matcherRegexp.FindStringSubmatch(matchers)
+			if lm == nil {
+				return nil, fmt.Errorf("invalid label matchers in condition %q", s)
+			}
+
+			c.labels[lm[1]], err = strconv.Unquote(lm[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid label value in condition %q", s)
+			}
+
+			matchers = matchers[len(lm[0]):]
+		}
+	}
+
+	return c, nil
+}
+
+// Match reports whether any series of the snapshot passes the threshold. Rates are computed
+// against the previous snapshot, so they are never matched on the first one, and series whose
+// value decreased, for example because a counter was reset, are skipped once.
+//
+// The push targets share the condition, so their snapshots may be only milliseconds apart.
+// Snapshots within the minimum interval of the previous sample of a series are skipped for
+// rates, so a rate is never computed over a shorter time.
+func (c *Condition) Match(snapshot delivery.Snapshot) bool {
+	var matched bool
+
+	previous := make(map[string]sample, len(c.previous))
+
+	for _, mf := range snapshot.Families {
+		if mf.GetName() != c.name {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			value, ok := series.Value(mf.GetType(), m)
+			if !ok || !c.matchLabels(m) {
+				continue
+			}
+
+			if !c.rate {
+				matched = matched || c.compare(value)
+
+				continue
+			}
+
+			key := series.Key(m)
+			current := sample{value: value, timestamp: snapshot.Timestamp}
+
+			last, ok := c.previous[key]
+			if ok && current.timestamp.Sub(last.timestamp) < c.minInterval {
+				previous[key] = last
+
+				continue
+			}
+
+			previous[key] = current
+
+			if ok && value >= last.value {
+				matched = matched || c.compare((value-last.value)/current.timestamp.Sub(last.timestamp).Seconds())
+			}
+		}
+	}
+
+	c.previous = previous
+
+	return matched
+}
+
+func (c *Condition) matchLabels(m *dto.Metric) bool {
+	var found int
+
+	for _, lp := range m.GetLabel() {
+		if value, ok := c.labels[lp.GetName()]; ok {
+			if value != lp.GetValue() {
+				return false
+			}
+
+			found++
+		}
+	}
+
+	return found == len(c.labels)
+}
+
+func (c *Condition) compare(value float64) bool {
+	switch c.operator {
+	case ">":
+		return value > c.value
+	case ">=":
+		return value >= c.value
+	case "<":
+		return value < c.value
+	default:
+		return value <= c.value
+	}
+}
+
+// String returns the condition as it was configured, apart from white space.
+func (c *Condition) String() string {
+	selector := c.name
+
+	if len(c.labels) > 0 {
+		matchers := make([]string, 0, len(c.labels))
+		for name, value := range c.labels {
+			matchers = append(matchers, name+"="+strconv.Quote(value))
+		}
+
+		slices.Sort(matchers)
+
+		selector += "{" + strings.Join(matchers, ",") + "}"
+	}
+
+	if c.rate {
+		selector = "rate(" + selector + ")"
+	}
+
+	return selector + " " + c.operator + " " + strconv.FormatFloat(c.value, 'g', -1, 64)
+}
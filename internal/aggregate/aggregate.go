@@ -0,0 +1,478 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package aggregate samples selected metrics more often than they are pushed, and adds
+// statistics over a sliding window to every gather. Spikes between two pushes are visible in the
+// maximum, even though a Pushgateway only keeps the last value.
+//
+// For a metric windows_net_output_queue_length_packets, the statistics are pushed as the gauges
+// windows_net_output_queue_length_packets_min, _max, _avg, _last and _quantile, with the labels
+// of the series and a quantile label. Rules with rate aggregate the per-second rate of a counter
+// instead of its value, and are named after the counter without the _total suffix, followed by
+// _per_second, for example windows_cpu_processor_utility_per_second_max.
+package aggregate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/series"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	StatMin  = "min"
+	StatMax  = "max"
+	StatAvg  = "avg"
+	StatLast = "last"
+
+	// DefaultSampleInterval is the default interval at which the metrics are sampled.
+	DefaultSampleInterval = time.Second
+
+	quantileLabel = "quantile"
+)
+
+//nolint:gochecknoglobals
+var statDescriptions = map[string]string{
+	StatMin:  "Minimum",
+	StatMax:  "Maximum",
+	StatAvg:  "Average",
+	StatLast: "Last value",
+}
+
+// Rule selects a metric and the statistics that are computed for each of its series.
+type Rule struct {
+	// Metric is the name of a gauge, counter or untyped metric.
+	Metric string
+	// Rate aggregates the per-second rate of a counter instead of its value.
+	Rate bool
+	// Statistics are StatMin, StatMax, StatAvg and StatLast. Empty means all of them.
+	Statistics []string
+	// Quantiles are computed in addition to the statistics, for example 0.5 and 0.99.
+	Quantiles []float64
+}
+
+// Config configures an Aggregator.
+type Config struct {
+	// SampleInterval is the interval at which the metrics are sampled. Defaults to DefaultSampleInterval.
+	SampleInterval time.Duration
+	// Window is the time over which the statistics are computed, usually the push interval.
+	Window time.Duration
+	Rules  []Rule
+	// Sampler is gathered by Run instead of the wrapped gatherer, so the samples between two
+	// gathers only run the collectors of the rules. Nil samples the wrapped gatherer.
+	Sampler prometheus.Gatherer
+}
+
+// Aggregator is a prometheus.Gatherer that adds the statistics of the rules to the metrics of
+// the wrapped gatherer. The samples are recorded by Run, and by every Gather. A statistic that has
+// the name of a gathered metric is left out, and the gathered metric is kept.
+type Aggregator struct {
+	gatherer prometheus.Gatherer
+	sampler  prometheus.Gatherer
+	config   Config
+	logger   *slog.Logger
+	now      func() time.Time
+
+	// mu serializes the calls to the wrapped gatherer and the sampler, and guards the recorded samples.
+	mu    sync.Mutex
+	rules []*rule
+	// collisions holds the names of the statistics that were logged as left out.
+	collisions map[string]bool
+}
+
+type rule struct {
+	Rule
+
+	name   string
+	series map[string]*samples
+}
+
+type samples struct {
+	labels []*dto.LabelPair
+	points []point
+}
+
+type point struct {
+	timestamp time.Time
+	value     float64
+}
+
+// New returns an Aggregator. It returns an error if a rule is invalid.
+func New(logger *slog.Logger, gatherer prometheus.Gatherer, config Config) (*Aggregator, error) {
+	if config.SampleInterval <= 0 {
+		config.SampleInterval = DefaultSampleInterval
+	}
+
+	if config.Window < config.SampleInterval {
+		return nil, fmt.Errorf("aggregation window %s is shorter than the sample interval %s", config.Window, config.SampleInterval)
+	}
+
+	a := &Aggregator{
+		gatherer:   gatherer,
+		sampler:    config.Sampler,
+		config:     config,
+		logger:     logger,
+		now:        time.Now,
+		collisions: map[string]bool{},
+	}
+	if a.sampler == nil {
+		a.sampler = gatherer
+	}
+
+	names := map[string]bool{}
+	metrics := map[string]bool{}
+
+	for _, r := range config.Rules {
+		metrics[r.Metric] = true
+	}
+
+	for _, r := range config.Rules {
+		if r.Metric == "" {
+			return nil, errors.New("aggregation rule without metric")
+		}
+
+		if len(r.Statistics) == 0 {
+			r.Statistics = []string{StatMin, StatMax, StatAvg, StatLast}
+		}
+
+		for _, stat := range r.Statistics {
+			if _, ok := statDescriptions[stat]; !ok {
+				return nil, fmt.Errorf("aggregation rule %s: unknown statistic %q", r.Metric, stat)
+			}
+		}
+
+		for _, q := range r.Quantiles {
+			if !(q >= 0 && q <= 1) {
+				return nil, fmt.Errorf("aggregation rule %s: quantile %v is not between 0 and 1", r.Metric, q)
+			}
+		}
+
+		name := r.Metric
+		if r.Rate {
+			name = strings.TrimSuffix(name, "_total") + "_per_second"
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("duplicate aggregation rule for %s", r.Metric)
+		}
+
+		names[name] = true
+
+		compiled := &rule{Rule: r, name: name, series: map[string]*samples{}}
+
+		for _, output := range compiled.names() {
+			if metrics[output] {
+				return nil, fmt.Errorf("aggregation rule %s: %s is the metric of another rule", r.Metric, output)
+			}
+		}
+
+		a.rules = append(a.rules, compiled)
+	}
+
+	return a, nil
+}
+
+// Run samples the metrics until ctx is done.
+func (a *Aggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.config.SampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			families, err := a.sampler.Gather()
+			a.record(families)
+			a.mu.Unlock()
+
+			if err != nil {
+				a.logger.LogAttrs(ctx, slog.LevelDebug, "Failed to sample metrics for aggregation",
+					slog.Any("err", err),
+				)
+			}
+		}
+	}
+}
+
+// Gather implements prometheus.Gatherer.
+func (a *Aggregator) Gather() ([]*dto.MetricFamily, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	families, err := a.gather()
+
+	gathered := make(map[string]bool, len(families))
+	for _, mf := range families {
+		gathered[mf.GetName()] = true
+	}
+
+	for _, mf := range a.aggregate(a.now()) {
+		if !gathered[mf.GetName()] {
+			families = append(families, mf)
+
+			continue
+		}
+
+		if !a.collisions[mf.GetName()] {
+			a.collisions[mf.GetName()] = true
+
+			a.logger.LogAttrs(context.Background(), slog.LevelWarn, "Aggregated metric has the name of a gathered metric and is left out",
+				slog.String("metric", mf.GetName()),
+			)
+		}
+	}
+
+	slices.SortFunc(families, func(a, b *dto.MetricFamily) int {
+		return cmp.Compare(a.GetName(), b.GetName())
+	})
+
+	return families, err
+}
+
+// gather gathers the wrapped gatherer and records the samples of the rules. a.mu must be held.
+func (a *Aggregator) gather() ([]*dto.MetricFamily, error) {
+	families, err := a.gatherer.Gather()
+	a.record(families)
+
+	return families, err
+}
+
+// record records the samples of the rules in families, and removes the samples that left the
+// window. a.mu must be held.
+func (a *Aggregator) record(families []*dto.MetricFamily) {
+	now := a.now()
+	cutoff := now.Add(-a.config.Window)
+
+	for _, r := range a.rules {
+		for _, mf := range families {
+			if mf.GetName() != r.Metric {
+				continue
+			}
+
+			for _, m := range mf.GetMetric() {
+				value, ok := series.Value(mf.GetType(), m)
+				if !ok {
+					continue
+				}
+
+				key := series.Key(m)
+
+				s, ok := r.series[key]
+				if !ok {
+					s = &samples{labels: m.GetLabel()}
+					r.series[key] = s
+				}
+
+				s.points = append(s.points, point{timestamp: now, value: value})
+			}
+		}
+
+		for key, s := range r.series {
+			// Rates need the last point before the window, to compute the rate at its start.
+			i, found := slices.BinarySearchFunc(s.points, cutoff, func(p point, t time.Time) int {
+				return p.timestamp.Compare(t)
+			})
+
+			if found {
+				i++
+			}
+
+			if r.Rate && i > 0 {
+				i--
+			}
+
+			s.points = slices.Delete(s.points, 0, i)
+
+			if len(s.points) == 0 {
+				delete(r.series, key)
+			}
+		}
+	}
+}
+
+// aggregate returns the statistics of the recorded samples. a.mu must be held.
+func (a *Aggregator) aggregate(now time.Time) []*dto.MetricFamily {
+	var families []*dto.MetricFamily
+
+	cutoff := now.Add(-a.config.Window)
+
+	for _, r := range a.rules {
+		stats := make(map[string]*dto.MetricFamily, len(r.Statistics)+1)
+
+		for _, stat := range r.Statistics {
+			stats[stat] = &dto.MetricFamily{
+				Name: proto.String(r.name + "_" + stat),
+				Help: proto.String(fmt.Sprintf("%s of %s over the last %s.", statDescriptions[stat], r.sourceName(), a.config.Window)),
+				Type: dto.MetricType_GAUGE.Enum(),
+			}
+		}
+
+		quantiles := &dto.MetricFamily{
+			Name: proto.String(r.name + "_" + quantileLabel),
+			Help: proto.String(fmt.Sprintf("Quantiles of %s over the last %s.", r.sourceName(), a.config.Window)),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+
+		keys := make([]string, 0, len(r.series))
+		for key := range r.series {
+			keys = append(keys, key)
+		}
+
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			s := r.series[key]
+
+			values := r.values(s, cutoff)
+			if len(values) == 0 {
+				continue
+			}
+
+			last := values[len(values)-1]
+
+			for _, stat := range r.Statistics {
+				var value float64
+
+				switch stat {
+				case StatMin:
+					value = slices.Min(values)
+				case StatMax:
+					value = slices.Max(values)
+				case StatAvg:
+					for _, v := range values {
+						value += v
+					}
+
+					value /= float64(len(values))
+				case StatLast:
+					value = last
+				}
+
+				stats[stat].Metric = append(stats[stat].Metric, gauge(s.labels, value))
+			}
+
+			if len(r.Quantiles) == 0 {
+				continue
+			}
+
+			slices.Sort(values)
+
+			for _, q := range r.Quantiles {
+				labels := append(slices.Clone(s.labels), &dto.LabelPair{
+					Name:  proto.String(quantileLabel),
+					Value: proto.String(strconv.FormatFloat(q, 'g', -1, 64)),
+				})
+				slices.SortFunc(labels, func(a, b *dto.LabelPair) int {
+					return cmp.Compare(a.GetName(), b.GetName())
+				})
+
+				quantiles.Metric = append(quantiles.Metric, gauge(labels, quantile(values, q)))
+			}
+		}
+
+		for _, stat := range r.Statistics {
+			if len(stats[stat].Metric) > 0 {
+				families = append(families, stats[stat])
+			}
+		}
+
+		if len(quantiles.Metric) > 0 {
+			families = append(families, quantiles)
+		}
+	}
+
+	return families
+}
+
+// names returns the names of the metrics of the statistics.
+func (r *rule) names() []string {
+	names := make([]string, 0, len(r.Statistics)+1)
+	for _, stat := range r.Statistics {
+		names = append(names, r.name+"_"+stat)
+	}
+
+	if len(r.Quantiles) > 0 {
+		names = append(names, r.name+"_"+quantileLabel)
+	}
+
+	return names
+}
+
+// sourceName describes the aggregated values in help texts.
+func (r *rule) sourceName() string {
+	if r.Rate {
+		return "the per-second rate of " + r.Metric
+	}
+
+	return r.Metric
+}
+
+// values returns the values of the series in the window (cutoff, now], oldest first. For rate rules, these are
+// the rates between consecutive samples. Counter resets are skipped.
+func (r *rule) values(s *samples, cutoff time.Time) []float64 {
+	values := make([]float64, 0, len(s.points))
+
+	for i, p := range s.points {
+		if !p.timestamp.After(cutoff) {
+			continue
+		}
+
+		if !r.Rate {
+			values = append(values, p.value)
+
+			continue
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		previous := s.points[i-1]
+		if seconds := p.timestamp.Sub(previous.timestamp).Seconds(); seconds > 0 && p.value >= previous.value {
+			values = append(values, (p.value-previous.value)/seconds)
+		}
+	}
+
+	return values
+}
+
+// quantile returns the q-quantile of sorted values, interpolating linearly between the closest ranks.
+func quantile(sorted []float64, q float64) float64 {
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func gauge(labels []*dto.LabelPair, value float64) *dto.Metric {
+	return &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+}
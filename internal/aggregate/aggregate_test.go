@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package aggregate
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregator(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	queue := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_queue_length", Help: "A test gauge"}, []string{"nic"})
+	utility := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_utility_total", Help: "A test counter"})
+	registry.MustRegister(queue, utility)
+
+	a, err := New(slog.New(slog.DiscardHandler), registry, Config{
+		SampleInterval: time.Second,
+		Window:         4 * time.Second,
+		Rules: []Rule{
+			{Metric: "test_queue_length", Quantiles: []float64{0.5, 1}},
+			{Metric: "test_utility_total", Rate: true, Statistics: []string{StatMax, StatAvg}},
+		},
+	})
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	// The first sample is outside of the window of the gather, which records the last sample.
+	for _, value := range []float64{100, 2, 8, 4} {
+		queue.WithLabelValues("Ethernet").Set(value)
+		utility.Add(value)
+
+		a.mu.Lock()
+		_, err = a.gather()
+		a.mu.Unlock()
+		require.NoError(t, err)
+
+		now = now.Add(time.Second)
+	}
+
+	queue.WithLabelValues("Ethernet").Set(6)
+	utility.Add(6)
+
+	require.NoError(t, testutil.GatherAndCompare(a, strings.NewReader(`# HELP test_queue_length A test gauge
+# TYPE test_queue_length gauge
+test_queue_length{nic="Ethernet"} 6
+# HELP test_queue_length_avg Average of test_queue_length over the last 4s.
+# TYPE test_queue_length_avg gauge
+test_queue_length_avg{nic="Ethernet"} 5
+# HELP test_queue_length_last Last value of test_queue_length over the last 4s.
+# TYPE test_queue_length_last gauge
+test_queue_length_last{nic="Ethernet"} 6
+# HELP test_queue_length_max Maximum of test_queue_length over the last 4s.
+# TYPE test_queue_length_max gauge
+test_queue_length_max{nic="Ethernet"} 8
+# HELP test_queue_length_min Minimum of test_queue_length over the last 4s.
+# TYPE test_queue_length_min gauge
+test_queue_length_min{nic="Ethernet"} 2
+# HELP test_queue_length_quantile Quantiles of test_queue_length over the last 4s.
+# TYPE test_queue_length_quantile gauge
+test_queue_length_quantile{nic="Ethernet",quantile="0.5"} 5
+test_queue_length_quantile{nic="Ethernet",quantile="1"} 8
+# HELP test_utility_per_second_avg Average of the per-second rate of test_utility_total over the last 4s.
+# TYPE test_utility_per_second_avg gauge
+test_utility_per_second_avg 5
+# HELP test_utility_per_second_max Maximum of the per-second rate of test_utility_total over the last 4s.
+# TYPE test_utility_per_second_max gauge
+test_utility_per_second_max 8
+# HELP test_utility_total A test counter
+# TYPE test_utility_total counter
+test_utility_total 120
+`)))
+}
+
+func TestAggregatorRun(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	sampler := prometheus.NewRegistry()
+
+	var samples, others int
+
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"}, func() float64 {
+		samples++
+
+		return float64(samples)
+	})
+	other := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_other", Help: "Another test gauge"}, func() float64 {
+		others++
+
+		return float64(others)
+	})
+	registry.MustRegister(gauge, other)
+	sampler.MustRegister(gauge)
+
+	a, err := New(slog.New(slog.DiscardHandler), registry, Config{
+		SampleInterval: 10 * time.Millisecond,
+		Window:         time.Minute,
+		Rules:          []Rule{{Metric: "test_gauge", Statistics: []string{StatMin}}},
+		Sampler:        sampler,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	a.Run(ctx)
+
+	// Only the sampler is gathered between two gathers.
+	require.Zero(t, others)
+
+	families, err := a.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 3)
+	require.Equal(t, "test_gauge_min", families[1].GetName())
+	require.Equal(t, 1.0, families[1].GetMetric()[0].GetGauge().GetValue())
+	require.Greater(t, families[0].GetMetric()[0].GetGauge().GetValue(), 5.0)
+	require.Equal(t, 1, others)
+}
+
+func TestAggregatorCollision(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"})
+	gauge.Set(2)
+
+	existing := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge_max", Help: "An existing gauge"})
+	existing.Set(10)
+
+	registry.MustRegister(gauge, existing)
+
+	a, err := New(slog.New(slog.DiscardHandler), registry, Config{
+		SampleInterval: time.Second,
+		Window:         time.Minute,
+		Rules:          []Rule{{Metric: "test_gauge", Statistics: []string{StatMin, StatMax}}},
+	})
+	require.NoError(t, err)
+
+	// The gathered test_gauge_max is kept instead of the statistic of the same name.
+	require.NoError(t, testutil.GatherAndCompare(a, strings.NewReader(`# HELP test_gauge A test gauge
+# TYPE test_gauge gauge
+test_gauge 2
+# HELP test_gauge_max An existing gauge
+# TYPE test_gauge_max gauge
+test_gauge_max 10
+# HELP test_gauge_min Minimum of test_gauge over the last 1m0s.
+# TYPE test_gauge_min gauge
+test_gauge_min 2
+`)))
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, config := range map[string]Config{
+		"window":    {SampleInterval: time.Minute, Window: time.Second},
+		"metric":    {Window: time.Minute, Rules: []Rule{{}}},
+		"statistic": {Window: time.Minute, Rules: []Rule{{Metric: "a", Statistics: []string{"median"}}}},
+		"quantile":  {Window: time.Minute, Rules: []Rule{{Metric: "a", Quantiles: []float64{99}}}},
+		"duplicate": {Window: time.Minute, Rules: []Rule{{Metric: "a"}, {Metric: "a", Statistics: []string{StatMax}}}},
+		"collision": {Window: time.Minute, Rules: []Rule{{Metric: "a_max"}, {Metric: "a"}}},
+	} {
+		_, err := New(slog.New(slog.DiscardHandler), prometheus.NewRegistry(), config)
+		require.Error(t, err, name)
+	}
+}
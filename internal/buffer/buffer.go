@@ -0,0 +1,495 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package buffer implements a bounded on-disk buffer for metric snapshots that
+// could not be delivered. Snapshots are replayed in the order they were taken
+// once the target is reachable again.
+//
+// Each snapshot is stored in its own file, named after its timestamp. A file
+// consists of a fixed-size header (magic, timestamp and CRC-32C of the payload)
+// followed by the metric families encoded as length-delimited protobuf.
+// Files are written to a temporary name and renamed, so a crash never leaves a
+// partially written snapshot behind. Files that fail validation are removed.
+package buffer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	fileExtension = ".snap"
+	tempExtension = ".tmp"
+	headerSize    = 16
+
+	reasonSize     = "size"
+	reasonAge      = "age"
+	reasonCorrupt  = "corrupt"
+	reasonRejected = "rejected"
+	reasonReplaced = "replaced"
+)
+
+//nolint:gochecknoglobals
+var (
+	magic      = [4]byte{'W', 'A', 'S', '1'}
+	crcTable   = crc32.MakeTable(crc32.Castagnoli)
+	wireFormat = expfmt.NewFormat(expfmt.TypeProtoDelim)
+
+	errCorrupt = errors.New("corrupt snapshot")
+)
+
+// Config configures a Buffer.
+type Config struct {
+	// Path is the directory the snapshots are stored in.
+	Path string
+	// MaxSize is the maximum size of all stored snapshots in bytes. 0 means no limit.
+	MaxSize int64
+	// MaxAge is the maximum age of a stored snapshot. 0 means no limit.
+	MaxAge time.Duration
+	// LatestOnly keeps only the newest snapshot. It is set for targets that store only the
+	// latest value of a series and ignore timestamps, such as a Pushgateway, where replaying
+	// older snapshots costs requests and leaves only the newest one anyway.
+	LatestOnly bool
+}
+
+// Buffer is a bounded on-disk FIFO of metric snapshots.
+// It implements prometheus.Collector to report its depth.
+type Buffer struct {
+	config Config
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries []entry
+	size    int64
+	dropped map[string]float64
+
+	snapshotsDesc *prometheus.Desc
+	bytesDesc     *prometheus.Desc
+	oldestDesc    *prometheus.Desc
+	droppedDesc   *prometheus.Desc
+}
+
+type entry struct {
+	name      string
+	timestamp time.Time
+	size      int64
+}
+
+// New opens the buffer in config.Path, creating the directory if needed.
+// Existing snapshots are validated, and corrupt ones are removed.
+func New(logger *slog.Logger, config Config) (*Buffer, error) {
+	if err := os.MkdirAll(config.Path, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create buffer directory: %w", err)
+	}
+
+	b := &Buffer{
+		config:  config,
+		logger:  logger,
+		now:     time.Now,
+		dropped: map[string]float64{},
+
+		snapshotsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_buffer_snapshots"),
+			"Number of undelivered snapshots in the offline buffer.",
+			nil,
+			nil,
+		),
+		bytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_buffer_bytes"),
+			"Size of the undelivered snapshots in the offline buffer.",
+			nil,
+			nil,
+		),
+		oldestDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_buffer_oldest_snapshot_timestamp_seconds"),
+			"Timestamp of the oldest snapshot in the offline buffer. 0 if the buffer is empty.",
+			nil,
+			nil,
+		),
+		droppedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_buffer_dropped_snapshots_total"),
+			"Number of snapshots dropped from the offline buffer without being delivered.",
+			[]string{"reason"},
+			nil,
+		),
+	}
+
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// load reads the directory and validates all existing snapshots.
+func (b *Buffer) load() error {
+	dirEntries, err := os.ReadDir(b.config.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer directory: %w", err)
+	}
+
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		path := filepath.Join(b.config.Path, name)
+
+		switch {
+		case dirEntry.IsDir():
+			continue
+		case strings.HasSuffix(name, tempExtension):
+			// Leftover of an interrupted write.
+			_ = os.Remove(path)
+
+			continue
+		case !strings.HasSuffix(name, fileExtension):
+			continue
+		}
+
+		timestamp, size, err := validate(path)
+		if err != nil {
+			b.logger.Warn("removing corrupt snapshot from buffer",
+				slog.String("file", name),
+				slog.Any("err", err),
+			)
+
+			_ = os.Remove(path)
+			b.dropped[reasonCorrupt]++
+
+			continue
+		}
+
+		b.entries = append(b.entries, entry{name: name, timestamp: timestamp, size: size})
+		b.size += size
+	}
+
+	slices.SortFunc(b.entries, func(a, b entry) int {
+		return a.timestamp.Compare(b.timestamp)
+	})
+
+	b.enforceLimits()
+
+	return nil
+}
+
+// Len returns the number of buffered snapshots.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.entries)
+}
+
+// Append stores a snapshot at the end of the buffer. The oldest snapshots are
+// dropped if the buffer exceeds its size or age limit.
+func (b *Buffer) Append(snapshot delivery.Snapshot) error {
+	payload := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(payload, wireFormat)
+
+	for _, mf := range snapshot.Families {
+		if err := encoder.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode metric family %s: %w", mf.GetName(), err)
+		}
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic[:])
+	binary.BigEndian.PutUint64(header[4:12], uint64(snapshot.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(header[12:16], crc32.Checksum(payload.Bytes(), crcTable))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name := b.fileName(snapshot.Timestamp)
+	path := filepath.Join(b.config.Path, name)
+
+	if err := writeFile(path, header, payload.Bytes()); err != nil {
+		return err
+	}
+
+	size := int64(headerSize + payload.Len())
+
+	b.entries = append(b.entries, entry{name: name, timestamp: snapshot.Timestamp, size: size})
+	b.size += size
+
+	// Snapshots are appended in order under normal operation, but the clock may have been adjusted.
+	slices.SortStableFunc(b.entries, func(a, b entry) int {
+		return a.timestamp.Compare(b.timestamp)
+	})
+
+	b.enforceLimits()
+
+	return nil
+}
+
+// Replay calls fn for each buffered snapshot, oldest first. A snapshot is removed
+// once fn succeeds, or if fn fails with a non-retryable error, because sending it
+// again would fail again. Replay stops at the first retryable error and returns it.
+//
+// The deadline of ctx is treated as a time budget: once ctx is done, Replay
+// returns without an error and the remaining snapshots stay buffered.
+func (b *Buffer) Replay(ctx context.Context, fn func(ctx context.Context, snapshot delivery.Snapshot) error) error {
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		b.mu.Lock()
+		b.enforceLimits()
+
+		if len(b.entries) == 0 {
+			b.mu.Unlock()
+
+			return nil
+		}
+
+		head := b.entries[0]
+		b.mu.Unlock()
+
+		snapshot, err := read(filepath.Join(b.config.Path, head.name))
+		if err != nil {
+			b.logger.LogAttrs(ctx, slog.LevelWarn, "dropping unreadable snapshot from buffer",
+				slog.String("file", head.name),
+				slog.Any("err", err),
+			)
+
+			b.remove(head, reasonCorrupt)
+
+			continue
+		}
+
+		if err = fn(ctx, snapshot); err != nil {
+			if delivery.IsRetryable(err) {
+				return err
+			}
+
+			b.logger.LogAttrs(ctx, slog.LevelWarn, "dropping snapshot rejected by target from buffer",
+				slog.Time("timestamp", snapshot.Timestamp),
+				slog.Any("err", err),
+			)
+
+			b.remove(head, reasonRejected)
+
+			continue
+		}
+
+		b.remove(head, "")
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (b *Buffer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.snapshotsDesc
+	ch <- b.bytesDesc
+	ch <- b.oldestDesc
+	ch <- b.droppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (b *Buffer) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var oldest float64
+	if len(b.entries) > 0 {
+		oldest = float64(b.entries[0].timestamp.UnixNano()) / 1e9
+	}
+
+	ch <- prometheus.MustNewConstMetric(b.snapshotsDesc, prometheus.GaugeValue, float64(len(b.entries)))
+	ch <- prometheus.MustNewConstMetric(b.bytesDesc, prometheus.GaugeValue, float64(b.size))
+	ch <- prometheus.MustNewConstMetric(b.oldestDesc, prometheus.GaugeValue, oldest)
+
+	for _, reason := range []string{reasonSize, reasonAge, reasonCorrupt, reasonRejected, reasonReplaced} {
+		ch <- prometheus.MustNewConstMetric(b.droppedDesc, prometheus.CounterValue, b.dropped[reason], reason)
+	}
+}
+
+// remove deletes a delivered or dropped snapshot. An empty reason means the
+// snapshot was delivered.
+func (b *Buffer) remove(e entry, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx := slices.IndexFunc(b.entries, func(candidate entry) bool {
+		return candidate.name == e.name
+	})
+	if idx == -1 {
+		// Already dropped by enforceLimits.
+		return
+	}
+
+	b.deleteAt(idx, reason)
+}
+
+// enforceLimits drops the oldest snapshots until the buffer is within its
+// limits. b.mu must be held.
+func (b *Buffer) enforceLimits() {
+	if b.config.LatestOnly {
+		for len(b.entries) > 1 {
+			b.deleteAt(0, reasonReplaced)
+		}
+	}
+
+	if b.config.MaxAge > 0 {
+		cutoff := b.now().Add(-b.config.MaxAge)
+
+		for len(b.entries) > 0 && b.entries[0].timestamp.Before(cutoff) {
+			b.deleteAt(0, reasonAge)
+		}
+	}
+
+	if b.config.MaxSize > 0 {
+		for len(b.entries) > 0 && b.size > b.config.MaxSize {
+			b.deleteAt(0, reasonSize)
+		}
+	}
+}
+
+// deleteAt removes the snapshot at index idx. b.mu must be held.
+func (b *Buffer) deleteAt(idx int, reason string) {
+	e := b.entries[idx]
+
+	if err := os.Remove(filepath.Join(b.config.Path, e.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		b.logger.Warn("failed to remove snapshot from buffer",
+			slog.String("file", e.name),
+			slog.Any("err", err),
+		)
+	}
+
+	b.entries = slices.Delete(b.entries, idx, idx+1)
+	b.size -= e.size
+
+	if reason != "" {
+		b.dropped[reason]++
+	}
+}
+
+// fileName returns a unique file name for a snapshot taken at timestamp. b.mu must be held.
+func (b *Buffer) fileName(timestamp time.Time) string {
+	for nanos := timestamp.UnixNano(); ; nanos++ {
+		name := fmt.Sprintf("%020d%s", nanos, fileExtension)
+
+		if !slices.ContainsFunc(b.entries, func(e entry) bool { return e.name == name }) {
+			return name
+		}
+	}
+}
+
+func writeFile(path string, header, payload []byte) error {
+	tempPath := path + tempExtension
+
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	_, err = file.Write(header)
+	if err == nil {
+		_, err = file.Write(payload)
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tempPath)
+
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+
+	return nil
+}
+
+// readFile reads a snapshot file and verifies its header and checksum.
+func readFile(path string) (time.Time, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if len(data) < headerSize || !bytes.Equal(data[:4], magic[:]) {
+		return time.Time{}, nil, fmt.Errorf("%w: invalid header", errCorrupt)
+	}
+
+	payload := data[headerSize:]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[12:16]) {
+		return time.Time{}, nil, fmt.Errorf("%w: checksum mismatch", errCorrupt)
+	}
+
+	timestamp := time.Unix(0, int64(binary.BigEndian.Uint64(data[4:12])))
+
+	return timestamp, payload, nil
+}
+
+func validate(path string) (time.Time, int64, error) {
+	timestamp, payload, err := readFile(path)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	return timestamp, int64(headerSize + len(payload)), nil
+}
+
+func read(path string) (delivery.Snapshot, error) {
+	timestamp, payload, err := readFile(path)
+	if err != nil {
+		return delivery.Snapshot{}, err
+	}
+
+	snapshot := delivery.Snapshot{Timestamp: timestamp}
+	decoder := expfmt.NewDecoder(bytes.NewReader(payload), wireFormat)
+
+	for {
+		mf := &dto.MetricFamily{}
+
+		if err = decoder.Decode(mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return snapshot, nil
+			}
+
+			return delivery.Snapshot{}, fmt.Errorf("%w: %w", errCorrupt, err)
+		}
+
+		snapshot.Families = append(snapshot.Families, mf)
+	}
+}
@@ -0,0 +1,247 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package buffer
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func testSnapshot(timestamp time.Time, value float64) delivery.Snapshot {
+	return delivery.Snapshot{
+		Timestamp: timestamp,
+		Families: []*dto.MetricFamily{{
+			Name: proto.String("test_metric"),
+			Help: proto.String("A test metric"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Gauge: &dto.Gauge{Value: proto.Float64(value)},
+			}},
+		}},
+	}
+}
+
+func TestBufferReplayInOrder(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	start := time.Now()
+
+	b, err := New(slog.New(slog.DiscardHandler), Config{Path: dir})
+	require.NoError(t, err)
+
+	for i := range 3 {
+		require.NoError(t, b.Append(testSnapshot(start.Add(time.Duration(i)*time.Second), float64(i))))
+	}
+
+	require.Equal(t, 3, b.Len())
+
+	// Reopening the buffer must find the same snapshots.
+	b, err = New(slog.New(slog.DiscardHandler), Config{Path: dir})
+	require.NoError(t, err)
+	require.Equal(t, 3, b.Len())
+
+	var values []float64
+
+	err = b.Replay(context.Background(), func(_ context.Context, snapshot delivery.Snapshot) error {
+		require.Equal(t, start.Add(time.Duration(len(values))*time.Second).UnixNano(), snapshot.Timestamp.UnixNano())
+
+		values = append(values, snapshot.Families[0].GetMetric()[0].GetGauge().GetValue())
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []float64{0, 1, 2}, values)
+	require.Zero(t, b.Len())
+}
+
+func TestBufferReplayStopsOnRetryableError(t *testing.T) {
+	t.Parallel()
+
+	b, err := New(slog.New(slog.DiscardHandler), Config{Path: t.TempDir()})
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := range 3 {
+		require.NoError(t, b.Append(testSnapshot(start.Add(time.Duration(i)*time.Second), float64(i))))
+	}
+
+	var calls int
+
+	err = b.Replay(context.Background(), func(context.Context, delivery.Snapshot) error {
+		calls++
+
+		switch calls {
+		case 1:
+			// Rejected by the target, dropped.
+			return &delivery.StatusError{StatusCode: http.StatusBadRequest}
+		case 2:
+			return nil
+		default:
+			return &delivery.StatusError{StatusCode: http.StatusServiceUnavailable}
+		}
+	})
+	require.Error(t, err)
+	require.True(t, delivery.IsRetryable(err))
+	require.Equal(t, 3, calls)
+	require.Equal(t, 1, b.Len())
+	require.InDelta(t, 1.0, b.dropped[reasonRejected], 0)
+}
+
+func TestBufferLimits(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	b, err := New(slog.New(slog.DiscardHandler), Config{Path: t.TempDir(), MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	b.now = func() time.Time { return now }
+
+	require.NoError(t, b.Append(testSnapshot(now.Add(-2*time.Hour), 1)))
+	require.NoError(t, b.Append(testSnapshot(now, 2)))
+	require.Equal(t, 1, b.Len())
+	require.InDelta(t, 1.0, b.dropped[reasonAge], 0)
+
+	size := b.size
+	b.config.MaxSize = 2 * size
+
+	for i := range 5 {
+		require.NoError(t, b.Append(testSnapshot(now.Add(time.Duration(i+1)*time.Second), 3)))
+	}
+
+	require.Equal(t, 2, b.Len())
+	require.LessOrEqual(t, b.size, b.config.MaxSize)
+	require.InDelta(t, 4.0, b.dropped[reasonSize], 0)
+}
+
+func TestBufferLatestOnly(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	start := time.Now()
+
+	b, err := New(slog.New(slog.DiscardHandler), Config{Path: dir})
+	require.NoError(t, err)
+
+	for i := range 3 {
+		require.NoError(t, b.Append(testSnapshot(start.Add(time.Duration(i)*time.Second), float64(i))))
+	}
+
+	// Snapshots buffered before the target switched modes are reduced to the latest one.
+	b, err = New(slog.New(slog.DiscardHandler), Config{Path: dir, LatestOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, b.Len())
+	require.InDelta(t, 2.0, b.dropped[reasonReplaced], 0)
+
+	require.NoError(t, b.Append(testSnapshot(start.Add(3*time.Second), 3)))
+	require.Equal(t, 1, b.Len())
+
+	var values []float64
+
+	require.NoError(t, b.Replay(context.Background(), func(_ context.Context, snapshot delivery.Snapshot) error {
+		values = append(values, snapshot.Families[0].GetMetric()[0].GetGauge().GetValue())
+
+		return nil
+	}))
+	require.Equal(t, []float64{3}, values)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestBufferCorruptionRecovery(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	start := time.Now()
+
+	b, err := New(slog.New(slog.DiscardHandler), Config{Path: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, b.Append(testSnapshot(start, 1)))
+	require.NoError(t, b.Append(testSnapshot(start.Add(time.Second), 2)))
+
+	// Flip a payload byte of the first snapshot and leave an interrupted write behind.
+	path := filepath.Join(dir, b.entries[0].name)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0"+fileExtension+tempExtension), []byte("partial"), 0o600))
+
+	b, err = New(slog.New(slog.DiscardHandler), Config{Path: dir})
+	require.NoError(t, err)
+	require.Equal(t, 1, b.Len())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	var values []float64
+
+	require.NoError(t, b.Replay(context.Background(), func(_ context.Context, snapshot delivery.Snapshot) error {
+		values = append(values, snapshot.Families[0].GetMetric()[0].GetGauge().GetValue())
+
+		return nil
+	}))
+	require.Equal(t, []float64{2}, values)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(b)
+
+	count, err := testutil.GatherAndCount(registry, "windows_agent_push_buffer_dropped_snapshots_total")
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+	require.InDelta(t, 1.0, b.dropped[reasonCorrupt], 0)
+}
+
+func TestBufferReplayCanceled(t *testing.T) {
+	t.Parallel()
+
+	b, err := New(slog.New(slog.DiscardHandler), Config{Path: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, b.Append(testSnapshot(time.Now(), 1)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls int
+
+	require.NoError(t, b.Replay(ctx, func(context.Context, delivery.Snapshot) error {
+		calls++
+
+		return nil
+	}))
+	require.Zero(t, calls)
+	require.Equal(t, 1, b.Len())
+}
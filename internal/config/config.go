@@ -22,15 +22,76 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
-	"github.com/alecthomas/kingpin/v2"
+	"github.com/Brownster/agent-windows/internal/relabel"
 	"github.com/Brownster/agent-windows/pkg/collector"
+	"github.com/alecthomas/kingpin/v2"
 	"gopkg.in/yaml.v3"
 )
 
 // configFile represents the structure of the windows_exporter configuration file,
 // including configuration from the collector and web packages.
 type configFile struct {
+	AgentID        string            `yaml:"agent-id"`
+	Labels         map[string]string `yaml:"labels"`
+	LabelCollision string            `yaml:"label-collision"`
+	Push           struct {
+		Mode             string            `yaml:"mode"`
+		GatewayURL       string            `yaml:"gateway-url"`
+		RemoteWriteURL   string            `yaml:"remote-write-url"`
+		OTLPURL          string            `yaml:"otlp-url"`
+		InfluxDBURL      string            `yaml:"influxdb-url"`
+		InfluxDB         PushInfluxConfig  `yaml:"influxdb"`
+		StatsDURL        string            `yaml:"statsd-url"`
+		StatsD           PushStatsDConfig  `yaml:"statsd"`
+		MQTTURL          string            `yaml:"mqtt-url"`
+		FilePath         string            `yaml:"file-path"`
+		File             PushFileConfig    `yaml:"file"`
+		Username         string            `yaml:"username"`
+		Password         string            `yaml:"password"`
+		BearerToken      string            `yaml:"bearer-token"`
+		BearerTokenFile  string            `yaml:"bearer-token-file"`
+		Headers          map[string]string `yaml:"headers"`
+		OAuth2           PushOAuth2Config  `yaml:"oauth2"`
+		Grouping         map[string]string `yaml:"grouping"`
+		Method           string            `yaml:"method"`
+		DeleteOnShutdown bool              `yaml:"delete-on-shutdown"`
+		ShutdownTimeout  string            `yaml:"shutdown-timeout"`
+		Interval         string            `yaml:"interval"`
+		JobName          string            `yaml:"job-name"`
+		Retry            struct {
+			MaxRetries     string `yaml:"max-retries"`
+			InitialBackoff string `yaml:"initial-backoff"`
+			MaxBackoff     string `yaml:"max-backoff"`
+		} `yaml:"retry"`
+		CircuitBreaker struct {
+			Threshold string `yaml:"threshold"`
+			Timeout   string `yaml:"timeout"`
+		} `yaml:"circuit-breaker"`
+		MQTT struct {
+			ClientID    string `yaml:"client-id"`
+			Topic       string `yaml:"topic"`
+			StatusTopic string `yaml:"status-topic"`
+			Format      string `yaml:"format"`
+			QoS         string `yaml:"qos"`
+			KeepAlive   string `yaml:"keep-alive"`
+		} `yaml:"mqtt"`
+		Burst struct {
+			Interval  string `yaml:"interval"`
+			Duration  string `yaml:"duration"`
+			Condition string `yaml:"condition"`
+		} `yaml:"burst"`
+		DisableRuntimeMetrics bool          `yaml:"disable-runtime-metrics"`
+		Timeout               string        `yaml:"timeout"`
+		TLS                   PushTLSConfig `yaml:"tls"`
+		Buffer                struct {
+			Path    string `yaml:"path"`
+			MaxSize string `yaml:"max-size"`
+			MaxAge  string `yaml:"max-age"`
+		} `yaml:"buffer"`
+		Targets []PushTarget `yaml:"targets"`
+	} `yaml:"push"`
 	Debug struct {
 		Enabled bool `yaml:"enabled"`
 	} `yaml:"debug"`
@@ -50,16 +111,145 @@ type configFile struct {
 	Scrape struct {
 		TimeoutMargin string `yaml:"timeout-margin"`
 	} `yaml:"scrape"`
+	Aggregation struct {
+		SampleInterval string            `yaml:"sample-interval"`
+		Window         string            `yaml:"window"`
+		Rules          []AggregationRule `yaml:"rules"`
+	} `yaml:"aggregation"`
+	Rate struct {
+		MinInterval string     `yaml:"min-interval"`
+		Rules       []RateRule `yaml:"rules"`
+	} `yaml:"rate"`
+	Derived struct {
+		Rules []DerivedRule `yaml:"rules"`
+	} `yaml:"derived"`
 	Telemetry struct {
 		Path string `yaml:"path"`
 	} `yaml:"telemetry"`
 	Web struct {
-		DisableExporterMetrics bool `yaml:"disable-exporter-metrics"`
-		ListenAddresses        any  `yaml:"listen-address"`
+		Enabled                bool   `yaml:"enabled"`
+		CacheMaxAge            string `yaml:"cache-max-age"`
+		DisableExporterMetrics bool   `yaml:"disable-exporter-metrics"`
+		ListenAddresses        any    `yaml:"listen-address"`
 		Config                 struct {
 			File string `yaml:"file"`
 		} `yaml:"config"`
 	} `yaml:"web"`
+	MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs"`
+	Filter               FilterConfig      `yaml:"filter"`
+}
+
+// PushTarget is an additional push target defined in the push.targets list of the configuration file.
+// Lists can't be expressed as flags, so push targets are only configurable in the configuration file.
+type PushTarget struct {
+	Name             string            `yaml:"name"`
+	Mode             string            `yaml:"mode"`
+	URL              string            `yaml:"url"`
+	Username         string            `yaml:"username"`
+	Password         string            `yaml:"password"`
+	BearerToken      string            `yaml:"bearer-token"`
+	BearerTokenFile  string            `yaml:"bearer-token-file"`
+	Headers          map[string]string `yaml:"headers"`
+	OAuth2           PushOAuth2Config  `yaml:"oauth2"`
+	Grouping         map[string]string `yaml:"grouping"`
+	Method           string            `yaml:"method"`
+	DeleteOnShutdown *bool             `yaml:"delete-on-shutdown"`
+	Interval         time.Duration     `yaml:"interval"`
+	Timeout          time.Duration     `yaml:"timeout"`
+	JobName          string            `yaml:"job-name"`
+	TLS              PushTLSConfig     `yaml:"tls"`
+	InfluxDB         PushInfluxConfig  `yaml:"influxdb"`
+	StatsD           PushStatsDConfig  `yaml:"statsd"`
+	MQTT             PushMQTTConfig    `yaml:"mqtt"`
+	File             PushFileConfig    `yaml:"file"`
+}
+
+// PushOAuth2Config is the OAuth2 client credentials configuration of a push target.
+type PushOAuth2Config struct {
+	TokenURL         string `yaml:"token-url"`
+	ClientID         string `yaml:"client-id"`
+	ClientSecretFile string `yaml:"client-secret-file"`
+	Scopes           string `yaml:"scopes"`
+}
+
+// PushInfluxConfig is the InfluxDB configuration of a push target in the influxdb mode.
+type PushInfluxConfig struct {
+	Org       string `yaml:"org"`
+	Bucket    string `yaml:"bucket"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token-file"`
+	BatchSize int    `yaml:"batch-size"`
+}
+
+// PushStatsDConfig is the StatsD configuration of a push target in the statsd mode.
+type PushStatsDConfig struct {
+	MaxPacketSize int `yaml:"max-packet-size"`
+}
+
+// PushMQTTConfig is the MQTT configuration of a push target in the mqtt mode.
+// Unset fields are inherited from the push.mqtt.* flags, except the client ID.
+type PushMQTTConfig struct {
+	ClientID    string        `yaml:"client-id"`
+	Topic       string        `yaml:"topic"`
+	StatusTopic string        `yaml:"status-topic"`
+	Format      string        `yaml:"format"`
+	QoS         *int          `yaml:"qos"`
+	KeepAlive   time.Duration `yaml:"keep-alive"`
+}
+
+// PushFileConfig is the file configuration of a push target in the file mode.
+type PushFileConfig struct {
+	MaxSize  int64 `yaml:"max-size"`
+	MaxFiles int   `yaml:"max-files"`
+	Compress bool  `yaml:"compress"`
+}
+
+// PushTLSConfig is the TLS client configuration of a push target.
+type PushTLSConfig struct {
+	CAFile             string `yaml:"ca-file"`
+	CertFile           string `yaml:"cert-file"`
+	KeyFile            string `yaml:"key-file"`
+	ServerName         string `yaml:"server-name"`
+	MinVersion         string `yaml:"min-version"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+}
+
+// AggregationRule selects a metric that is sampled at the aggregation sample interval, and the
+// statistics over the aggregation window that are pushed for it.
+type AggregationRule struct {
+	Metric     string    `yaml:"metric"`
+	Rate       bool      `yaml:"rate"`
+	Statistics []string  `yaml:"statistics"`
+	Quantiles  []float64 `yaml:"quantiles"`
+}
+
+// RateRule selects a counter whose per-second rate is pushed as a gauge.
+type RateRule struct {
+	Metric      string `yaml:"metric"`
+	CounterBits int    `yaml:"counter-bits"`
+}
+
+// DerivedRule defines a gauge that is computed from the gathered metrics by an expression.
+type DerivedRule struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	Expr string `yaml:"expr"`
+}
+
+// FilterRules are the allow and deny lists of metric name regular expressions.
+type FilterRules struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// FilterConfig is the filter section of the configuration file. The lists are only configurable in the
+// configuration file, MaxSeries is bound to the filter.max-series flag.
+type FilterConfig struct {
+	FilterRules `yaml:",inline"`
+
+	Collectors map[string]FilterRules `yaml:"collectors"`
+	Priorities []string               `yaml:"priorities"`
+	MaxSeries  string                 `yaml:"max-series"`
 }
 
 type getFlagger interface {
@@ -69,6 +259,7 @@ type getFlagger interface {
 // Resolver represents a configuration file resolver for kingpin.
 type Resolver struct {
 	flags map[string]string
+	file  configFile
 }
 
 // Parse parses the command line arguments and configuration files.
@@ -157,7 +348,52 @@ func NewConfigFileResolver(filePath string) (*Resolver, error) {
 		}
 	}
 
-	return &Resolver{flags: flags}, nil
+	return &Resolver{flags: flags, file: configFileStructure}, nil
+}
+
+// PushTargets returns the additional push targets defined in the configuration file.
+func (c *Resolver) PushTargets() []PushTarget {
+	return c.file.Push.Targets
+}
+
+// AggregationRules returns the rules of the metrics that are aggregated before they are pushed.
+func (c *Resolver) AggregationRules() []AggregationRule {
+	return c.file.Aggregation.Rules
+}
+
+// RateRules returns the rules of the counters whose rates are computed before they are pushed.
+func (c *Resolver) RateRules() []RateRule {
+	return c.file.Rate.Rules
+}
+
+// DerivedRules returns the rules of the gauges that are computed from the gathered metrics.
+func (c *Resolver) DerivedRules() []DerivedRule {
+	return c.file.Derived.Rules
+}
+
+// MetricRelabelConfigs returns the relabel configurations that are applied to all gathered metrics.
+func (c *Resolver) MetricRelabelConfigs() []*relabel.Config {
+	return c.file.MetricRelabelConfigs
+}
+
+// Filter returns the allow and deny lists and the priorities of the metric filter.
+func (c *Resolver) Filter() FilterConfig {
+	return c.file.Filter
+}
+
+// Labels returns the constant labels that are added to all collector metrics.
+func (c *Resolver) Labels() map[string]string {
+	return c.file.Labels
+}
+
+// PushGrouping returns the grouping label templates of the push target configured by the push.* flags.
+func (c *Resolver) PushGrouping() map[string]string {
+	return c.file.Push.Grouping
+}
+
+// PushHeaders returns the extra HTTP headers of the push target configured by the push.* flags.
+func (c *Resolver) PushHeaders() map[string]string {
+	return c.file.Push.Headers
 }
 
 func (c *Resolver) setDefault(v getFlagger) {
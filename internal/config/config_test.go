@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/relabel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConfigFileResolver(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+agent-id: agent_001
+
+push:
+  gateway-url: http://localhost:9091
+  interval: 30s
+  retry:
+    max-retries: 5
+  circuit-breaker:
+    threshold: 3
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{
+		"agent-id":                       "agent_001",
+		"push.gateway-url":               "http://localhost:9091",
+		"push.interval":                  "30s",
+		"push.retry.max-retries":         "5",
+		"push.circuit-breaker.threshold": "3",
+	}, resolver.flags)
+}
+
+func TestResolverPushTargets(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+push:
+  gateway-url: http://localhost:9091
+  targets:
+    - name: central
+      mode: remote_write
+      url: http://mimir:9009/api/v1/push
+      interval: 1m
+    - url: http://backup:9091
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, []PushTarget{
+		{Name: "central", Mode: "remote_write", URL: "http://mimir:9009/api/v1/push", Interval: time.Minute},
+		{URL: "http://backup:9091"},
+	}, resolver.PushTargets())
+}
+
+func TestResolverAggregationRules(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+aggregation:
+  sample-interval: 2s
+  rules:
+    - metric: windows_net_output_queue_length_packets
+      statistics: [max, avg]
+      quantiles: [0.5, 0.99]
+    - metric: windows_cpu_processor_utility_total
+      rate: true
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, []AggregationRule{
+		{Metric: "windows_net_output_queue_length_packets", Statistics: []string{"max", "avg"}, Quantiles: []float64{0.5, 0.99}},
+		{Metric: "windows_cpu_processor_utility_total", Rate: true},
+	}, resolver.AggregationRules())
+	require.Equal(t, "2s", resolver.flags["aggregation.sample-interval"])
+}
+
+func TestResolverRateRules(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+rate:
+  min-interval: 5s
+  rules:
+    - metric: windows_net_bytes_received_total
+      counter-bits: 64
+    - metric: windows_cpu_interrupts_total
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, []RateRule{
+		{Metric: "windows_net_bytes_received_total", CounterBits: 64},
+		{Metric: "windows_cpu_interrupts_total"},
+	}, resolver.RateRules())
+	require.Equal(t, "5s", resolver.flags["rate.min-interval"])
+}
+
+func TestResolverDerivedRules(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+derived:
+  rules:
+    - name: windows_memory_commit_used_ratio
+      help: Share of the commit limit that is used.
+      expr: windows_memory_committed_bytes / windows_memory_commit_limit
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, []DerivedRule{{
+		Name: "windows_memory_commit_used_ratio",
+		Help: "Share of the commit limit that is used.",
+		Expr: "windows_memory_committed_bytes / windows_memory_commit_limit",
+	}}, resolver.DerivedRules())
+}
+
+func TestResolverMetricRelabelConfigs(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+metric_relabel_configs:
+  - source_labels: [__name__]
+    regex: windows_(cpu|memory)_.*
+    action: keep
+  - regex: core
+    action: labeldrop
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	cfgs := resolver.MetricRelabelConfigs()
+	require.Len(t, cfgs, 2)
+	require.Equal(t, relabel.Keep, cfgs[0].Action)
+	require.Equal(t, "windows_(cpu|memory)_.*", cfgs[0].Regex.String())
+	require.Equal(t, relabel.LabelDrop, cfgs[1].Action)
+
+	err = os.WriteFile(path, []byte(`---
+metric_relabel_configs:
+  - action: hashmod
+    source_labels: [instance]
+    target_label: shard
+`), 0o600)
+	require.NoError(t, err)
+
+	_, err = NewConfigFileResolver(path)
+	require.ErrorContains(t, err, "requires non-zero modulus")
+}
+
+func TestResolverFilter(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+filter:
+  deny: [windows_pagefile_.*]
+  collectors:
+    net:
+      deny: [windows_net_nic_address_info]
+  priorities: [windows_cpu_.*]
+  max-series: 5000
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, FilterConfig{
+		FilterRules: FilterRules{Deny: []string{"windows_pagefile_.*"}},
+		Collectors:  map[string]FilterRules{"net": {Deny: []string{"windows_net_nic_address_info"}}},
+		Priorities:  []string{"windows_cpu_.*"},
+		MaxSeries:   "5000",
+	}, resolver.Filter())
+	require.Equal(t, "5000", resolver.flags["filter.max-series"])
+}
+
+func TestResolverLabels(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+agent-id: agent_001
+labels:
+  site: berlin
+  tenant: team-a
+label-collision: rename
+`), 0o600)
+	require.NoError(t, err)
+
+	resolver, err := NewConfigFileResolver(path)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{"site": "berlin", "tenant": "team-a"}, resolver.Labels())
+	require.Equal(t, "rename", resolver.flags["label-collision"])
+}
+
+func TestNewConfigFileResolverUnknownField(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(`---
+push:
+  gateway: http://localhost:9091
+`), 0o600)
+	require.NoError(t, err)
+
+	_, err = NewConfigFileResolver(path)
+	require.ErrorContains(t, err, "field gateway not found")
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// reservedHeaders are set by the push clients and can't be overridden by extra headers.
+//
+//nolint:gochecknoglobals
+var reservedHeaders = map[string]struct{}{
+	"Authorization":                     {},
+	"Content-Encoding":                  {},
+	"Content-Length":                    {},
+	"Content-Type":                      {},
+	"X-Prometheus-Remote-Write-Version": {},
+}
+
+// bearerTokenRoundTripper sets a bearer token on every request.
+type bearerTokenRoundTripper struct {
+	token     string
+	tokenFile string
+	next      http.RoundTripper
+}
+
+// NewBearerTokenRoundTripper returns a RoundTripper that authenticates every request with a bearer token.
+// If tokenFile is set, it is read for every request, so rotated tokens are used as soon as they are written.
+// Otherwise, token is used.
+func NewBearerTokenRoundTripper(token, tokenFile string, next http.RoundTripper) http.RoundTripper {
+	return &bearerTokenRoundTripper{token: token, tokenFile: tokenFile, next: next}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *bearerTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := rt.token
+
+	if rt.tokenFile != "" {
+		content, err := os.ReadFile(rt.tokenFile)
+		if err != nil {
+			closeBody(req)
+
+			return nil, fmt.Errorf("failed to read bearer token file: %w", err)
+		}
+
+		token = strings.TrimSpace(string(content))
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return rt.next.RoundTrip(req)
+}
+
+// headersRoundTripper adds extra headers to every request.
+type headersRoundTripper struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+// NewHeadersRoundTripper returns a RoundTripper that adds the given headers to every request,
+// for example X-Scope-OrgID for multi-tenant backends. Headers used for authentication or by
+// the push protocols can't be set.
+func NewHeadersRoundTripper(headers map[string]string, next http.RoundTripper) (http.RoundTripper, error) {
+	h := make(http.Header, len(headers))
+
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := reservedHeaders[name]; ok {
+			return nil, fmt.Errorf("header %q can't be overridden", name)
+		}
+
+		h.Set(name, value)
+	}
+
+	return &headersRoundTripper{headers: h, next: next}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	for name, values := range rt.headers {
+		req.Header[name] = values
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// closeBody closes the body of a request that is not sent, as required by http.RoundTripper.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
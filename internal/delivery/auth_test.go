@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearerTokenRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	var authorization []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("first\n"), 0o600))
+
+	client := &http.Client{Transport: NewBearerTokenRoundTripper("static", tokenFile, http.DefaultTransport)}
+
+	get := func() error {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	require.NoError(t, get())
+
+	// The token file is read again for every request.
+	require.NoError(t, os.WriteFile(tokenFile, []byte("second"), 0o600))
+	require.NoError(t, get())
+
+	require.NoError(t, os.Remove(tokenFile))
+	require.ErrorContains(t, get(), "failed to read bearer token file")
+
+	client.Transport = NewBearerTokenRoundTripper("static", "", http.DefaultTransport)
+	require.NoError(t, get())
+
+	require.Equal(t, []string{"Bearer first", "Bearer second", "Bearer static"}, authorization)
+}
+
+func TestHeadersRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	rt, err := NewHeadersRoundTripper(map[string]string{"x-scope-orgid": "tenant-1"}, http.DefaultTransport)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	require.Equal(t, "tenant-1", header.Get("X-Scope-OrgID"))
+	require.Empty(t, req.Header, "the original request must not be modified")
+
+	_, err = NewHeadersRoundTripper(map[string]string{"authorization": "Bearer token"}, http.DefaultTransport)
+	require.Error(t, err)
+}
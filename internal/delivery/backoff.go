@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes exponentially growing delays with random jitter.
+type Backoff struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max caps the delay. Zero means no cap.
+	Max time.Duration
+	// Multiplier is the growth factor between attempts. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction by which each delay is randomly spread, e.g. 0.2 for ±20%.
+	Jitter float64
+}
+
+// Duration returns the delay before retry number attempt, starting at 0.
+func (b Backoff) Duration(attempt int) time.Duration {
+	if b.Initial <= 0 {
+		return 0
+	}
+
+	multiplier := b.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(max(attempt, 0)))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		delay *= 1 - b.Jitter + 2*b.Jitter*rand.Float64() //nolint:gosec // jitter does not need a secure source
+	}
+
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	return time.Duration(delay)
+}
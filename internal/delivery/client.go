@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"io"
+	"net/http"
+)
+
+// maxErrorBodySize limits how much of an error response body is kept for logging.
+const maxErrorBodySize = 512
+
+// Doer is the interface of an HTTP client as used by the push clients.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// StatusClient wraps a Doer and converts non-2xx responses into a *StatusError,
+// so callers can tell retryable failures apart from fatal ones.
+type StatusClient struct {
+	client Doer
+}
+
+// NewStatusClient returns a StatusClient using the given client. If client is nil,
+// http.DefaultClient is used.
+func NewStatusClient(client Doer) *StatusClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &StatusClient{client: client}
+}
+
+// Do implements Doer.
+func (c *StatusClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	return nil, &StatusError{
+		StatusCode: resp.StatusCode,
+		URL:        req.URL.Redacted(),
+		Body:       string(body),
+	}
+}
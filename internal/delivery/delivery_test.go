@@ -0,0 +1,492 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "server error", err: &StatusError{StatusCode: http.StatusBadGateway}, expected: true},
+		{name: "too many requests", err: &StatusError{StatusCode: http.StatusTooManyRequests}, expected: true},
+		{name: "bad request", err: &StatusError{StatusCode: http.StatusBadRequest}, expected: false},
+		{name: "unauthorized", err: &StatusError{StatusCode: http.StatusUnauthorized}, expected: false},
+		{name: "wrapped server error", err: fmt.Errorf("push: %w", &StatusError{StatusCode: 503}), expected: true},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, expected: true},
+		{name: "canceled", err: context.Canceled, expected: false},
+		{name: "circuit open", err: ErrCircuitOpen, expected: true},
+		{name: "other", err: errors.New("invalid metric"), expected: false},
+		{name: "retryable", err: fmt.Errorf("publish: %w", retryableError{}), expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.expected, IsRetryable(tt.err))
+		})
+	}
+}
+
+// retryableError is a transient error of a sink that is not an HTTP status.
+type retryableError struct{}
+
+func (retryableError) Error() string { return "connection lost" }
+
+func (retryableError) Retryable() bool { return true }
+
+func TestStatusClient(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	client := NewStatusClient(server.Client())
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/ok", nil)
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	req, err = http.NewRequest(http.MethodPut, server.URL+"/fail", nil)
+	require.NoError(t, err)
+
+	_, err = client.Do(req) //nolint:bodyclose // the body is closed by the client on error
+	require.Error(t, err)
+
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	require.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+	require.Contains(t, statusErr.Body, "boom")
+	require.True(t, IsRetryable(err))
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+
+	require.Equal(t, time.Second, b.Duration(0))
+	require.Equal(t, 2*time.Second, b.Duration(1))
+	require.Equal(t, 8*time.Second, b.Duration(3))
+	require.Equal(t, 10*time.Second, b.Duration(10))
+
+	b.Jitter = 0.5
+
+	for range 100 {
+		d := b.Duration(1)
+		require.GreaterOrEqual(t, d, time.Second)
+		require.LessOrEqual(t, d, 3*time.Second)
+	}
+
+	require.Zero(t, Backoff{}.Duration(5))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	require.True(t, b.Allow())
+	b.Failure()
+	require.Equal(t, BreakerClosed, b.State())
+
+	b.Failure()
+	require.Equal(t, BreakerOpen, b.State())
+	require.False(t, b.Allow())
+
+	now = now.Add(time.Minute)
+
+	// The first request after the timeout is the probe, all others are rejected.
+	require.True(t, b.Allow())
+	require.Equal(t, BreakerHalfOpen, b.State())
+	require.False(t, b.Allow())
+
+	// A failed probe opens the breaker again.
+	b.Failure()
+	require.Equal(t, BreakerOpen, b.State())
+	require.False(t, b.Allow())
+
+	now = now.Add(time.Minute)
+
+	require.True(t, b.Allow())
+	b.Success()
+	require.Equal(t, BreakerClosed, b.State())
+	require.True(t, b.Allow())
+}
+
+func TestRetrier(t *testing.T) {
+	t.Parallel()
+
+	retryableErr := &StatusError{StatusCode: http.StatusInternalServerError}
+
+	t.Run("retries within interval", func(t *testing.T) {
+		t.Parallel()
+
+		r := NewRetrier(RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond})
+
+		var calls int
+
+		err := r.Do(context.Background(), func(context.Context) error {
+			calls++
+			if calls < 3 {
+				return retryableErr
+			}
+
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("fatal errors are not retried", func(t *testing.T) {
+		t.Parallel()
+
+		r := NewRetrier(RetryConfig{
+			MaxRetries:       2,
+			InitialBackoff:   time.Minute,
+			BreakerThreshold: 2,
+			BreakerTimeout:   5 * time.Minute,
+		})
+
+		var calls int
+
+		fail := func(context.Context) error {
+			calls++
+
+			return &StatusError{StatusCode: http.StatusUnauthorized}
+		}
+
+		err := r.Do(context.Background(), fail)
+		require.Error(t, err)
+		require.False(t, IsRetryable(err))
+		require.Equal(t, 1, calls)
+
+		// A fatal error is a failed interval: the target is not treated as healthy.
+		require.ErrorIs(t, r.Do(context.Background(), fail), ErrBackoff)
+		require.Equal(t, 1, calls)
+
+		r.nextAttempt = time.Time{}
+
+		require.Error(t, r.Do(context.Background(), fail))
+		require.Equal(t, BreakerOpen, r.State())
+	})
+
+	t.Run("canceled intervals are not failures", func(t *testing.T) {
+		t.Parallel()
+
+		r := NewRetrier(RetryConfig{
+			MaxRetries:       2,
+			InitialBackoff:   time.Minute,
+			BreakerThreshold: 1,
+			BreakerTimeout:   5 * time.Minute,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := r.Do(ctx, func(ctx context.Context) error { return ctx.Err() })
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, BreakerClosed, r.State())
+
+		var calls int
+
+		require.NoError(t, r.Do(context.Background(), func(context.Context) error {
+			calls++
+
+			return nil
+		}))
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("backs off across intervals and opens the breaker", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Unix(0, 0)
+		r := NewRetrier(RetryConfig{
+			InitialBackoff:   time.Second,
+			MaxBackoff:       time.Minute,
+			BreakerThreshold: 2,
+			BreakerTimeout:   5 * time.Minute,
+		})
+		r.now = func() time.Time { return now }
+		r.breaker.now = r.now
+
+		fail := func(context.Context) error { return retryableErr }
+
+		require.ErrorIs(t, r.Do(context.Background(), fail), retryableErr)
+		require.ErrorIs(t, r.Do(context.Background(), fail), ErrBackoff)
+
+		now = now.Add(time.Minute)
+
+		require.ErrorIs(t, r.Do(context.Background(), fail), retryableErr)
+		require.Equal(t, BreakerOpen, r.State())
+
+		now = now.Add(time.Minute)
+
+		require.ErrorIs(t, r.Do(context.Background(), fail), ErrCircuitOpen)
+
+		now = now.Add(5 * time.Minute)
+
+		var calls int
+
+		require.NoError(t, r.Do(context.Background(), func(context.Context) error {
+			calls++
+
+			return nil
+		}))
+		require.Equal(t, 1, calls)
+		require.Equal(t, BreakerClosed, r.State())
+	})
+
+	t.Run("retries are bounded by the context deadline", func(t *testing.T) {
+		t.Parallel()
+
+		r := NewRetrier(RetryConfig{MaxRetries: 10, InitialBackoff: time.Hour})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var calls int
+
+		start := time.Now()
+		err := r.Do(ctx, func(context.Context) error {
+			calls++
+
+			return retryableErr
+		})
+		require.Error(t, err)
+		require.Equal(t, 1, calls)
+		require.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestCachedGatherer(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+
+	g := NewCachedGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		calls++
+
+		return []*dto.MetricFamily{{Name: proto.String(fmt.Sprintf("call_%d", calls))}}, nil
+	}), 5*time.Second)
+
+	now := time.Unix(1700000000, 0)
+	g.now = func() time.Time { return now }
+
+	first, err := Gather(g)
+	require.NoError(t, err)
+	require.Equal(t, now, first.Timestamp)
+
+	now = now.Add(4 * time.Second)
+
+	families, err := g.Gather()
+	require.NoError(t, err)
+	require.Equal(t, "call_1", families[0].GetName())
+
+	second, err := Gather(g)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+
+	now = now.Add(time.Second)
+
+	third, err := Gather(g)
+	require.NoError(t, err)
+	require.Equal(t, now, third.Timestamp)
+	require.Equal(t, "call_2", third.Families[0].GetName())
+	require.Equal(t, 2, calls)
+}
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+
+	s := NewSchedule(30*time.Second, "agent_001")
+	require.Equal(t, s, NewSchedule(30*time.Second, "agent_001"))
+	require.NotEqual(t, s.Offset(), NewSchedule(30*time.Second, "agent_002").Offset())
+	require.Less(t, s.Offset(), 30*time.Second)
+	require.Panics(t, func() { NewSchedule(0, "agent_001") })
+
+	s = Schedule{interval: 30 * time.Second, offset: 7 * time.Second}
+	base := time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		now, next time.Duration
+	}{
+		{0, 7 * time.Second},
+		{6 * time.Second, 7 * time.Second},
+		{7 * time.Second, 37 * time.Second},
+		{8 * time.Second, 37 * time.Second},
+		{40 * time.Second, 67 * time.Second},
+	} {
+		require.True(t, base.Add(tc.next).Equal(s.Next(base.Add(tc.now))), tc.now)
+	}
+
+	scheduled := base.Add(7 * time.Second)
+	require.Equal(t, 0, s.Missed(scheduled, scheduled.Add(29*time.Second)))
+	require.Equal(t, 1, s.Missed(scheduled, scheduled.Add(30*time.Second)))
+	require.Equal(t, 2, s.Missed(scheduled, scheduled.Add(65*time.Second)))
+
+	// Intervals that don't divide a day are aligned to the Unix epoch.
+	s = Schedule{interval: 7 * time.Second}
+	require.Equal(t, int64(0), s.Next(base).Unix()%7)
+}
+
+func TestFailureReason(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "server error", err: fmt.Errorf("push: %w", &StatusError{StatusCode: http.StatusServiceUnavailable}), expected: FailureHTTP5xx},
+		{name: "bad request", err: &StatusError{StatusCode: http.StatusBadRequest}, expected: FailureHTTP4xx},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, expected: FailureTimeout},
+		{name: "dial timeout", err: &net.OpError{Op: "dial", Err: timeoutError{}}, expected: FailureTimeout},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, expected: FailureNetwork},
+		{name: "other", err: errors.New("failed"), expected: FailureOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.expected, FailureReason(tt.err))
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTelemetry(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	telemetry := NewTelemetry()
+	telemetry.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	client := &http.Client{Transport: telemetry.RoundTripper(http.DefaultTransport)}
+
+	failing := true
+	sender := telemetry.Sender(SenderFunc(func(ctx context.Context, _ Snapshot) error {
+		if failing {
+			return &StatusError{StatusCode: http.StatusBadGateway}
+		}
+
+		// Bodies of unknown length are counted while they are sent.
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, io.MultiReader(strings.NewReader("test_metric 1\n")))
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}))
+
+	snapshot := Snapshot{Families: []*dto.MetricFamily{
+		{Name: proto.String("a"), Metric: []*dto.Metric{{}, {}}},
+		{Name: proto.String("b"), Metric: []*dto.Metric{{}}},
+	}}
+
+	require.Error(t, sender.Send(context.Background(), snapshot))
+
+	failing = false
+
+	require.NoError(t, sender.Send(context.Background(), snapshot))
+
+	require.NoError(t, testutil.CollectAndCompare(telemetry, strings.NewReader(`# HELP windows_agent_push_attempts_total Number of push attempts, including retries and replays of the offline buffer.
+# TYPE windows_agent_push_attempts_total counter
+windows_agent_push_attempts_total 2
+# HELP windows_agent_push_failures_total Number of failed push attempts.
+# TYPE windows_agent_push_failures_total counter
+windows_agent_push_failures_total{reason="http_4xx"} 0
+windows_agent_push_failures_total{reason="http_5xx"} 1
+windows_agent_push_failures_total{reason="network"} 0
+windows_agent_push_failures_total{reason="other"} 0
+windows_agent_push_failures_total{reason="timeout"} 0
+# HELP windows_agent_push_last_success_timestamp_seconds Timestamp of the last successful push. 0 if no push succeeded yet.
+# TYPE windows_agent_push_last_success_timestamp_seconds gauge
+windows_agent_push_last_success_timestamp_seconds 1.7e+09
+# HELP windows_agent_push_payload_bytes Size of the request body of the last push. Only reported for targets pushed to over HTTP.
+# TYPE windows_agent_push_payload_bytes gauge
+windows_agent_push_payload_bytes 14
+# HELP windows_agent_push_series Number of series of the last pushed snapshot.
+# TYPE windows_agent_push_series gauge
+windows_agent_push_series 3
+`), "windows_agent_push_attempts_total", "windows_agent_push_failures_total", "windows_agent_push_last_success_timestamp_seconds",
+		"windows_agent_push_payload_bytes", "windows_agent_push_series"))
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(telemetry)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	require.Equal(t, "windows_agent_push_duration_seconds", families[1].GetName())
+	require.Equal(t, uint64(2), families[1].GetMetric()[0].GetHistogram().GetSampleCount())
+}
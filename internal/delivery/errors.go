@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	// ErrCircuitOpen is returned when a delivery is skipped because the circuit breaker is open.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+	// ErrBackoff is returned when a delivery is skipped because the target is still backing off.
+	ErrBackoff = errors.New("backing off after previous failures")
+)
+
+// StatusError is returned for HTTP responses with a non-2xx status code.
+type StatusError struct {
+	StatusCode int
+	URL        string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from %s: %s", e.StatusCode, e.URL, e.Body)
+}
+
+// Retryable reports whether the request may succeed if it is sent again.
+// Server errors, throttling and request timeouts are retryable. All other 4xx
+// responses (e.g. 400 for inconsistent metrics or 401 for bad credentials) are not.
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode >= http.StatusInternalServerError ||
+		e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusRequestTimeout
+}
+
+// IsRetryable reports whether err is a transient failure that is worth retrying.
+// Deliveries skipped because of ErrBackoff or ErrCircuitOpen are retryable as well.
+// Errors with a Retryable method, such as *StatusError, decide for themselves.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if errors.Is(err, ErrBackoff) || errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+
+	var retryableErr interface{ Retryable() bool }
+	if errors.As(err, &retryableErr) {
+		return retryableErr.Retryable()
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// Connection refused, DNS failures, resets and timeouts all surface as net.Error.
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
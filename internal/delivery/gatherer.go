@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CachedGatherer serializes the calls to Gather of the wrapped gatherer and reuses the last
+// snapshot while it is younger than the maximum age. It lets the scrapes of the local endpoint
+// share one collection, instead of running the collectors for every request.
+type CachedGatherer struct {
+	gatherer prometheus.Gatherer
+	maxAge   time.Duration
+	// now returns the current time. It is replaced in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	snapshot Snapshot
+	err      error
+}
+
+// NewCachedGatherer returns a CachedGatherer. A maxAge of 0 disables the cache.
+func NewCachedGatherer(g prometheus.Gatherer, maxAge time.Duration) *CachedGatherer {
+	return &CachedGatherer{gatherer: g, maxAge: maxAge, now: time.Now}
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *CachedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	snapshot, err := g.Snapshot()
+
+	return snapshot.Families, err
+}
+
+// Snapshot returns the cached snapshot, or gathers a new one if it is too old. The timestamp of
+// the snapshot is the time it was gathered, not the time it was returned.
+func (g *CachedGatherer) Snapshot() (Snapshot, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+
+	if g.snapshot.Timestamp.IsZero() || now.Sub(g.snapshot.Timestamp) >= g.maxAge {
+		families, err := g.gatherer.Gather()
+		g.snapshot, g.err = Snapshot{Timestamp: now, Families: families}, err
+	}
+
+	return g.snapshot, g.err
+}
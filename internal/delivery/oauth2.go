@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTokenExpiryDelta is how long before expiry a token is refreshed.
+	// Short-lived tokens are refreshed after half their lifetime.
+	maxTokenExpiryDelta = 30 * time.Second
+	// maxTokenResponseSize limits the size of a token endpoint response.
+	maxTokenResponseSize = 1 << 20
+)
+
+// OAuth2Config configures the OAuth2 client credentials flow (RFC 6749, section 4.4).
+type OAuth2Config struct {
+	// TokenURL is the token endpoint of the identity provider.
+	TokenURL string
+	ClientID string
+	// ClientSecretFile contains the client secret. It is read for every token request.
+	ClientSecretFile string
+	Scopes           []string
+}
+
+// oauth2RoundTripper authenticates requests with an access token from the client credentials flow.
+type oauth2RoundTripper struct {
+	config OAuth2Config
+	next   http.RoundTripper
+	now    func() time.Time
+
+	mu    sync.Mutex
+	token string
+	// refresh is when the token is refreshed. Zero if the token does not expire.
+	refresh time.Time
+}
+
+// NewOAuth2RoundTripper returns a RoundTripper that authenticates every request with an OAuth2 access token.
+//
+// The token is cached and refreshed shortly before it expires. If a request is rejected with
+// 401 Unauthorized, the token is refreshed and the request is sent once more. Token requests
+// are sent with next, so they use the same TLS configuration as the push requests.
+func NewOAuth2RoundTripper(config OAuth2Config, next http.RoundTripper) http.RoundTripper {
+	return &oauth2RoundTripper{config: config, next: next, now: time.Now}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *oauth2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := rt.getToken(req.Context(), false)
+	if err != nil {
+		closeBody(req)
+
+		return nil, err
+	}
+
+	resp, err := rt.send(req, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.GetBody == nil {
+		return resp, err
+	}
+
+	// The token may have been revoked or the server's clock is ahead of ours.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	token, err = rt.getToken(req.Context(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+
+	retry.Body, err = req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return rt.send(retry, token)
+}
+
+func (rt *oauth2RoundTripper) send(req *http.Request, token string) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return rt.next.RoundTrip(req)
+}
+
+// getToken returns the cached token, or requests a new one if the cached token is about to expire
+// or force is set.
+func (rt *oauth2RoundTripper) getToken(ctx context.Context, force bool) (string, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if !force && rt.token != "" && (rt.refresh.IsZero() || rt.now().Before(rt.refresh)) {
+		return rt.token, nil
+	}
+
+	token, expiresIn, err := rt.requestToken(ctx)
+	if err != nil {
+		rt.token = ""
+
+		return "", err
+	}
+
+	rt.token = token
+	rt.refresh = time.Time{}
+
+	// Tokens without expiry are kept until they are rejected.
+	if expiresIn > 0 {
+		rt.refresh = rt.now().Add(expiresIn - min(maxTokenExpiryDelta, expiresIn/2))
+	}
+
+	return token, nil
+}
+
+// tokenResponse is the successful response of a token endpoint (RFC 6749, section 5.1).
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (rt *oauth2RoundTripper) requestToken(ctx context.Context) (string, time.Duration, error) {
+	secret, err := os.ReadFile(rt.config.ClientSecretFile)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read OAuth2 client secret file: %w", err)
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(rt.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(rt.config.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rt.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create OAuth2 token request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(rt.config.ClientID), url.QueryEscape(strings.TrimSpace(string(secret))))
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth2 token request failed: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read OAuth2 token response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Invalid client credentials are as fatal as invalid push credentials.
+		return "", 0, fmt.Errorf("OAuth2 token request failed: %w", &StatusError{
+			StatusCode: resp.StatusCode,
+			URL:        req.URL.Redacted(),
+			Body:       string(body[:min(len(body), maxErrorBodySize)]),
+		})
+	}
+
+	var token tokenResponse
+	if err = json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("failed to parse OAuth2 token response: %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return "", 0, errors.New("OAuth2 token response contains no access token")
+	}
+
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported OAuth2 token type %q", token.TokenType)
+	}
+
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
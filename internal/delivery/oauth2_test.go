@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tokenServer is a stand-in for an identity provider that issues tokens with the client credentials flow.
+type tokenServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+	scope    string
+}
+
+func newTokenServer(t *testing.T, clientID, clientSecret string) *tokenServer {
+	t.Helper()
+
+	ts := &tokenServer{}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != clientID || secret != clientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+
+			return
+		}
+
+		if r.PostFormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		ts.requests++
+		ts.scope = r.PostFormValue("scope")
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: fmt.Sprintf("token-%d", ts.requests),
+			TokenType:   "Bearer",
+			ExpiresIn:   3600,
+		})
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func (ts *tokenServer) tokenRequests() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.requests
+}
+
+func TestOAuth2RoundTripper(t *testing.T) {
+	t.Parallel()
+
+	tokens := newTokenServer(t, "agent", "s3cret")
+
+	var (
+		mu       sync.Mutex
+		accepted = "Bearer token-1"
+		received []string
+	)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Header.Get("Authorization")+" "+string(body))
+
+		if r.Header.Get("Authorization") != accepted {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer gateway.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0o600))
+
+	now := time.Now()
+	rt := NewOAuth2RoundTripper(OAuth2Config{
+		TokenURL:         tokens.URL,
+		ClientID:         "agent",
+		ClientSecretFile: secretFile,
+		Scopes:           []string{"metrics.write", "metrics.read"},
+	}, http.DefaultTransport).(*oauth2RoundTripper)
+	rt.now = func() time.Time { return now }
+
+	client := &http.Client{Transport: rt}
+
+	push := func(body string) int {
+		resp, err := client.Post(gateway.URL, "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		return resp.StatusCode
+	}
+
+	// The token is requested once and cached.
+	require.Equal(t, http.StatusOK, push("1"))
+	require.Equal(t, http.StatusOK, push("2"))
+	require.Equal(t, 1, tokens.tokenRequests())
+	require.Equal(t, "metrics.write metrics.read", tokens.scope)
+
+	// The token is refreshed shortly before it expires.
+	now = now.Add(time.Hour - 10*time.Second)
+	mu.Lock()
+	accepted = "Bearer token-2"
+	mu.Unlock()
+
+	require.Equal(t, http.StatusOK, push("3"))
+	require.Equal(t, 2, tokens.tokenRequests())
+
+	// A 401 triggers a refresh and a single retry with the same body.
+	mu.Lock()
+	accepted = "Bearer token-3"
+	mu.Unlock()
+
+	require.Equal(t, http.StatusOK, push("4"))
+	require.Equal(t, 3, tokens.tokenRequests())
+
+	mu.Lock()
+	accepted = "none"
+	mu.Unlock()
+
+	require.Equal(t, http.StatusUnauthorized, push("5"))
+	require.Equal(t, 4, tokens.tokenRequests())
+
+	require.Equal(t, []string{
+		"Bearer token-1 1",
+		"Bearer token-1 2",
+		"Bearer token-2 3",
+		"Bearer token-2 4",
+		"Bearer token-3 4",
+		"Bearer token-3 5",
+		"Bearer token-4 5",
+	}, received)
+}
+
+func TestOAuth2RoundTripperInvalidClient(t *testing.T) {
+	t.Parallel()
+
+	tokens := newTokenServer(t, "agent", "s3cret")
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer gateway.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("wrong"), 0o600))
+
+	client := &http.Client{Transport: NewOAuth2RoundTripper(OAuth2Config{
+		TokenURL:         tokens.URL,
+		ClientID:         "agent",
+		ClientSecretFile: secretFile,
+	}, http.DefaultTransport)}
+
+	_, err := client.Get(gateway.URL)
+	require.ErrorContains(t, err, "invalid_client")
+	require.False(t, IsRetryable(err), "invalid client credentials must not be retried")
+
+	// The secret file is read for every token request.
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cret"), 0o600))
+
+	resp, err := client.Get(gateway.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, 1, tokens.tokenRequests())
+}
@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RetryConfig configures how a Retrier handles failed deliveries.
+type RetryConfig struct {
+	// MaxRetries is the number of retries within a single push interval.
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry. Subsequent delays grow exponentially.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries and between failed intervals.
+	MaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failed intervals after which
+	// the circuit breaker opens. 0 disables the breaker.
+	BreakerThreshold int
+	// BreakerTimeout is how long the breaker stays open before a probe is sent.
+	BreakerTimeout time.Duration
+}
+
+// Retrier delivers with bounded retries inside an interval, exponential backoff
+// with jitter across failed intervals, and a circuit breaker.
+//
+// A Retrier is meant to be used by a single push loop and is not safe for
+// concurrent use.
+type Retrier struct {
+	config  RetryConfig
+	backoff Backoff
+	breaker *CircuitBreaker
+	now     func() time.Time
+
+	// failures counts consecutive failed intervals.
+	failures    int
+	nextAttempt time.Time
+}
+
+// NewRetrier returns a new Retrier for the given configuration.
+func NewRetrier(config RetryConfig) *Retrier {
+	return &Retrier{
+		config: config,
+		backoff: Backoff{
+			Initial:    config.InitialBackoff,
+			Max:        config.MaxBackoff,
+			Multiplier: 2,
+			Jitter:     0.2,
+		},
+		breaker: NewCircuitBreaker(config.BreakerThreshold, config.BreakerTimeout),
+		now:     time.Now,
+	}
+}
+
+// Do calls fn until it succeeds, fails with a non-retryable error, the retries
+// are exhausted or ctx is done. The deadline of ctx bounds all retries, so it
+// should not exceed the push interval. Every failed interval, including one that
+// failed with a non-retryable error, delays the next attempt and counts towards
+// the circuit breaker. An interval that ends because ctx is canceled is not a
+// failed interval.
+//
+// If the target is still backing off or the circuit breaker is open, fn is not
+// called and an error wrapping ErrBackoff or ErrCircuitOpen is returned.
+func (r *Retrier) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if wait := r.nextAttempt.Sub(r.now()); wait > 0 {
+		return fmt.Errorf("%w: next attempt in %s", ErrBackoff, wait.Round(time.Millisecond))
+	}
+
+	if !r.breaker.Allow() {
+		return ErrCircuitOpen
+	}
+
+	attempts := 1 + max(r.config.MaxRetries, 0)
+	if r.breaker.State() == BreakerHalfOpen {
+		// A half-open breaker sends a single probe.
+		attempts = 1
+	}
+
+	var err error
+
+	for attempt := range attempts {
+		if err = fn(ctx); err == nil {
+			r.reset()
+
+			return nil
+		}
+
+		// Fatal errors, such as invalid credentials, fail the same way when retried
+		// within the interval. They still back off, so a misconfigured target is not
+		// sent every interval.
+		if !IsRetryable(err) || attempt == attempts-1 || !r.wait(ctx, r.backoff.Duration(attempt)) {
+			break
+		}
+	}
+
+	// A push that was canceled, because the agent is stopping, says nothing about the target.
+	// Only the deadline of ctx is part of the interval.
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return err
+	}
+
+	r.failures++
+	r.breaker.Failure()
+	r.nextAttempt = r.now().Add(r.backoff.Duration(r.failures - 1))
+
+	return fmt.Errorf("delivery failed after %d consecutive failed intervals: %w", r.failures, err)
+}
+
+// State returns the state of the circuit breaker.
+func (r *Retrier) State() BreakerState {
+	return r.breaker.State()
+}
+
+// reset marks the target as healthy.
+func (r *Retrier) reset() {
+	r.breaker.Success()
+	r.failures = 0
+	r.nextAttempt = time.Time{}
+}
+
+// wait sleeps for d and reports whether there is time left for another attempt.
+func (r *Retrier) wait(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && r.now().Add(d).After(deadline) {
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// Schedule computes push times that are aligned to wall-clock multiples of the interval, shifted
+// by a fixed offset. Agents that start at the same time, for example after a site-wide reboot,
+// still push at different times within the interval, and each agent always pushes at the same
+// point of the interval.
+type Schedule struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+// NewSchedule returns a Schedule whose offset is derived from a hash of key, usually the agent ID.
+// The interval must be positive; like time.NewTicker, NewSchedule panics otherwise.
+func NewSchedule(interval time.Duration, key string) Schedule {
+	if interval <= 0 {
+		panic("non-positive interval for NewSchedule")
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	return Schedule{interval: interval, offset: time.Duration(h.Sum64() % uint64(interval))}
+}
+
+// Offset returns the offset of the push times from the multiples of the interval.
+func (s Schedule) Offset() time.Duration {
+	return s.offset
+}
+
+// Next returns the first push time after now.
+func (s Schedule) Next(now time.Time) time.Time {
+	n := now.UnixNano() - int64(s.offset)
+	slot := n / int64(s.interval)
+
+	// Division truncates toward zero, which only matters before 1970.
+	if n < 0 && n%int64(s.interval) != 0 {
+		slot--
+	}
+
+	return time.Unix(0, (slot+1)*int64(s.interval)+int64(s.offset))
+}
+
+// Missed returns the number of push times in (scheduled, now]. A push that started at scheduled
+// and ended at now skipped them.
+func (s Schedule) Missed(scheduled, now time.Time) int {
+	if !now.After(scheduled) {
+		return 0
+	}
+
+	return int(s.Next(now).Sub(scheduled)/s.interval) - 1
+}
@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import "context"
+
+// Sender delivers snapshots to a target.
+type Sender interface {
+	Send(ctx context.Context, snapshot Snapshot) error
+}
+
+// SenderFunc is an adapter to allow the use of ordinary functions as Sender.
+type SenderFunc func(ctx context.Context, snapshot Snapshot) error
+
+// Send implements Sender.
+func (f SenderFunc) Send(ctx context.Context, snapshot Snapshot) error {
+	return f(ctx, snapshot)
+}
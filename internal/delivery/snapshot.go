@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Snapshot is a set of metric families gathered at a single point in time.
+type Snapshot struct {
+	Timestamp time.Time
+	Families  []*dto.MetricFamily
+}
+
+// Gather gathers a new Snapshot from g. If g is a CachedGatherer, its cached snapshot may be returned.
+func Gather(g prometheus.Gatherer) (Snapshot, error) {
+	if cached, ok := g.(*CachedGatherer); ok {
+		return cached.Snapshot()
+	}
+
+	timestamp := time.Now()
+
+	families, err := g.Gather()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return Snapshot{Timestamp: timestamp, Families: families}, nil
+}
+
+// Gatherer returns a prometheus.Gatherer that returns the families of the snapshot.
+func (s Snapshot) Gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return s.Families, nil
+	})
+}
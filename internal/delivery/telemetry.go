@@ -0,0 +1,290 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons that failed pushes are counted under.
+const (
+	// FailureTimeout is a push that timed out.
+	FailureTimeout = "timeout"
+	// FailureHTTP4xx is a push rejected with a 4xx status code.
+	FailureHTTP4xx = "http_4xx"
+	// FailureHTTP5xx is a push rejected with a 5xx status code.
+	FailureHTTP5xx = "http_5xx"
+	// FailureNetwork is a push that failed with a network error other than a timeout.
+	FailureNetwork = "network"
+	// FailureOther is a push that failed for any other reason.
+	FailureOther = "other"
+)
+
+//nolint:gochecknoglobals
+var (
+	failureReasons = []string{FailureTimeout, FailureHTTP4xx, FailureHTTP5xx, FailureNetwork, FailureOther}
+
+	durationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// Telemetry records the push attempts of a target. It implements prometheus.Collector, so the
+// state of the pushes is delivered with the next push that succeeds.
+type Telemetry struct {
+	now func() time.Time
+
+	mu           sync.Mutex
+	attempts     float64
+	failures     map[string]float64
+	lastSuccess  time.Time
+	payloadBytes float64
+	series       float64
+
+	duration prometheus.Histogram
+
+	attemptsDesc     *prometheus.Desc
+	failuresDesc     *prometheus.Desc
+	lastSuccessDesc  *prometheus.Desc
+	payloadBytesDesc *prometheus.Desc
+	seriesDesc       *prometheus.Desc
+}
+
+// NewTelemetry returns a Telemetry.
+func NewTelemetry() *Telemetry {
+	return &Telemetry{
+		now:      time.Now,
+		failures: map[string]float64{},
+
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    prometheus.BuildFQName(types.Namespace, "agent", "push_duration_seconds"),
+			Help:    "Duration of the push attempts.",
+			Buckets: durationBuckets,
+		}),
+
+		attemptsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_attempts_total"),
+			"Number of push attempts, including retries and replays of the offline buffer.",
+			nil,
+			nil,
+		),
+		failuresDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_failures_total"),
+			"Number of failed push attempts.",
+			[]string{"reason"},
+			nil,
+		),
+		lastSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_last_success_timestamp_seconds"),
+			"Timestamp of the last successful push. 0 if no push succeeded yet.",
+			nil,
+			nil,
+		),
+		payloadBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_payload_bytes"),
+			"Size of the request body of the last push. Only reported for targets pushed to over HTTP.",
+			nil,
+			nil,
+		),
+		seriesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "push_series"),
+			"Number of series of the last pushed snapshot.",
+			nil,
+			nil,
+		),
+	}
+}
+
+// Sender returns a Sender that records the attempts of next.
+func (t *Telemetry) Sender(next Sender) Sender {
+	return &telemetrySender{telemetry: t, sender: next}
+}
+
+// RoundTripper returns an http.RoundTripper that records the size of the request bodies sent with next.
+// Requests without a body, such as deletes of the grouping key, are not recorded.
+func (t *Telemetry) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &telemetryRoundTripper{telemetry: t, next: next}
+}
+
+func (t *Telemetry) observe(snapshot Snapshot, duration time.Duration, err error) {
+	t.duration.Observe(duration.Seconds())
+
+	var series int
+	for _, mf := range snapshot.Families {
+		series += len(mf.GetMetric())
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attempts++
+	t.series = float64(series)
+
+	if err != nil {
+		t.failures[FailureReason(err)]++
+
+		return
+	}
+
+	t.lastSuccess = t.now()
+}
+
+// FailureReason returns the reason that a failed push is counted under.
+func FailureReason(err error) string {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.StatusCode >= http.StatusInternalServerError {
+			return FailureHTTP5xx
+		}
+
+		return FailureHTTP4xx
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return FailureTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return FailureTimeout
+		}
+
+		return FailureNetwork
+	}
+
+	return FailureOther
+}
+
+// Describe implements prometheus.Collector.
+func (t *Telemetry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.attemptsDesc
+	ch <- t.failuresDesc
+	ch <- t.lastSuccessDesc
+	ch <- t.payloadBytesDesc
+	ch <- t.seriesDesc
+	t.duration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *Telemetry) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lastSuccess float64
+	if !t.lastSuccess.IsZero() {
+		lastSuccess = float64(t.lastSuccess.UnixNano()) / 1e9
+	}
+
+	ch <- prometheus.MustNewConstMetric(t.attemptsDesc, prometheus.CounterValue, t.attempts)
+	ch <- prometheus.MustNewConstMetric(t.lastSuccessDesc, prometheus.GaugeValue, lastSuccess)
+	ch <- prometheus.MustNewConstMetric(t.payloadBytesDesc, prometheus.GaugeValue, t.payloadBytes)
+	ch <- prometheus.MustNewConstMetric(t.seriesDesc, prometheus.GaugeValue, t.series)
+
+	for _, reason := range failureReasons {
+		ch <- prometheus.MustNewConstMetric(t.failuresDesc, prometheus.CounterValue, t.failures[reason], reason)
+	}
+
+	t.duration.Collect(ch)
+}
+
+// telemetrySender records the attempts of the wrapped sender.
+type telemetrySender struct {
+	telemetry *Telemetry
+	sender    Sender
+}
+
+func (s *telemetrySender) Send(ctx context.Context, snapshot Snapshot) error {
+	start := time.Now()
+	err := s.sender.Send(ctx, snapshot)
+	s.telemetry.observe(snapshot, time.Since(start), err)
+
+	return err
+}
+
+// Close closes the wrapped sender if it keeps a connection to the target.
+func (s *telemetrySender) Close(ctx context.Context) error {
+	type closer interface {
+		Close(ctx context.Context) error
+	}
+
+	if c, ok := s.sender.(closer); ok {
+		return c.Close(ctx)
+	}
+
+	return nil
+}
+
+// telemetryRoundTripper records the size of the request bodies.
+type telemetryRoundTripper struct {
+	telemetry *Telemetry
+	next      http.RoundTripper
+}
+
+func (rt *telemetryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return rt.next.RoundTrip(req)
+	}
+
+	if req.ContentLength > 0 {
+		rt.telemetry.setPayloadBytes(req.ContentLength)
+
+		return rt.next.RoundTrip(req)
+	}
+
+	// The size of streamed bodies is known once they are read.
+	req = req.Clone(req.Context())
+	req.Body = &countingReader{ReadCloser: req.Body, done: rt.telemetry.setPayloadBytes}
+
+	return rt.next.RoundTrip(req)
+}
+
+func (t *Telemetry) setPayloadBytes(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.payloadBytes = float64(n)
+}
+
+// countingReader calls done with the number of bytes read when the body is closed.
+type countingReader struct {
+	io.ReadCloser
+
+	n    int64
+	done func(n int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	r.done(r.n)
+
+	return r.ReadCloser.Close()
+}
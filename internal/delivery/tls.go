@@ -0,0 +1,254 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+//nolint:gochecknoglobals
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// TLSConfig configures the TLS client of a push target.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the CAs used to verify the server. If empty, the system roots are used.
+	CAFile string
+	// CertFile and KeyFile are the PEM encoded client certificate and key for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the server name used for SNI and certificate verification.
+	ServerName string
+	// Host is the host of the target URL. The certificate is verified against it when ServerName
+	// is empty and the connection has no SNI server name, e.g. because the URL has an IP address.
+	Host string
+	// MinVersion is the minimum TLS version. 0 means TLS 1.2.
+	MinVersion uint16
+	// InsecureSkipVerify disables the verification of the server certificate.
+	InsecureSkipVerify bool
+}
+
+// ParseTLSVersion parses a TLS version in the form TLS10, TLS11, TLS12 or TLS13.
+func ParseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// NewTLSConfig returns a *tls.Config for the given configuration.
+//
+// The CA, certificate and key files are read again for every new connection and reloaded when
+// their content changed, so rotated certificates are picked up without a restart. If a file can
+// no longer be read, the last valid version is used.
+func NewTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be configured together")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         config.MinVersion,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify, //nolint:gosec // explicitly requested by the user
+	}
+
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+
+	if config.CAFile != "" && !config.InsecureSkipVerify {
+		ca := &caReloader{path: config.CAFile}
+		if _, err := ca.pool(); err != nil {
+			return nil, err
+		}
+
+		// The standard verification can't use a changing set of roots, so it is replaced
+		// by an equivalent verification against the current CA bundle.
+		tlsConfig.InsecureSkipVerify = true //nolint:gosec // verified in VerifyConnection
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return ca.verifyConnection(state, config.ServerName, config.Host)
+		}
+	}
+
+	if config.CertFile != "" {
+		cert := &certReloader{certPath: config.CertFile, keyPath: config.KeyFile}
+		if _, err := cert.certificate(); err != nil {
+			return nil, err
+		}
+
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.certificate()
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewTransport returns a clone of http.DefaultTransport using the given TLS configuration.
+func NewTransport(config TLSConfig) (*http.Transport, error) {
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+// caReloader holds the CA bundle loaded from path.
+type caReloader struct {
+	path string
+
+	mu      sync.Mutex
+	content []byte
+	roots   *x509.CertPool
+}
+
+func (r *caReloader) pool() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		if r.roots != nil {
+			return r.roots, nil
+		}
+
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	if r.roots != nil && bytes.Equal(content, r.content) {
+		return r.roots, nil
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(content) {
+		if r.roots != nil {
+			return r.roots, nil
+		}
+
+		return nil, fmt.Errorf("no certificates found in CA file %s", r.path)
+	}
+
+	r.content = content
+	r.roots = roots
+
+	return roots, nil
+}
+
+// verifyConnection verifies the server certificate against the current roots and the configured
+// server name. Without one, the SNI server name of the connection is used, which is empty for IP
+// addresses, so host is used as the last fallback.
+func (r *caReloader) verifyConnection(state tls.ConnectionState, serverName, host string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+
+	name := serverName
+	if name == "" {
+		name = state.ServerName
+	}
+
+	if name == "" {
+		name = host
+	}
+
+	if name == "" {
+		return errors.New("no server name to verify the certificate against")
+	}
+
+	roots, err := r.pool()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+// certReloader holds the client certificate loaded from certPath and keyPath.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu          sync.Mutex
+	certContent []byte
+	keyContent  []byte
+	cert        *tls.Certificate
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certContent, certErr := os.ReadFile(r.certPath)
+	keyContent, keyErr := os.ReadFile(r.keyPath)
+
+	if err := errors.Join(certErr, keyErr); err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+
+		return nil, fmt.Errorf("failed to read client certificate: %w", err)
+	}
+
+	if r.cert != nil && bytes.Equal(certContent, r.certContent) && bytes.Equal(keyContent, r.keyContent) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.X509KeyPair(certContent, keyContent)
+	if err != nil {
+		// The certificate and key are usually not replaced at the same time.
+		// Keep the previous pair until both files match again.
+		if r.cert != nil {
+			return r.cert, nil
+		}
+
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	r.certContent = certContent
+	r.keyContent = keyContent
+	r.cert = &cert
+
+	return r.cert, nil
+}
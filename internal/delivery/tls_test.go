@@ -0,0 +1,342 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package delivery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func newTLSServer(t *testing.T, ca *testCA, clientCAs *x509.CertPool) *httptest.Server {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, "gateway.internal", x509.ExtKeyUsageServerAuth)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+}
+
+// get sends a request on a new connection and returns the common name of the client certificate seen by the server.
+func get(t *testing.T, transport *http.Transport, url string) (string, error) {
+	t.Helper()
+
+	transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return "", err
+	}
+
+	_ = resp.Body.Close()
+
+	return resp.Header.Get("X-Client"), nil
+}
+
+func TestNewTransport(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	server := newTLSServer(t, serverCA, clientCAs)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+
+	writeFile(t, caFile, serverCA.pem)
+
+	certPEM, keyPEM := clientCA.issue(t, "agent-1", x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	t.Run("system roots", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{})
+		require.NoError(t, err)
+
+		_, err = get(t, transport, server.URL)
+		require.Error(t, err)
+	})
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{InsecureSkipVerify: true})
+		require.NoError(t, err)
+
+		_, err = get(t, transport, server.URL)
+		require.NoError(t, err)
+	})
+
+	t.Run("server name mismatch", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{CAFile: caFile, ServerName: "other.internal"})
+		require.NoError(t, err)
+
+		_, err = get(t, transport, server.URL)
+		require.Error(t, err)
+	})
+
+	t.Run("ip address", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{CAFile: caFile, Host: "127.0.0.1"})
+		require.NoError(t, err)
+
+		_, err = get(t, transport, server.URL)
+		require.NoError(t, err)
+	})
+
+	t.Run("ip address mismatch", func(t *testing.T) {
+		t.Parallel()
+
+		// The certificate only has the IP address 127.0.0.1.
+		transport, err := NewTransport(TLSConfig{CAFile: caFile, Host: "192.0.2.1"})
+		require.NoError(t, err)
+
+		_, err = get(t, transport, server.URL)
+		require.ErrorContains(t, err, "192.0.2.1")
+	})
+
+	t.Run("no server name", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{CAFile: caFile})
+		require.NoError(t, err)
+
+		_, err = get(t, transport, server.URL)
+		require.ErrorContains(t, err, "no server name")
+	})
+
+	t.Run("mutual TLS", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{
+			CAFile:     caFile,
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			ServerName: "gateway.internal",
+		})
+		require.NoError(t, err)
+
+		client, err := get(t, transport, server.URL)
+		require.NoError(t, err)
+		require.Equal(t, "agent-1", client)
+	})
+
+	t.Run("min version", func(t *testing.T) {
+		t.Parallel()
+
+		transport, err := NewTransport(TLSConfig{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+		require.NoError(t, err)
+
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+
+		_ = resp.Body.Close()
+
+		require.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+	})
+}
+
+func TestNewTransportReload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	clientCA := newTestCA(t, "client-ca")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	oldCA := newTestCA(t, "old-ca")
+	newCA := newTestCA(t, "new-ca")
+	oldServer := newTLSServer(t, oldCA, clientCAs)
+	newServer := newTLSServer(t, newCA, clientCAs)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+
+	writeFile(t, caFile, oldCA.pem)
+
+	certPEM, keyPEM := clientCA.issue(t, "agent-1", x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	transport, err := NewTransport(TLSConfig{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "gateway.internal",
+	})
+	require.NoError(t, err)
+
+	client, err := get(t, transport, oldServer.URL)
+	require.NoError(t, err)
+	require.Equal(t, "agent-1", client)
+
+	_, err = get(t, transport, newServer.URL)
+	require.Error(t, err)
+
+	// Rotate the CA bundle and the client certificate.
+	writeFile(t, caFile, newCA.pem)
+
+	certPEM, keyPEM = clientCA.issue(t, "agent-2", x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	client, err = get(t, transport, newServer.URL)
+	require.NoError(t, err)
+	require.Equal(t, "agent-2", client)
+
+	// A half-written or missing file keeps the last valid version in use.
+	writeFile(t, keyFile, []byte("garbage"))
+	require.NoError(t, os.Remove(caFile))
+
+	client, err = get(t, transport, newServer.URL)
+	require.NoError(t, err)
+	require.Equal(t, "agent-2", client)
+}
+
+func TestNewTLSConfigInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.pem")
+	writeFile(t, invalid, []byte("not a certificate"))
+
+	for name, config := range map[string]TLSConfig{
+		"missing CA file":  {CAFile: filepath.Join(dir, "missing.pem")},
+		"invalid CA file":  {CAFile: invalid},
+		"cert without key": {CertFile: invalid},
+		"invalid cert":     {CertFile: invalid, KeyFile: invalid},
+	} {
+		_, err := NewTLSConfig(config)
+		require.Error(t, err, name)
+	}
+
+	_, err := ParseTLSVersion("SSL3")
+	require.Error(t, err)
+
+	version, err := ParseTLSVersion("TLS13")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), version)
+}
@@ -0,0 +1,433 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package derive adds gauges that are computed from the metrics of the same gather, for example
+// the share of the commit limit that is used:
+//
+//	windows_memory_committed_bytes / windows_memory_commit_limit
+//
+// Expressions are a subset of PromQL: numbers, selectors with label matchers, the arithmetic
+// operators + - * /, and the aggregations sum, avg, min, max and count with an optional by clause.
+// Binary operators between two vectors match series with the same labels, or with the same values
+// of the labels of an on clause, or of all labels except those of an ignoring clause:
+//
+//	windows_cpu_time_per_second{mode="idle"} / on(core) sum by (core) (windows_cpu_time_per_second)
+//
+// Series without exactly one match on each side are dropped.
+package derive
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync/atomic"
+
+	"github.com/Brownster/agent-windows/internal/series"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+//nolint:gochecknoglobals
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Rule defines a derived gauge.
+type Rule struct {
+	// Name is the name of the gauge.
+	Name string
+	// Help is the help text of the gauge. Defaults to the expression.
+	Help string
+	// Expr is the expression that computes the gauge.
+	Expr string
+}
+
+// Expr is a parsed expression.
+type Expr interface {
+	eval(families map[string]*dto.MetricFamily) value
+}
+
+// value is the result of an expression: a scalar if vector is nil.
+type value struct {
+	scalar float64
+	vector []sample
+}
+
+type sample struct {
+	labels []*dto.LabelPair
+	value  float64
+}
+
+type numberLiteral float64
+
+type selectorExpr struct {
+	metric   string
+	matchers []matcher
+}
+
+type matcher struct {
+	name, op, value string
+	re              *regexp.Regexp
+}
+
+type binaryExpr struct {
+	op       string
+	matching *vectorMatching
+	lhs, rhs Expr
+}
+
+// vectorMatching is the on or ignoring clause of a binary operator.
+type vectorMatching struct {
+	on     bool
+	labels []string
+}
+
+type aggregateExpr struct {
+	op   string
+	by   []string
+	expr Expr
+}
+
+// Gatherer is a prometheus.Gatherer that adds the derived gauges of the rules to the metrics of
+// the wrapped gatherer.
+type Gatherer struct {
+	gatherer prometheus.Gatherer
+	logger   *slog.Logger
+	rules    []*rule
+}
+
+type rule struct {
+	Rule
+
+	expr Expr
+	// conflict is set once a gathered family with the name of the rule was logged.
+	conflict atomic.Bool
+}
+
+// New returns a Gatherer. It returns an error if a rule is invalid or its expression can't be parsed.
+func New(logger *slog.Logger, gatherer prometheus.Gatherer, rules []Rule) (*Gatherer, error) {
+	g := &Gatherer{gatherer: gatherer, logger: logger}
+	names := map[string]bool{}
+
+	for _, r := range rules {
+		if !metricNameRegexp.MatchString(r.Name) {
+			return nil, fmt.Errorf("derived metric %q: invalid metric name", r.Name)
+		}
+
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate derived metric %s", r.Name)
+		}
+
+		names[r.Name] = true
+
+		if r.Expr == "" {
+			return nil, fmt.Errorf("derived metric %s: empty expression", r.Name)
+		}
+
+		expr, err := Parse(r.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("derived metric %s: %w", r.Name, err)
+		}
+
+		if r.Help == "" {
+			r.Help = r.Expr
+		}
+
+		g.rules = append(g.rules, &rule{Rule: r, expr: expr})
+	}
+
+	return g, nil
+}
+
+// Gather implements prometheus.Gatherer. A derived gauge that has the name of a gathered family
+// is not added, and logged once.
+func (g *Gatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+
+	derived := make([]*dto.MetricFamily, 0, len(g.rules))
+
+	for _, r := range g.rules {
+		if _, ok := byName[r.Name]; ok {
+			if !r.conflict.Swap(true) {
+				g.logger.LogAttrs(context.Background(), slog.LevelWarn, "Derived metric has the name of a gathered metric and is not added",
+					slog.String("metric", r.Name),
+				)
+			}
+
+			continue
+		}
+
+		result := r.expr.eval(byName)
+		if result.vector == nil {
+			result.vector = []sample{{value: result.scalar}}
+		}
+
+		if len(result.vector) == 0 {
+			continue
+		}
+
+		mf := &dto.MetricFamily{
+			Name: proto.String(r.Name),
+			Help: proto.String(r.Help),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+
+		for _, s := range result.vector {
+			mf.Metric = append(mf.Metric, &dto.Metric{Label: s.labels, Gauge: &dto.Gauge{Value: proto.Float64(s.value)}})
+		}
+
+		slices.SortFunc(mf.Metric, func(a, b *dto.Metric) int {
+			return cmp.Compare(series.Key(a), series.Key(b))
+		})
+
+		derived = append(derived, mf)
+	}
+
+	if len(derived) > 0 {
+		families = append(families, derived...)
+		slices.SortFunc(families, func(a, b *dto.MetricFamily) int {
+			return cmp.Compare(a.GetName(), b.GetName())
+		})
+	}
+
+	return families, err
+}
+
+func (n numberLiteral) eval(map[string]*dto.MetricFamily) value {
+	return value{scalar: float64(n)}
+}
+
+func (s *selectorExpr) eval(families map[string]*dto.MetricFamily) value {
+	result := value{vector: []sample{}}
+
+	mf, ok := families[s.metric]
+	if !ok {
+		return result
+	}
+
+	for _, m := range mf.GetMetric() {
+		v, ok := series.Value(mf.GetType(), m)
+		if !ok || !s.matches(m) {
+			continue
+		}
+
+		result.vector = append(result.vector, sample{labels: m.GetLabel(), value: v})
+	}
+
+	return result
+}
+
+// matches reports whether the labels of m match all matchers. Missing labels have the empty value.
+func (s *selectorExpr) matches(m *dto.Metric) bool {
+	for _, mt := range s.matchers {
+		var v string
+
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == mt.name {
+				v = lp.GetValue()
+
+				break
+			}
+		}
+
+		var ok bool
+
+		switch mt.op {
+		case "=":
+			ok = v == mt.value
+		case "!=":
+			ok = v != mt.value
+		case "=~":
+			ok = mt.re.MatchString(v)
+		case "!~":
+			ok = !mt.re.MatchString(v)
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *binaryExpr) eval(families map[string]*dto.MetricFamily) value {
+	lhs := b.lhs.eval(families)
+	rhs := b.rhs.eval(families)
+
+	switch {
+	case lhs.vector == nil && rhs.vector == nil:
+		return value{scalar: apply(b.op, lhs.scalar, rhs.scalar)}
+	case rhs.vector == nil:
+		result := value{vector: make([]sample, 0, len(lhs.vector))}
+		for _, s := range lhs.vector {
+			result.vector = append(result.vector, sample{labels: s.labels, value: apply(b.op, s.value, rhs.scalar)})
+		}
+
+		return result
+	case lhs.vector == nil:
+		result := value{vector: make([]sample, 0, len(rhs.vector))}
+		for _, s := range rhs.vector {
+			result.vector = append(result.vector, sample{labels: s.labels, value: apply(b.op, lhs.scalar, s.value)})
+		}
+
+		return result
+	}
+
+	// Series that match more than one series on the other side are ambiguous, and dropped.
+	matches := make(map[string]float64, len(rhs.vector))
+	ambiguous := map[string]bool{}
+
+	for _, s := range rhs.vector {
+		k := key(b.matching.match(s.labels))
+		if _, ok := matches[k]; ok {
+			ambiguous[k] = true
+		}
+
+		matches[k] = s.value
+	}
+
+	lhsLabels := make([][]*dto.LabelPair, len(lhs.vector))
+	lhsCount := make(map[string]int, len(lhs.vector))
+
+	for i, s := range lhs.vector {
+		lhsLabels[i] = b.matching.match(s.labels)
+		lhsCount[key(lhsLabels[i])]++
+	}
+
+	result := value{vector: make([]sample, 0, len(lhs.vector))}
+
+	for i, s := range lhs.vector {
+		k := key(lhsLabels[i])
+		if ambiguous[k] || lhsCount[k] > 1 {
+			continue
+		}
+
+		if v, ok := matches[k]; ok {
+			result.vector = append(result.vector, sample{labels: lhsLabels[i], value: apply(b.op, s.value, v)})
+		}
+	}
+
+	return result
+}
+
+// match returns the labels that are matched, which are also the labels of the result: all labels
+// without a clause, the labels of an on clause, or all labels except those of an ignoring clause.
+func (m *vectorMatching) match(labels []*dto.LabelPair) []*dto.LabelPair {
+	if m == nil {
+		return labels
+	}
+
+	matched := make([]*dto.LabelPair, 0, len(labels))
+
+	for _, lp := range labels {
+		if slices.Contains(m.labels, lp.GetName()) == m.on {
+			matched = append(matched, lp)
+		}
+	}
+
+	return matched
+}
+
+func apply(op string, lhs, rhs float64) float64 {
+	switch op {
+	case "+":
+		return lhs + rhs
+	case "-":
+		return lhs - rhs
+	case "*":
+		return lhs * rhs
+	default:
+		return lhs / rhs
+	}
+}
+
+func (a *aggregateExpr) eval(families map[string]*dto.MetricFamily) value {
+	v := a.expr.eval(families)
+	if v.vector == nil {
+		v.vector = []sample{{value: v.scalar}}
+	}
+
+	type group struct {
+		labels []*dto.LabelPair
+		values []float64
+	}
+
+	var (
+		groups []*group
+		byKey  = map[string]*group{}
+	)
+
+	for _, s := range v.vector {
+		labels := make([]*dto.LabelPair, 0, len(a.by))
+
+		for _, lp := range s.labels {
+			if slices.Contains(a.by, lp.GetName()) {
+				labels = append(labels, lp)
+			}
+		}
+
+		k := key(labels)
+
+		g, ok := byKey[k]
+		if !ok {
+			g = &group{labels: labels}
+			byKey[k] = g
+			groups = append(groups, g)
+		}
+
+		g.values = append(g.values, s.value)
+	}
+
+	result := value{vector: make([]sample, 0, len(groups))}
+
+	for _, g := range groups {
+		var v float64
+
+		switch a.op {
+		case "sum", "avg":
+			for _, x := range g.values {
+				v += x
+			}
+
+			if a.op == "avg" {
+				v /= float64(len(g.values))
+			}
+		case "min":
+			v = slices.Min(g.values)
+		case "max":
+			v = slices.Max(g.values)
+		case "count":
+			v = float64(len(g.values))
+		}
+
+		result.vector = append(result.vector, sample{labels: g.labels, value: v})
+	}
+
+	return result
+}
+
+func key(labels []*dto.LabelPair) string {
+	return series.Key(&dto.Metric{Label: labels})
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package derive
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatherer(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	committed := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_committed_bytes", Help: "A test gauge"})
+	limit := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_commit_limit", Help: "A test gauge"})
+	received := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_bytes_received_per_second", Help: "A test gauge"}, []string{"nic"})
+	bandwidth := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_current_bandwidth_bytes", Help: "A test gauge"}, []string{"nic"})
+	cpu := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_cpu_time_total", Help: "A test counter"}, []string{"core", "mode"})
+	traffic := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_bytes_per_second", Help: "A test gauge"}, []string{"direction", "nic"})
+	registry.MustRegister(committed, limit, received, bandwidth, cpu, traffic)
+
+	committed.Set(3e9)
+	limit.Set(12e9)
+	received.WithLabelValues("Ethernet").Set(25e6)
+	received.WithLabelValues("Wi-Fi").Set(1e6)
+	bandwidth.WithLabelValues("Ethernet").Set(125e6)
+	cpu.WithLabelValues("0,0", "dpc").Add(5)
+	cpu.WithLabelValues("0,0", "idle").Add(80)
+	cpu.WithLabelValues("0,0", "user").Add(15)
+	cpu.WithLabelValues("0,1", "dpc").Add(1)
+	cpu.WithLabelValues("0,1", "idle").Add(49)
+	traffic.WithLabelValues("received", "Ethernet").Set(50e6)
+	traffic.WithLabelValues("sent", "Ethernet").Set(25e6)
+
+	g, err := New(slog.New(slog.DiscardHandler), registry, []Rule{
+		{Name: "test_commit_used_ratio", Help: "Share of the commit limit that is used.", Expr: "test_committed_bytes / test_commit_limit"},
+		{Name: "test_nic_utilization_percent", Expr: "100 * test_bytes_received_per_second / test_current_bandwidth_bytes"},
+		{Name: "test_cpu_dpc_ratio", Expr: `sum by (core) (test_cpu_time_total{mode="dpc"}) / sum(test_cpu_time_total) by (core)`},
+		{Name: "test_cpu_busy_max", Expr: `max(sum by (core) (test_cpu_time_total{mode!~'idle|dpc'}))`},
+		{Name: "test_cpu_cores", Expr: `count(test_cpu_time_total{mode="idle"}) - -1 * 0`},
+		{Name: "test_missing", Expr: "test_missing_total * 2"},
+		{Name: "test_nic_direction_ratio", Expr: `test_bytes_per_second{direction="received"} / ignoring(direction) test_current_bandwidth_bytes`},
+		{Name: "test_cpu_mode_ratio", Expr: `test_cpu_time_total{mode="idle"} / on(core) sum by (core) (test_cpu_time_total)`},
+		// Both directions match the same bandwidth.
+		{Name: "test_nic_ambiguous", Expr: "test_current_bandwidth_bytes / on(nic) test_bytes_per_second"},
+		{Name: "test_nic_ambiguous_left", Expr: "test_bytes_per_second / ignoring(direction) test_current_bandwidth_bytes"},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, testutil.GatherAndCompare(g, strings.NewReader(`# HELP test_commit_used_ratio Share of the commit limit that is used.
+# TYPE test_commit_used_ratio gauge
+test_commit_used_ratio 0.25
+# HELP test_cpu_busy_max max(sum by (core) (test_cpu_time_total{mode!~'idle|dpc'}))
+# TYPE test_cpu_busy_max gauge
+test_cpu_busy_max 15
+# HELP test_cpu_cores count(test_cpu_time_total{mode="idle"}) - -1 * 0
+# TYPE test_cpu_cores gauge
+test_cpu_cores 2
+# HELP test_cpu_mode_ratio test_cpu_time_total{mode="idle"} / on(core) sum by (core) (test_cpu_time_total)
+# TYPE test_cpu_mode_ratio gauge
+test_cpu_mode_ratio{core="0,0"} 0.8
+test_cpu_mode_ratio{core="0,1"} 0.98
+# HELP test_cpu_dpc_ratio sum by (core) (test_cpu_time_total{mode="dpc"}) / sum(test_cpu_time_total) by (core)
+# TYPE test_cpu_dpc_ratio gauge
+test_cpu_dpc_ratio{core="0,0"} 0.05
+test_cpu_dpc_ratio{core="0,1"} 0.02
+# HELP test_nic_direction_ratio test_bytes_per_second{direction="received"} / ignoring(direction) test_current_bandwidth_bytes
+# TYPE test_nic_direction_ratio gauge
+test_nic_direction_ratio{nic="Ethernet"} 0.4
+# HELP test_nic_utilization_percent 100 * test_bytes_received_per_second / test_current_bandwidth_bytes
+# TYPE test_nic_utilization_percent gauge
+test_nic_utilization_percent{nic="Ethernet"} 20
+`), "test_commit_used_ratio", "test_cpu_busy_max", "test_cpu_cores", "test_cpu_dpc_ratio", "test_nic_utilization_percent", "test_missing",
+		"test_cpu_mode_ratio", "test_nic_direction_ratio", "test_nic_ambiguous", "test_nic_ambiguous_left"))
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{
+		"1",
+		"-1.5e3",
+		"a",
+		`a{b="c",d!="e",f=~"g.*",h!~'i'}`,
+		"a{}",
+		"(a + b) * -c / 2",
+		"sum(a)",
+		"sum by () (a)",
+		"avg by (b, c) (a) - min(a) by (b)",
+		"sum",
+		"by",
+		"count(count(a) by (b))",
+		"a / on(b, c) b",
+		"a - ignoring() sum by (b) (c) * on(b) d",
+	} {
+		_, err := Parse(input)
+		require.NoError(t, err, input)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+
+	for input, expected := range map[string]string{
+		"":                      "parse error at position 1: unexpected end of expression",
+		"a +":                   "parse error at position 4: unexpected end of expression",
+		"a b":                   `parse error at position 3: unexpected "b"`,
+		"(a":                    `parse error at position 3: expected ")", got end of expression`,
+		"a{b=c}":                `parse error at position 5: expected string, got "c"`,
+		`a{b="c}`:               "parse error at position 5: unterminated string",
+		`a{b=~"("}`:             "parse error at position 6: invalid regular expression",
+		`a{b<"c"}`:              `parse error at position 4: unexpected character '<'`,
+		"sum by a (b)":          `parse error at position 8: expected "(", got "a"`,
+		"sum by (a) (b) by (c)": "parse error at position 16: duplicate grouping",
+		"rate(a)":               `parse error at position 1: unknown function "rate"`,
+		"a[5m]":                 `parse error at position 2: unexpected character '['`,
+		"1.2.3":                 `parse error at position 1: invalid number "1.2.3"`,
+		"a / on b":              `parse error at position 8: expected "(", got "b"`,
+		"a * on(b) 2":           `parse error at position 3: vector matching requires vectors on both sides of "*"`,
+	} {
+		_, err := Parse(input)
+		require.ErrorContains(t, err, expected, input)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, rules := range map[string][]Rule{
+		"name":       {{Name: "a-b", Expr: "1"}},
+		"expression": {{Name: "a"}},
+		"parse":      {{Name: "a", Expr: "b /"}},
+		"duplicate":  {{Name: "a", Expr: "1"}, {Name: "a", Expr: "2"}},
+	} {
+		_, err := New(slog.New(slog.DiscardHandler), prometheus.NewRegistry(), rules)
+		require.Error(t, err, name)
+	}
+}
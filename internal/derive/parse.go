@@ -0,0 +1,508 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package derive
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdentifier
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value float64
+	pos   int
+}
+
+// ParseError is returned for an invalid expression. Pos is the byte offset of the error.
+type ParseError struct {
+	Pos int
+	Err string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos+1, e.Err)
+}
+
+//nolint:gochecknoglobals
+var aggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+//nolint:gochecknoglobals
+var operators = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true,
+	"(": true, ")": true, "{": true, "}": true, ",": true,
+	"=": true, "!=": true, "=~": true, "!~": true,
+}
+
+// lex splits an expression into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	for pos := 0; pos < len(input); {
+		c := rune(input[pos])
+
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case c >= '0' && c <= '9' || c == '.':
+			end := pos
+			for end < len(input) && (isDigit(input[end]) || input[end] == '.' || input[end] == 'e' || input[end] == 'E' ||
+				(end > pos && (input[end] == '+' || input[end] == '-') && (input[end-1] == 'e' || input[end-1] == 'E'))) {
+				end++
+			}
+
+			value, err := strconv.ParseFloat(input[pos:end], 64)
+			if err != nil {
+				return nil, &ParseError{Pos: pos, Err: fmt.Sprintf("invalid number %q", input[pos:end])}
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: input[pos:end], value: value, pos: pos})
+			pos = end
+		case c == '_' || c == ':' || unicode.IsLetter(c):
+			end := pos
+			for end < len(input) && (input[end] == '_' || input[end] == ':' || isDigit(input[end]) || unicode.IsLetter(rune(input[end]))) {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdentifier, text: input[pos:end], pos: pos})
+			pos = end
+		case c == '"' || c == '\'':
+			end := pos + 1
+			for end < len(input) && input[end] != input[pos] {
+				if input[end] == '\\' {
+					end++
+				}
+
+				end++
+			}
+
+			if end >= len(input) {
+				return nil, &ParseError{Pos: pos, Err: "unterminated string"}
+			}
+
+			quoted := input[pos : end+1]
+			if c == '\'' {
+				quoted = `"` + strings.ReplaceAll(strings.ReplaceAll(quoted[1:len(quoted)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+
+			value, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, &ParseError{Pos: pos, Err: fmt.Sprintf("invalid string %s", input[pos:end+1])}
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: value, pos: pos})
+			pos = end + 1
+		default:
+			operator := string(c)
+			if pos+1 < len(input) {
+				switch two := input[pos : pos+2]; two {
+				case "!=", "=~", "!~":
+					operator = two
+				}
+			}
+
+			if !operators[operator] {
+				return nil, &ParseError{Pos: pos, Err: fmt.Sprintf("unexpected character %q", c)}
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser is a recursive descent parser of the grammar:
+//
+//	expr      = term { ("+" | "-") [ matching ] term }
+//	term      = unary { ("*" | "/") [ matching ] unary }
+//	unary     = "-" unary | primary
+//	primary   = number | "(" expr ")" | aggregate | selector
+//	aggregate = op [ grouping ] "(" expr ")" [ grouping ]
+//	grouping  = "by" "(" [ label { "," label } ] ")"
+//	matching  = ( "on" | "ignoring" ) "(" [ label { "," label } ] ")"
+//	selector  = metric [ "{" [ matcher { "," matcher } ] "}" ]
+//	matcher   = label ( "=" | "!=" | "=~" | "!~" ) string
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses an expression.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) isOperator(operators ...string) bool {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return false
+	}
+
+	for _, op := range operators {
+		if t.text == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) expect(operator string) error {
+	if t := p.next(); t.kind != tokenOperator || t.text != operator {
+		return p.errorf(t, "expected %q, got %s", operator, describe(t))
+	}
+
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return &ParseError{Pos: t.pos, Err: fmt.Sprintf(format, args...)}
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+func (p *parser) expr() (Expr, error) {
+	lhs, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("+", "-") {
+		op := p.next()
+
+		matching, err := p.matching()
+		if err != nil {
+			return nil, err
+		}
+
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+
+		if lhs, err = p.binary(op, matching, lhs, rhs); err != nil {
+			return nil, err
+		}
+	}
+
+	return lhs, nil
+}
+
+func (p *parser) term() (Expr, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("*", "/") {
+		op := p.next()
+
+		matching, err := p.matching()
+		if err != nil {
+			return nil, err
+		}
+
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		if lhs, err = p.binary(op, matching, lhs, rhs); err != nil {
+			return nil, err
+		}
+	}
+
+	return lhs, nil
+}
+
+// matching parses the optional on or ignoring clause of a binary operator.
+func (p *parser) matching() (*vectorMatching, error) {
+	t := p.peek()
+	if t.kind != tokenIdentifier || t.text != "on" && t.text != "ignoring" {
+		return nil, nil //nolint:nilnil
+	}
+
+	labels, err := p.grouping()
+	if err != nil {
+		return nil, err
+	}
+
+	return &vectorMatching{on: t.text == "on", labels: labels}, nil
+}
+
+// binary returns the binary expression of op. A matching clause requires vectors on both sides.
+func (p *parser) binary(op token, matching *vectorMatching, lhs, rhs Expr) (Expr, error) {
+	if matching != nil && (isScalar(lhs) || isScalar(rhs)) {
+		return nil, p.errorf(op, "vector matching requires vectors on both sides of %q", op.text)
+	}
+
+	return &binaryExpr{op: op.text, matching: matching, lhs: lhs, rhs: rhs}, nil
+}
+
+// isScalar reports whether expr always evaluates to a scalar.
+func isScalar(expr Expr) bool {
+	switch e := expr.(type) {
+	case numberLiteral:
+		return true
+	case *binaryExpr:
+		return isScalar(e.lhs) && isScalar(e.rhs)
+	default:
+		return false
+	}
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.isOperator("-") {
+		p.next()
+
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &binaryExpr{op: "*", lhs: numberLiteral(-1), rhs: expr}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case tokenNumber:
+		p.next()
+
+		return numberLiteral(t.value), nil
+	case tokenOperator:
+		if t.text != "(" {
+			return nil, p.errorf(t, "unexpected %q", t.text)
+		}
+
+		p.next()
+
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		return expr, nil
+	case tokenIdentifier:
+		if following := p.tokens[p.pos+1]; aggregations[t.text] &&
+			(following.kind == tokenOperator && following.text == "(" || following.kind == tokenIdentifier && following.text == "by") {
+			return p.aggregate()
+		}
+
+		if following := p.tokens[p.pos+1]; following.kind == tokenOperator && following.text == "(" {
+			return nil, p.errorf(t, "unknown function %q", t.text)
+		}
+
+		return p.selector()
+	default:
+		return nil, p.errorf(t, "unexpected %s", describe(t))
+	}
+}
+
+func (p *parser) aggregate() (Expr, error) {
+	expr := &aggregateExpr{op: p.next().text}
+
+	if p.peek().kind == tokenIdentifier && p.peek().text == "by" {
+		grouping, err := p.grouping()
+		if err != nil {
+			return nil, err
+		}
+
+		expr.by = grouping
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if expr.expr, err = p.expr(); err != nil {
+		return nil, err
+	}
+
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind == tokenIdentifier && p.peek().text == "by" {
+		if expr.by != nil {
+			return nil, p.errorf(p.peek(), "duplicate grouping")
+		}
+
+		if expr.by, err = p.grouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	return expr, nil
+}
+
+func (p *parser) grouping() ([]string, error) {
+	p.next()
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+
+	for !p.isOperator(")") {
+		if len(labels) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		t := p.next()
+		if t.kind != tokenIdentifier {
+			return nil, p.errorf(t, "expected label name, got %s", describe(t))
+		}
+
+		labels = append(labels, t.text)
+	}
+
+	p.next()
+
+	return labels, nil
+}
+
+func (p *parser) selector() (Expr, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier {
+		return nil, p.errorf(t, "expected metric name, got %s", describe(t))
+	}
+
+	expr := &selectorExpr{metric: t.text}
+
+	if !p.isOperator("{") {
+		return expr, nil
+	}
+
+	p.next()
+
+	for !p.isOperator("}") {
+		if len(expr.matchers) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		name := p.next()
+		if name.kind != tokenIdentifier {
+			return nil, p.errorf(name, "expected label name, got %s", describe(name))
+		}
+
+		op := p.next()
+		if op.kind != tokenOperator || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+			return nil, p.errorf(op, "expected label matcher operator, got %s", describe(op))
+		}
+
+		value := p.next()
+		if value.kind != tokenString {
+			return nil, p.errorf(value, "expected string, got %s", describe(value))
+		}
+
+		m := matcher{name: name.text, op: op.text, value: value.text}
+
+		if op.text == "=~" || op.text == "!~" {
+			re, err := regexp.Compile("^(?:" + value.text + ")$")
+			if err != nil {
+				return nil, p.errorf(value, "invalid regular expression: %s", err)
+			}
+
+			m.re = re
+		}
+
+		expr.matchers = append(expr.matchers, m)
+	}
+
+	p.next()
+
+	return expr, nil
+}
@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package filter drops metric families by name before they are delivered, and limits the number
+// of series of a gather.
+//
+// Families are filtered by allow and deny lists of regular expressions, globally and per
+// collector. If the remaining families have more series than the limit, whole families are
+// dropped, lowest priority first, until the limit is met.
+package filter
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Brownster/agent-windows/internal/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Reasons that dropped series are counted under.
+const (
+	// ReasonAllow is a family that matches none of the allow rules.
+	ReasonAllow = "allow"
+	// ReasonDeny is a family that matches a deny rule.
+	ReasonDeny = "deny"
+	// ReasonLimit is a family dropped to meet the series limit.
+	ReasonLimit = "limit"
+)
+
+// Rules select families by name. The regular expressions are anchored at both ends.
+type Rules struct {
+	// Allow drops the families that match none of the regular expressions. Empty allows all families.
+	Allow []string
+	// Deny drops the families that match any of the regular expressions.
+	Deny []string
+}
+
+// Config configures a Filter.
+type Config struct {
+	Rules
+
+	// Collectors are the rules of the families of a collector, by collector name. The families of
+	// the collector cpu are those with the prefix windows_cpu_.
+	Collectors map[string]Rules
+	// Priorities are regular expressions of family names, highest priority first. Families that
+	// match none of them have the lowest priority.
+	Priorities []string
+	// MaxSeries is the maximum number of series of a gather. 0 disables the limit.
+	MaxSeries int
+}
+
+// Filter is a prometheus.Gatherer that filters the families of the wrapped gatherer. It
+// implements prometheus.Collector to report the dropped series.
+type Filter struct {
+	gatherer prometheus.Gatherer
+	config   Config
+	logger   *slog.Logger
+
+	rules      rules
+	collectors map[string]rules
+	priorities []*regexp.Regexp
+
+	mu      sync.Mutex
+	dropped map[string]float64
+	// limited is true while the limit drops families, to log it only once.
+	limited bool
+
+	droppedDesc *prometheus.Desc
+}
+
+type rules struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// New returns a Filter. It returns an error if a regular expression is invalid.
+func New(logger *slog.Logger, gatherer prometheus.Gatherer, config Config) (*Filter, error) {
+	if config.MaxSeries < 0 {
+		return nil, fmt.Errorf("series limit %d is negative", config.MaxSeries)
+	}
+
+	f := &Filter{
+		gatherer:   gatherer,
+		config:     config,
+		logger:     logger,
+		collectors: make(map[string]rules, len(config.Collectors)),
+		dropped:    map[string]float64{},
+
+		droppedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "series_dropped_total"),
+			"Number of series dropped before delivery, by reason.",
+			[]string{"reason"},
+			nil,
+		),
+	}
+
+	var err error
+
+	if f.rules, err = compileRules(config.Rules); err != nil {
+		return nil, err
+	}
+
+	for name, r := range config.Collectors {
+		if f.collectors[name], err = compileRules(r); err != nil {
+			return nil, fmt.Errorf("collector %s: %w", name, err)
+		}
+	}
+
+	if f.priorities, err = compile(config.Priorities); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func compileRules(r Rules) (rules, error) {
+	allow, err := compile(r.Allow)
+	if err != nil {
+		return rules{}, err
+	}
+
+	deny, err := compile(r.Deny)
+	if err != nil {
+		return rules{}, err
+	}
+
+	return rules{allow: allow, deny: deny}, nil
+}
+
+func compile(expressions []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(expressions))
+
+	for _, expr := range expressions {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter expression %q: %w", expr, err)
+		}
+
+		result = append(result, re)
+	}
+
+	return result, nil
+}
+
+// match returns the reason to drop the family name, or "" to keep it.
+func (r rules) match(name string) string {
+	if len(r.allow) > 0 && !slices.ContainsFunc(r.allow, matches(name)) {
+		return ReasonAllow
+	}
+
+	if slices.ContainsFunc(r.deny, matches(name)) {
+		return ReasonDeny
+	}
+
+	return ""
+}
+
+func matches(name string) func(*regexp.Regexp) bool {
+	return func(re *regexp.Regexp) bool {
+		return re.MatchString(name)
+	}
+}
+
+// Gather implements prometheus.Gatherer.
+func (f *Filter) Gather() ([]*dto.MetricFamily, error) {
+	// The wrapped gatherer may collect f, so f.mu must not be held.
+	families, err := f.gatherer.Gather()
+
+	dropped := map[string]int{}
+	result := make([]*dto.MetricFamily, 0, len(families))
+
+	for _, mf := range families {
+		if reason := f.match(mf.GetName()); reason != "" {
+			dropped[reason] += len(mf.GetMetric())
+
+			continue
+		}
+
+		result = append(result, mf)
+	}
+
+	result, limited := f.limit(result)
+	for _, mf := range limited {
+		dropped[ReasonLimit] += len(mf.GetMetric())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for reason, count := range dropped {
+		f.dropped[reason] += float64(count)
+	}
+
+	if len(limited) > 0 && !f.limited {
+		names := make([]string, 0, len(limited))
+		for _, mf := range limited {
+			names = append(names, mf.GetName())
+		}
+
+		f.logger.LogAttrs(context.Background(), slog.LevelWarn, "Series limit exceeded, dropping metric families",
+			slog.Int("max_series", f.config.MaxSeries),
+			slog.Int("dropped_series", dropped[ReasonLimit]),
+			slog.String("families", strings.Join(names, ",")),
+		)
+	}
+
+	f.limited = len(limited) > 0
+
+	return result, err
+}
+
+// match returns the reason to drop the family name, or "" to keep it.
+func (f *Filter) match(name string) string {
+	if reason := f.rules.match(name); reason != "" {
+		return reason
+	}
+
+	for collector, r := range f.collectors {
+		if strings.HasPrefix(name, types.Namespace+"_"+collector+"_") {
+			if reason := r.match(name); reason != "" {
+				return reason
+			}
+		}
+	}
+
+	return ""
+}
+
+// limit drops the families with the lowest priority until the series limit is met. Families of
+// the same priority with more series are dropped first. It returns the kept and the dropped
+// families, the kept families in their original order.
+func (f *Filter) limit(families []*dto.MetricFamily) ([]*dto.MetricFamily, []*dto.MetricFamily) {
+	var total int
+	for _, mf := range families {
+		total += len(mf.GetMetric())
+	}
+
+	if f.config.MaxSeries == 0 || total <= f.config.MaxSeries {
+		return families, nil
+	}
+
+	order := slices.Clone(families)
+	slices.SortStableFunc(order, func(a, b *dto.MetricFamily) int {
+		return cmp.Or(
+			cmp.Compare(f.priority(b.GetName()), f.priority(a.GetName())),
+			cmp.Compare(len(b.GetMetric()), len(a.GetMetric())),
+			cmp.Compare(a.GetName(), b.GetName()),
+		)
+	})
+
+	drop := map[*dto.MetricFamily]bool{}
+
+	var dropped []*dto.MetricFamily
+
+	for _, mf := range order {
+		if total <= f.config.MaxSeries {
+			break
+		}
+
+		drop[mf] = true
+		dropped = append(dropped, mf)
+		total -= len(mf.GetMetric())
+	}
+
+	return slices.DeleteFunc(families, func(mf *dto.MetricFamily) bool {
+		return drop[mf]
+	}), dropped
+}
+
+// priority returns the index of the first priority that matches name. Higher values have a
+// lower priority.
+func (f *Filter) priority(name string) int {
+	if i := slices.IndexFunc(f.priorities, matches(name)); i >= 0 {
+		return i
+	}
+
+	return len(f.priorities)
+}
+
+// Describe implements prometheus.Collector.
+func (f *Filter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.droppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (f *Filter) Collect(ch chan<- prometheus.Metric) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, reason := range []string{ReasonAllow, ReasonDeny, ReasonLimit} {
+		ch <- prometheus.MustNewConstMetric(f.droppedDesc, prometheus.CounterValue, f.dropped[reason], reason)
+	}
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package filter
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func names(families []*dto.MetricFamily) []string {
+	result := make([]string, 0, len(families))
+	for _, mf := range families {
+		result = append(result, mf.GetName())
+	}
+
+	return result
+}
+
+func TestFilter(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "windows_net_nic_operation_status", Help: "A test gauge"}, []string{"nic", "status"})
+	received := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "windows_net_bytes_received_total", Help: "A test counter"}, []string{"nic"})
+	address := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "windows_net_nic_address_info", Help: "A test gauge"}, []string{"nic", "address"})
+	cpu := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "windows_cpu_time_total", Help: "A test counter"}, []string{"core"})
+	memory := prometheus.NewGauge(prometheus.GaugeOpts{Name: "windows_memory_available_bytes", Help: "A test gauge"})
+	pagefile := prometheus.NewGauge(prometheus.GaugeOpts{Name: "windows_pagefile_limit_bytes", Help: "A test gauge"})
+	registry.MustRegister(status, received, address, cpu, memory, pagefile)
+
+	for i := range 4 {
+		nic := "vEthernet " + strconv.Itoa(i)
+		status.WithLabelValues(nic, "up").Set(1)
+		status.WithLabelValues(nic, "down").Set(0)
+		received.WithLabelValues(nic).Add(1)
+		address.WithLabelValues(nic, "fe80::"+strconv.Itoa(i)).Set(1)
+	}
+
+	cpu.WithLabelValues("0,0").Add(1)
+	cpu.WithLabelValues("0,1").Add(1)
+	memory.Set(1)
+	pagefile.Set(1)
+
+	f, err := New(slog.New(slog.DiscardHandler), registry, Config{
+		Rules: Rules{Deny: []string{"windows_pagefile_.*"}},
+		Collectors: map[string]Rules{
+			"net": {Allow: []string{"windows_net_nic_.*", "windows_net_bytes_.*"}, Deny: []string{".*_address_info"}},
+		},
+		Priorities: []string{"windows_(cpu|memory)_.*", "windows_net_bytes_.*"},
+		MaxSeries:  10,
+	})
+	require.NoError(t, err)
+	registry.MustRegister(f)
+
+	// 8 operation status series exceed the limit with the 4 + 2 + 1 series of higher priority.
+	families, err := f.Gather()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"windows_agent_series_dropped_total",
+		"windows_cpu_time_total",
+		"windows_memory_available_bytes",
+		"windows_net_bytes_received_total",
+	}, names(families))
+
+	require.NoError(t, testutil.CollectAndCompare(f, strings.NewReader(`# HELP windows_agent_series_dropped_total Number of series dropped before delivery, by reason.
+# TYPE windows_agent_series_dropped_total counter
+windows_agent_series_dropped_total{reason="allow"} 0
+windows_agent_series_dropped_total{reason="deny"} 5
+windows_agent_series_dropped_total{reason="limit"} 8
+`)))
+
+	f.config.MaxSeries = 0
+
+	families, err = f.Gather()
+	require.NoError(t, err)
+	require.Contains(t, names(families), "windows_net_nic_operation_status")
+	require.NotContains(t, names(families), "windows_net_nic_address_info")
+}
+
+func TestFilterAllow(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "windows_cpu_a", Help: "A test gauge"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "windows_cpu_b", Help: "A test gauge"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "windows_cpus", Help: "A test gauge"}),
+	)
+
+	f, err := New(slog.New(slog.DiscardHandler), registry, Config{
+		Collectors: map[string]Rules{"cpu": {Allow: []string{"windows_cpu_a"}}},
+	})
+	require.NoError(t, err)
+
+	families, err := f.Gather()
+	require.NoError(t, err)
+	require.Equal(t, []string{"windows_cpu_a", "windows_cpus"}, names(families))
+	require.Equal(t, 1.0, f.dropped[ReasonAllow])
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, config := range map[string]Config{
+		"allow":      {Rules: Rules{Allow: []string{"("}}},
+		"collector":  {Collectors: map[string]Rules{"net": {Deny: []string{"["}}}},
+		"priorities": {Priorities: []string{"*"}},
+		"limit":      {MaxSeries: -1},
+	} {
+		_, err := New(slog.New(slog.DiscardHandler), prometheus.NewRegistry(), config)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package grouping expands and validates the grouping key of pushes.
+package grouping
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+)
+
+// AgentIDLabel is the grouping label that identifies the agent. It is always part of the grouping key.
+const AgentIDLabel = "agent_id"
+
+// Data is the data available to the grouping templates.
+type Data struct {
+	AgentID   string
+	Hostname  string
+	OSVersion string
+}
+
+//nolint:gochecknoglobals
+var funcs = template.FuncMap{
+	"env":   os.Getenv,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// Expand expands the templates of a grouping key and validates the result.
+//
+// The templates use the text/template syntax, for example "{{ .Hostname | lower }}" or "{{ env \"SITE\" }}".
+// Values are returned unencoded. The Pushgateway client encodes values that can't be used as a path
+// segment, such as values containing a "/", with base64.
+func Expand(templates map[string]string, data Data) (map[string]string, error) {
+	grouping := make(map[string]string, len(templates))
+
+	for name, text := range templates {
+		if err := ValidateName(name); err != nil {
+			return nil, err
+		}
+
+		tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("grouping label %q: invalid template: %w", name, err)
+		}
+
+		var value strings.Builder
+		if err = tmpl.Execute(&value, data); err != nil {
+			return nil, fmt.Errorf("grouping label %q: %w", name, err)
+		}
+
+		if err = ValidateValue(value.String()); err != nil {
+			return nil, fmt.Errorf("grouping label %q: %w", name, err)
+		}
+
+		grouping[name] = value.String()
+	}
+
+	return grouping, nil
+}
+
+// ValidateName reports whether name can be used as an additional grouping label.
+// The job and agent_id labels are set by the agent and can't be overridden.
+func ValidateName(name string) error {
+	switch {
+	case !model.LabelName(name).IsValidLegacy():
+		return fmt.Errorf("invalid grouping label name %q", name)
+	case strings.HasPrefix(name, model.ReservedLabelPrefix):
+		return fmt.Errorf("grouping label name %q is reserved", name)
+	case name == model.JobLabel, name == AgentIDLabel:
+		return fmt.Errorf("grouping label %q is set by the agent", name)
+	}
+
+	return nil
+}
+
+// ValidateValue reports whether value is a legal grouping label value.
+// Empty values are legal for the Pushgateway, but they are rejected as they usually
+// stem from an unset environment variable.
+func ValidateValue(value string) error {
+	switch {
+	case value == "":
+		return errors.New("value is empty")
+	case !utf8.ValidString(value):
+		return fmt.Errorf("value %q is not valid UTF-8", value)
+	}
+
+	return nil
+}
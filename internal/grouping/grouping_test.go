@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package grouping_test
+
+import (
+	"testing"
+
+	"github.com/Brownster/agent-windows/internal/grouping"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpand(t *testing.T) {
+	t.Setenv("AGENT_SITE", "berlin/dc-1")
+
+	data := grouping.Data{
+		AgentID:   "agent_001",
+		Hostname:  "WS-0042",
+		OSVersion: "10.0.22631",
+	}
+
+	result, err := grouping.Expand(map[string]string{
+		"site":       `{{ env "AGENT_SITE" }}`,
+		"hostname":   "{{ .Hostname | lower }}",
+		"os_version": "{{ .OSVersion }}",
+		"instance":   "{{ .AgentID }}@{{ .Hostname }}",
+		"tenant":     "team-a",
+	}, data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"site":       "berlin/dc-1",
+		"hostname":   "ws-0042",
+		"os_version": "10.0.22631",
+		"instance":   "agent_001@WS-0042",
+		"tenant":     "team-a",
+	}, result)
+}
+
+func TestExpandInvalid(t *testing.T) {
+	tests := map[string]map[string]string{
+		"invalid name":         {"site-name": "berlin"},
+		"reserved name":        {"__site": "berlin"},
+		"job":                  {"job": "windows"},
+		"agent_id":             {"agent_id": "agent"},
+		"invalid template":     {"site": "{{ .Hostname"},
+		"unknown field":        {"site": "{{ .Site }}"},
+		"unset variable":       {"site": `{{ env "AGENT_UNSET_VARIABLE" }}`},
+		"invalid UTF-8 string": {"site": "\xff"},
+	}
+
+	for name, templates := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := grouping.Expand(templates, grouping.Data{})
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,297 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package labels adds constant labels to the metrics of collectors.
+package labels
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// CollisionError rejects metrics that already have one of the labels.
+	CollisionError = "error"
+	// CollisionRename renames the existing label to exported_<name>, like Prometheus does on scrape.
+	CollisionRename = "rename"
+
+	exportedPrefix = "exported_"
+)
+
+// Wrapper adds a fixed set of labels to the metrics of a collector.
+type Wrapper struct {
+	labels    map[string]string
+	collision string
+}
+
+// New returns a Wrapper that adds labels to every metric.
+func New(labels map[string]string, collision string) (*Wrapper, error) {
+	switch collision {
+	case CollisionError, CollisionRename:
+	default:
+		return nil, fmt.Errorf("invalid label collision mode %q", collision)
+	}
+
+	for name, value := range labels {
+		switch {
+		case !model.LabelName(name).IsValidLegacy():
+			return nil, fmt.Errorf("invalid label name %q", name)
+		case strings.HasPrefix(name, model.ReservedLabelPrefix):
+			return nil, fmt.Errorf("label name %q is reserved", name)
+		case name == model.JobLabel:
+			return nil, fmt.Errorf("label %q is set by the push target", name)
+		case value == "":
+			return nil, fmt.Errorf("label %q: value is empty", name)
+		}
+	}
+
+	return &Wrapper{labels: labels, collision: collision}, nil
+}
+
+// Register registers c with registerer and adds the labels of the wrapper to all its metrics.
+//
+// In the error mode, the labels are added by prometheus.WrapRegistererWith, so the registry rejects
+// descriptors of c that already have one of them. Metrics that c did not describe must be passed
+// through Metric, which rejects them before they fail the gather.
+//
+// In the rename mode, the labels are added by Metric once the metric is written. The descriptors of c
+// are registered with the labels added and existing labels renamed the same way.
+func (w *Wrapper) Register(registerer prometheus.Registerer, c prometheus.Collector) error {
+	if w.collision == CollisionRename {
+		return registerer.Register(renamingCollector{Collector: c, wrapper: w})
+	}
+
+	return prometheus.WrapRegistererWith(w.labels, registerer).Register(c)
+}
+
+// Metric writes m and checks it for labels of the wrapper. In the error mode, an error is returned if
+// m already has one of them. In the rename mode, the existing label is renamed and the labels are added.
+// The returned metric writes the checked labels and the value of m, without writing m again.
+func (w *Wrapper) Metric(m prometheus.Metric) (prometheus.Metric, error) {
+	out := &dto.Metric{}
+	if err := m.Write(out); err != nil {
+		return nil, err
+	}
+
+	exists := func(name string) bool {
+		return slices.ContainsFunc(out.GetLabel(), func(lp *dto.LabelPair) bool {
+			return lp.GetName() == name
+		})
+	}
+
+	for name := range w.labels {
+		if !exists(name) {
+			continue
+		}
+
+		if w.collision != CollisionRename {
+			return nil, fmt.Errorf("metric already has the label %q", name)
+		}
+
+		renamed := exportedPrefix + name
+		for exists(renamed) {
+			renamed = exportedPrefix + renamed
+		}
+
+		for _, lp := range out.GetLabel() {
+			if lp.GetName() == name {
+				lp.Name = proto.String(renamed)
+			}
+		}
+	}
+
+	if w.collision == CollisionRename {
+		for name, value := range w.labels {
+			out.Label = append(out.Label, &dto.LabelPair{
+				Name:  proto.String(name),
+				Value: proto.String(value),
+			})
+		}
+
+		slices.SortFunc(out.Label, func(a, b *dto.LabelPair) int {
+			return strings.Compare(a.GetName(), b.GetName())
+		})
+	}
+
+	return &metric{desc: m.Desc(), out: out}, nil
+}
+
+// rename returns desc with the labels of the wrapper. Existing labels are renamed like in Metric.
+func (w *Wrapper) rename(desc *prometheus.Desc) *prometheus.Desc {
+	fqName, help, constLabels, variableLabels, err := parseDesc(desc.String())
+	if err != nil {
+		return prometheus.NewInvalidDesc(fmt.Errorf("%s: %w", desc, err))
+	}
+
+	exists := func(name string) bool {
+		_, ok := constLabels[name]
+
+		return ok || slices.Contains(variableLabels, name)
+	}
+
+	for name := range w.labels {
+		if !exists(name) {
+			continue
+		}
+
+		renamed := exportedPrefix + name
+		for exists(renamed) {
+			renamed = exportedPrefix + renamed
+		}
+
+		if value, ok := constLabels[name]; ok {
+			delete(constLabels, name)
+			constLabels[renamed] = value
+		}
+
+		for i, label := range variableLabels {
+			if label == name {
+				variableLabels[i] = renamed
+			}
+		}
+	}
+
+	maps.Copy(constLabels, w.labels)
+
+	return prometheus.NewDesc(fqName, help, variableLabels, constLabels)
+}
+
+// parseDesc returns the fields of a descriptor from its string form. prometheus.Desc does not
+// expose them otherwise.
+func parseDesc(s string) (string, string, prometheus.Labels, []string, error) {
+	errMalformed := errors.New("malformed descriptor")
+
+	rest, ok := strings.CutPrefix(s, "Desc{fqName: ")
+	if !ok {
+		return "", "", nil, nil, errMalformed
+	}
+
+	fqName, rest, err := unquote(rest)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+
+	if rest, ok = strings.CutPrefix(rest, ", help: "); !ok {
+		return "", "", nil, nil, errMalformed
+	}
+
+	help, rest, err := unquote(rest)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+
+	if rest, ok = strings.CutPrefix(rest, ", constLabels: {"); !ok {
+		return "", "", nil, nil, errMalformed
+	}
+
+	constLabels := prometheus.Labels{}
+
+	for !strings.HasPrefix(rest, "}") {
+		var name, value string
+
+		if name, rest, ok = strings.Cut(rest, "="); !ok {
+			return "", "", nil, nil, errMalformed
+		}
+
+		if value, rest, err = unquote(rest); err != nil {
+			return "", "", nil, nil, err
+		}
+
+		constLabels[name] = value
+		rest = strings.TrimPrefix(rest, ",")
+	}
+
+	if rest, ok = strings.CutPrefix(rest, "}, variableLabels: {"); !ok {
+		return "", "", nil, nil, errMalformed
+	}
+
+	if rest, ok = strings.CutSuffix(rest, "}}"); !ok {
+		return "", "", nil, nil, errMalformed
+	}
+
+	var variableLabels []string
+
+	if rest != "" {
+		for _, name := range strings.Split(rest, ",") {
+			// Constrained labels are written as c(name).
+			if constrained, ok := strings.CutPrefix(name, "c("); ok {
+				name = strings.TrimSuffix(constrained, ")")
+			}
+
+			variableLabels = append(variableLabels, name)
+		}
+	}
+
+	return fqName, help, constLabels, variableLabels, nil
+}
+
+// unquote returns the Go string literal at the start of s and the rest of s.
+func unquote(s string) (string, string, error) {
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", err
+	}
+
+	value, err := strconv.Unquote(quoted)
+
+	return value, s[len(quoted):], err
+}
+
+// renamingCollector describes the descriptors of the wrapped collector with the labels of the wrapper.
+type renamingCollector struct {
+	prometheus.Collector
+
+	wrapper *Wrapper
+}
+
+func (c renamingCollector) Describe(ch chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc)
+
+	go func() {
+		c.Collector.Describe(descs)
+		close(descs)
+	}()
+
+	for desc := range descs {
+		ch <- c.wrapper.rename(desc)
+	}
+}
+
+// metric is a metric that was already written.
+type metric struct {
+	desc *prometheus.Desc
+	out  *dto.Metric
+}
+
+func (m *metric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m *metric) Write(out *dto.Metric) error {
+	proto.Merge(out, m.out)
+
+	return nil
+}
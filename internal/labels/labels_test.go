@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package labels
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// testCollector collects metrics through a Wrapper. Only the metrics of described are described.
+type testCollector struct {
+	wrapper   *Wrapper
+	described []prometheus.Metric
+	metrics   []prometheus.Metric
+	errs      []error
+}
+
+func (c *testCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.described {
+		ch <- m.Desc()
+	}
+}
+
+func (c *testCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range append(c.described, c.metrics...) {
+		wrapped, err := c.wrapper.Metric(m)
+		if err != nil {
+			c.errs = append(c.errs, err)
+
+			continue
+		}
+
+		ch <- wrapped
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	t.Parallel()
+
+	desc := prometheus.NewDesc("windows_cpu_time_total", `Time "spent" in each mode, by core.`,
+		[]string{"core", "site"}, prometheus.Labels{"exported_site": "x", "unit": "s,\"ms\""})
+	up := prometheus.NewDesc("windows_up", "Whether the collector is up.", nil, nil)
+
+	tests := []struct {
+		collision string
+		expected  string
+	}{
+		{
+			collision: CollisionRename,
+			expected: `# HELP windows_cpu_time_total Time "spent" in each mode, by core.
+# TYPE windows_cpu_time_total counter
+windows_cpu_time_total{agent_id="agent_001",core="0,0",exported_exported_site="lab",exported_site="x",site="berlin",unit="s,\"ms\""} 42
+# HELP windows_up Whether the collector is up.
+# TYPE windows_up gauge
+windows_up{agent_id="agent_001",site="berlin"} 1
+`,
+		},
+		{
+			collision: CollisionError,
+			expected: `# HELP windows_up Whether the collector is up.
+# TYPE windows_up gauge
+windows_up{agent_id="agent_001",site="berlin"} 1
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.collision, func(t *testing.T) {
+			t.Parallel()
+
+			wrapper, err := New(map[string]string{"agent_id": "agent_001", "site": "berlin"}, tt.collision)
+			require.NoError(t, err)
+
+			c := &testCollector{
+				wrapper:   wrapper,
+				described: []prometheus.Metric{prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1)},
+				metrics:   []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.CounterValue, 42, "0,0", "lab")},
+			}
+
+			registry := prometheus.NewRegistry()
+			require.NoError(t, wrapper.Register(registry, c))
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(tt.expected)))
+
+			if tt.collision == CollisionError {
+				require.Len(t, c.errs, 1)
+				require.ErrorContains(t, c.errs[0], `metric already has the label "site"`)
+			} else {
+				require.Empty(t, c.errs)
+			}
+		})
+	}
+
+	// Described descriptors that already have one of the labels are rejected by the registry.
+	wrapper, err := New(map[string]string{"site": "berlin"}, CollisionError)
+	require.NoError(t, err)
+
+	c := &testCollector{
+		wrapper:   wrapper,
+		described: []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.CounterValue, 42, "0,0", "lab")},
+	}
+	require.Error(t, wrapper.Register(prometheus.NewRegistry(), c))
+
+	// In the rename mode, described descriptors are registered with the labels, so they collide
+	// with the same metric of another collector.
+	wrapper, err = New(map[string]string{"agent_id": "agent_001", "site": "berlin"}, CollisionRename)
+	require.NoError(t, err)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&testCollector{described: []prometheus.Metric{prometheus.MustNewConstMetric(
+		prometheus.NewDesc("windows_up", "Whether the collector is up.", nil, prometheus.Labels{"agent_id": "agent_001", "site": "berlin"}),
+		prometheus.GaugeValue, 1,
+	)}})
+
+	c = &testCollector{
+		wrapper:   wrapper,
+		described: []prometheus.Metric{prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1)},
+	}
+	require.Error(t, wrapper.Register(registry, c))
+}
+
+func TestWrapperRename(t *testing.T) {
+	t.Parallel()
+
+	wrapper, err := New(map[string]string{"agent_id": "agent_001", "site": "berlin"}, CollisionRename)
+	require.NoError(t, err)
+
+	desc := prometheus.NewDesc("windows_cpu_time_total", `Time "spent" in each mode, by core.`,
+		[]string{"core", "site"}, prometheus.Labels{"exported_site": "x", "unit": "s,\"ms\""})
+
+	expected := prometheus.NewDesc("windows_cpu_time_total", `Time "spent" in each mode, by core.`,
+		[]string{"core", "exported_exported_site"},
+		prometheus.Labels{"agent_id": "agent_001", "exported_site": "x", "site": "berlin", "unit": "s,\"ms\""})
+	require.Equal(t, expected.String(), wrapper.rename(desc).String())
+
+	_, _, _, _, err = parseDesc("Desc{fqName: windows_up}")
+	require.Error(t, err)
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]map[string]string{
+		"invalid name":  {"site-name": "berlin"},
+		"reserved name": {"__site": "berlin"},
+		"job":           {"job": "windows"},
+		"empty value":   {"site": ""},
+	}
+
+	for name, labels := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := New(labels, CollisionError)
+			require.Error(t, err)
+		})
+	}
+
+	_, err := New(nil, "ignore")
+	require.Error(t, err)
+}
@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package rate computes the per-second rate of selected counters on the agent. A Pushgateway
+// only keeps the last pushed sample, so rate() on the server is unreliable if pushes are sparse
+// or delayed.
+//
+// For a counter windows_net_bytes_received_total, the rate is pushed as the gauge
+// windows_net_bytes_received_per_second, with the labels of the series. It is the rate between
+// the last two gathers, so the first gather of a series has no rate.
+package rate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/series"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultMinInterval is the default minimum time between the samples of a rate.
+const DefaultMinInterval = time.Second
+
+// Rule selects a counter whose rate is computed.
+type Rule struct {
+	// Metric is the name of a counter or untyped metric.
+	Metric string
+	// CounterBits is the width of the source counter, 32 or 64. A counter that decreases in the
+	// upper half of its range wrapped around. 0 treats every decrease as a reset.
+	CounterBits int
+}
+
+// Config configures a Gatherer.
+type Config struct {
+	// MinInterval is the minimum time between the samples of a rate. Gathers within MinInterval
+	// of the previous sample repeat the previous rate. Defaults to DefaultMinInterval.
+	MinInterval time.Duration
+	Rules       []Rule
+}
+
+// Gatherer is a prometheus.Gatherer that adds the rates of the rules to the metrics of the
+// wrapped gatherer.
+type Gatherer struct {
+	gatherer prometheus.Gatherer
+	logger   *slog.Logger
+	config   Config
+	now      func() time.Time
+
+	// mu serializes the calls to the wrapped gatherer, and guards the previous samples.
+	mu    sync.Mutex
+	rules map[string]*rule
+}
+
+type rule struct {
+	Rule
+
+	name   string
+	series map[string]*sample
+	// conflict is set once a gathered family with the name of the rate was logged.
+	conflict atomic.Bool
+}
+
+type sample struct {
+	timestamp time.Time
+	value     float64
+	rate      float64
+	// valid is false until the rate was computed from two samples.
+	valid bool
+}
+
+// New returns a Gatherer. It returns an error if a rule is invalid or two rules have rates of
+// the same name.
+func New(logger *slog.Logger, gatherer prometheus.Gatherer, config Config) (*Gatherer, error) {
+	if config.MinInterval <= 0 {
+		config.MinInterval = DefaultMinInterval
+	}
+
+	g := &Gatherer{
+		gatherer: gatherer,
+		logger:   logger,
+		config:   config,
+		now:      time.Now,
+		rules:    make(map[string]*rule, len(config.Rules)),
+	}
+
+	names := make(map[string]string, len(config.Rules))
+
+	for _, r := range config.Rules {
+		if r.Metric == "" {
+			return nil, errors.New("rate rule without metric")
+		}
+
+		if r.CounterBits != 0 && r.CounterBits != 32 && r.CounterBits != 64 {
+			return nil, fmt.Errorf("rate rule %s: counter bits must be 0, 32 or 64, got %d", r.Metric, r.CounterBits)
+		}
+
+		if _, ok := g.rules[r.Metric]; ok {
+			return nil, fmt.Errorf("duplicate rate rule for %s", r.Metric)
+		}
+
+		name := strings.TrimSuffix(r.Metric, "_total") + "_per_second"
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("rate rules %s and %s both produce %s", other, r.Metric, name)
+		}
+
+		names[name] = r.Metric
+
+		g.rules[r.Metric] = &rule{
+			Rule:   r,
+			name:   name,
+			series: map[string]*sample{},
+		}
+	}
+
+	return g, nil
+}
+
+// Increase returns the increase of a counter from previous to current. A counter of bits width
+// that decreases from the upper half of its range wrapped around; any other decrease is a reset,
+// after which the counter started from zero.
+func Increase(previous, current float64, bits int) float64 {
+	if current >= previous {
+		return current - previous
+	}
+
+	if bits > 0 {
+		limit := math.Ldexp(1, bits)
+		if previous < limit && previous >= limit/2 && current < limit/2 {
+			return limit - previous + current
+		}
+	}
+
+	return current
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *Gatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	families, err := g.gatherer.Gather()
+	now := g.now()
+
+	gathered := make(map[string]bool, len(families))
+	for _, mf := range families {
+		gathered[mf.GetName()] = true
+	}
+
+	rates := make([]*dto.MetricFamily, 0, len(g.rules))
+
+	for _, mf := range families {
+		r, ok := g.rules[mf.GetName()]
+		if !ok || (mf.GetType() != dto.MetricType_COUNTER && mf.GetType() != dto.MetricType_UNTYPED) {
+			continue
+		}
+
+		if gathered[r.name] {
+			if !r.conflict.Swap(true) {
+				g.logger.LogAttrs(context.Background(), slog.LevelWarn, "Rate has the name of a gathered metric and is not added",
+					slog.String("metric", r.name),
+				)
+			}
+
+			continue
+		}
+
+		if mf := r.rates(mf, now, g.config.MinInterval); len(mf.GetMetric()) > 0 {
+			rates = append(rates, mf)
+		}
+	}
+
+	if len(rates) == 0 {
+		return families, err
+	}
+
+	families = append(families, rates...)
+	slices.SortFunc(families, func(a, b *dto.MetricFamily) int {
+		return cmp.Compare(a.GetName(), b.GetName())
+	})
+
+	return families, err
+}
+
+// rates records the samples of mf and returns the family of the rates. Series that are not in
+// mf are forgotten.
+func (r *rule) rates(mf *dto.MetricFamily, now time.Time, minInterval time.Duration) *dto.MetricFamily {
+	result := &dto.MetricFamily{
+		Name: proto.String(r.name),
+		Help: proto.String(fmt.Sprintf("Per-second rate of %s between the last two samples.", r.Metric)),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+
+	seen := make(map[string]bool, len(mf.GetMetric()))
+
+	for _, m := range mf.GetMetric() {
+		value, _ := series.Value(mf.GetType(), m)
+
+		timestamp := now
+		if m.TimestampMs != nil {
+			timestamp = time.UnixMilli(m.GetTimestampMs())
+		}
+
+		key := series.Key(m)
+		seen[key] = true
+
+		s, ok := r.series[key]
+		if !ok {
+			r.series[key] = &sample{timestamp: timestamp, value: value}
+
+			continue
+		}
+
+		if elapsed := timestamp.Sub(s.timestamp); elapsed >= minInterval {
+			s.rate = Increase(s.value, value, r.CounterBits) / elapsed.Seconds()
+			s.valid = true
+			s.timestamp = timestamp
+			s.value = value
+		}
+
+		if s.valid {
+			result.Metric = append(result.Metric, &dto.Metric{
+				Label: m.GetLabel(),
+				Gauge: &dto.Gauge{Value: proto.Float64(s.rate)},
+			})
+		}
+	}
+
+	for key := range r.series {
+		if !seen[key] {
+			delete(r.series, key)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package rate
+
+import (
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrease(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		previous, current float64
+		bits              int
+		expected          float64
+	}{
+		{previous: 10, current: 25, expected: 15},
+		{previous: 10, current: 10, expected: 0},
+		// Resets start from zero.
+		{previous: 1000, current: 40, expected: 40},
+		{previous: math.MaxUint32 - 10, current: 20, expected: 20},
+		// Wraps continue from the end of the range.
+		{previous: math.MaxUint32 - 10, current: 20, bits: 32, expected: 31},
+		{previous: math.MaxUint64 / 4 * 3, current: 0, bits: 64, expected: math.MaxUint64 / 4},
+		// A decrease in the lower half of the range is a reset.
+		{previous: 1000, current: 40, bits: 32, expected: 40},
+		// A counter beyond 32 bits can't wrap at 32 bits.
+		{previous: math.MaxUint32 + 10, current: 20, bits: 32, expected: 20},
+	} {
+		require.InDelta(t, test.expected, Increase(test.previous, test.current, test.bits), 1e-6*test.expected,
+			"%v -> %v (%d bits)", test.previous, test.current, test.bits)
+	}
+}
+
+func TestGatherer(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	var received, interrupts float64
+
+	receivedDesc := prometheus.NewDesc("test_bytes_received_total", "A test counter", []string{"nic"}, nil)
+	interruptsDesc := prometheus.NewDesc("test_interrupts_total", "Another test counter", nil, nil)
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.MustNewConstMetric(receivedDesc, prometheus.CounterValue, received, "Ethernet")
+		ch <- prometheus.MustNewConstMetric(interruptsDesc, prometheus.CounterValue, interrupts)
+	}))
+
+	g, err := New(slog.New(slog.DiscardHandler), registry, Config{
+		Rules: []Rule{{Metric: "test_bytes_received_total", CounterBits: 32}, {Metric: "test_interrupts_total"}},
+	})
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	g.now = func() time.Time { return now }
+
+	// The first gather has no previous sample.
+	received, interrupts = math.MaxUint32-99, 1000
+
+	families, err := g.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 2)
+
+	// The byte counter wraps, the interrupt counter resets.
+	now = now.Add(10 * time.Second)
+	received, interrupts = 900, 300
+
+	expected := `# HELP test_bytes_received_per_second Per-second rate of test_bytes_received_total between the last two samples.
+# TYPE test_bytes_received_per_second gauge
+test_bytes_received_per_second{nic="Ethernet"} 100
+# HELP test_interrupts_per_second Per-second rate of test_interrupts_total between the last two samples.
+# TYPE test_interrupts_per_second gauge
+test_interrupts_per_second 30
+`
+
+	require.NoError(t, testutil.GatherAndCompare(g, strings.NewReader(expected), "test_bytes_received_per_second", "test_interrupts_per_second"))
+
+	// Gathers within the minimum interval repeat the previous rate.
+	now = now.Add(100 * time.Millisecond)
+	received, interrupts = 1000, 400
+
+	require.NoError(t, testutil.GatherAndCompare(g, strings.NewReader(expected), "test_bytes_received_per_second", "test_interrupts_per_second"))
+}
+
+func TestGathererConflict(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	countDesc := prometheus.NewDesc("test_requests_total", "A test counter", nil, nil)
+	rateDesc := prometheus.NewDesc("test_requests_per_second", "A gathered rate", nil, nil)
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.MustNewConstMetric(countDesc, prometheus.CounterValue, 10)
+		ch <- prometheus.MustNewConstMetric(rateDesc, prometheus.GaugeValue, 5)
+	}))
+
+	g, err := New(slog.New(slog.DiscardHandler), registry, Config{Rules: []Rule{{Metric: "test_requests_total"}}})
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	g.now = func() time.Time { return now }
+
+	expected := `# HELP test_requests_per_second A gathered rate
+# TYPE test_requests_per_second gauge
+test_requests_per_second 5
+`
+
+	for range 2 {
+		require.NoError(t, testutil.GatherAndCompare(g, strings.NewReader(expected), "test_requests_per_second"))
+
+		now = now.Add(10 * time.Second)
+	}
+
+	require.True(t, g.rules["test_requests_total"].conflict.Load())
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, config := range map[string]Config{
+		"metric":    {Rules: []Rule{{}}},
+		"bits":      {Rules: []Rule{{Metric: "a", CounterBits: 16}}},
+		"duplicate": {Rules: []Rule{{Metric: "a"}, {Metric: "a", CounterBits: 32}}},
+		"same rate": {Rules: []Rule{{Metric: "a_total"}, {Metric: "a"}}},
+	} {
+		_, err := New(slog.New(slog.DiscardHandler), prometheus.NewRegistry(), config)
+		require.Error(t, err, name)
+	}
+}
+
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(f, ch)
+}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
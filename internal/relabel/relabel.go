@@ -0,0 +1,473 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package relabel implements metric_relabel_configs with the semantics of Prometheus, so series can
+// be dropped, renamed or redacted before they leave the machine. The metric name is available as
+// the __name__ label.
+//
+// Spec: https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+package relabel
+
+import (
+	"crypto/md5" //nolint:gosec // hashmod is compatible with Prometheus, not a security feature
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Action is the action to be performed on relabeling.
+type Action string
+
+const (
+	// Replace performs a regex replacement.
+	Replace Action = "replace"
+	// Keep drops targets for which the input does not match the regex.
+	Keep Action = "keep"
+	// Drop drops targets for which the input does match the regex.
+	Drop Action = "drop"
+	// KeepEqual drops targets for which the input does not match the target.
+	KeepEqual Action = "keepequal"
+	// DropEqual drops targets for which the input does match the target.
+	DropEqual Action = "dropequal"
+	// HashMod sets a label to the modulus of a hash of labels.
+	HashMod Action = "hashmod"
+	// LabelMap copies labels to other labelnames based on a regex.
+	LabelMap Action = "labelmap"
+	// LabelDrop drops any label matching the regex.
+	LabelDrop Action = "labeldrop"
+	// LabelKeep drops any label not matching the regex.
+	LabelKeep Action = "labelkeep"
+	// Lowercase maps input letters to their lower case.
+	Lowercase Action = "lowercase"
+	// Uppercase maps input letters to their upper case.
+	Uppercase Action = "uppercase"
+
+	// MetricNameLabel is the label that holds the metric name.
+	MetricNameLabel = "__name__"
+
+	defaultSeparator   = ";"
+	defaultRegex       = "(.*)"
+	defaultReplacement = "$1"
+)
+
+//nolint:gochecknoglobals
+var (
+	labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	relabelTarget   = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+	varInTemplate   = regexp.MustCompile(`\$(?:\{\w+\}|\w+)`)
+	defaultRegexp   = MustNewRegexp(defaultRegex)
+)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *Action) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	switch act := Action(strings.ToLower(s)); act {
+	case Replace, Keep, Drop, HashMod, LabelMap, LabelDrop, LabelKeep, Lowercase, Uppercase, KeepEqual, DropEqual:
+		*a = act
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown relabel action %q", s)
+}
+
+// Regexp encapsulates a regexp.Regexp and makes it YAML marshalable. The regular expression is
+// anchored at both ends.
+type Regexp struct {
+	*regexp.Regexp
+
+	original string
+}
+
+// NewRegexp creates a new anchored Regexp and returns an error if the passed-in regular expression
+// does not compile.
+func NewRegexp(s string) (Regexp, error) {
+	re, err := regexp.Compile("^(?s:" + s + ")$")
+
+	return Regexp{Regexp: re, original: s}, err
+}
+
+// MustNewRegexp works like NewRegexp, but panics if the regular expression does not compile.
+func MustNewRegexp(s string) Regexp {
+	re, err := NewRegexp(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return re
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (re *Regexp) UnmarshalYAML(unmarshal func(any) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	r, err := NewRegexp(s)
+	if err != nil {
+		return err
+	}
+
+	*re = r
+
+	return nil
+}
+
+// String returns the original string used to compile the regular expression.
+func (re Regexp) String() string {
+	return re.original
+}
+
+// Config is the configuration for relabeling of target label sets.
+type Config struct {
+	// A list of labels from which values are taken and concatenated
+	// with the configured separator in order.
+	SourceLabels []string `yaml:"source_labels,flow"`
+	// Separator is the string between concatenated values from the source labels.
+	Separator string `yaml:"separator"`
+	// Regex against which the concatenation is matched.
+	Regex Regexp `yaml:"regex"`
+	// Modulus to take of the hash of concatenated values from the source labels.
+	Modulus uint64 `yaml:"modulus"`
+	// TargetLabel is the label to which the resulting string is written in a replacement.
+	// Regexp interpolation is allowed for the replace action.
+	TargetLabel string `yaml:"target_label"`
+	// Replacement is the regex replacement pattern to be used.
+	Replacement string `yaml:"replacement"`
+	// Action is the action to be performed for the relabeling.
+	Action Action `yaml:"action"`
+}
+
+// DefaultConfig returns a Config with the defaults of Prometheus.
+func DefaultConfig() Config {
+	return Config{
+		Action:      Replace,
+		Separator:   defaultSeparator,
+		Regex:       defaultRegexp,
+		Replacement: defaultReplacement,
+	}
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(any) error) error {
+	*c = DefaultConfig()
+
+	type plain Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	return c.Validate()
+}
+
+// Validate returns an error if the fields of the configuration don't fit its action.
+func (c *Config) Validate() error {
+	if c.Action == "" {
+		return errors.New("relabel action cannot be empty")
+	}
+
+	if c.Regex.Regexp == nil {
+		c.Regex = MustNewRegexp("")
+	}
+
+	for _, name := range c.SourceLabels {
+		if !labelNameRegexp.MatchString(name) {
+			return fmt.Errorf("%q is not a valid label name", name)
+		}
+	}
+
+	if c.Modulus == 0 && c.Action == HashMod {
+		return errors.New("relabel configuration for hashmod requires non-zero modulus")
+	}
+
+	switch c.Action {
+	case Replace, HashMod, Lowercase, Uppercase, KeepEqual, DropEqual:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+		}
+	}
+
+	switch c.Action {
+	case Replace:
+		if varInTemplate.MatchString(c.TargetLabel) {
+			if !relabelTarget.MatchString(c.TargetLabel) {
+				return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+			}
+		} else if !labelNameRegexp.MatchString(c.TargetLabel) {
+			return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+		}
+	case HashMod, Lowercase, Uppercase, KeepEqual, DropEqual:
+		if !labelNameRegexp.MatchString(c.TargetLabel) {
+			return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+		}
+	case LabelMap:
+		if !relabelTarget.MatchString(c.Replacement) {
+			return fmt.Errorf("%q is invalid 'replacement' for %s action", c.Replacement, c.Action)
+		}
+	}
+
+	switch c.Action {
+	case Lowercase, Uppercase:
+		if c.Replacement != defaultReplacement {
+			return fmt.Errorf("'replacement' can not be set for %s action", c.Action)
+		}
+	case KeepEqual, DropEqual:
+		if c.Regex.String() != defaultRegex || c.Modulus != 0 || c.Separator != defaultSeparator || c.Replacement != defaultReplacement {
+			return fmt.Errorf("%s action requires only 'source_labels' and `target_label`, and no other fields", c.Action)
+		}
+	case LabelDrop, LabelKeep:
+		if c.SourceLabels != nil || c.TargetLabel != "" || c.Modulus != 0 || c.Separator != defaultSeparator || c.Replacement != defaultReplacement {
+			return fmt.Errorf("%s action requires only 'regex', and no other fields", c.Action)
+		}
+	}
+
+	return nil
+}
+
+// Label is a name/value pair.
+type Label struct {
+	Name, Value string
+}
+
+// builder holds a label set sorted by name.
+type builder []Label
+
+func (b *builder) get(name string) string {
+	if i, ok := b.index(name); ok {
+		return (*b)[i].Value
+	}
+
+	return ""
+}
+
+func (b *builder) set(name, value string) {
+	if value == "" {
+		b.del(name)
+
+		return
+	}
+
+	i, ok := b.index(name)
+	if ok {
+		(*b)[i].Value = value
+
+		return
+	}
+
+	*b = slices.Insert(*b, i, Label{Name: name, Value: value})
+}
+
+func (b *builder) del(name string) {
+	if i, ok := b.index(name); ok {
+		*b = slices.Delete(*b, i, i+1)
+	}
+}
+
+func (b *builder) index(name string) (int, bool) {
+	return slices.BinarySearchFunc(*b, name, func(l Label, name string) int {
+		return strings.Compare(l.Name, name)
+	})
+}
+
+// Process applies the relabel configurations to a label set, which must be sorted by name.
+// It returns the resulting label set, and false if it was dropped.
+func Process(labels []Label, cfgs ...*Config) ([]Label, bool) {
+	b := builder(slices.Clone(labels))
+
+	for _, cfg := range cfgs {
+		if !relabel(&b, cfg) {
+			return nil, false
+		}
+	}
+
+	return b, true
+}
+
+func relabel(b *builder, cfg *Config) bool {
+	var val string
+
+	if len(cfg.SourceLabels) > 0 {
+		values := make([]string, 0, len(cfg.SourceLabels))
+		for _, name := range cfg.SourceLabels {
+			values = append(values, b.get(name))
+		}
+
+		val = strings.Join(values, cfg.Separator)
+	}
+
+	switch cfg.Action {
+	case Drop:
+		if cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Keep:
+		if !cfg.Regex.MatchString(val) {
+			return false
+		}
+	case DropEqual:
+		if b.get(cfg.TargetLabel) == val {
+			return false
+		}
+	case KeepEqual:
+		if b.get(cfg.TargetLabel) != val {
+			return false
+		}
+	case Replace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		// If there is no match no replacement must take place.
+		if indexes == nil {
+			break
+		}
+
+		target := string(cfg.Regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+		if !labelNameRegexp.MatchString(target) {
+			break
+		}
+
+		res := cfg.Regex.ExpandString(nil, cfg.Replacement, val, indexes)
+		if len(res) == 0 {
+			b.del(target)
+
+			break
+		}
+
+		b.set(target, string(res))
+	case Lowercase:
+		b.set(cfg.TargetLabel, strings.ToLower(val))
+	case Uppercase:
+		b.set(cfg.TargetLabel, strings.ToUpper(val))
+	case HashMod:
+		hash := md5.Sum([]byte(val)) //nolint:gosec
+		// Use only the last 8 bytes of the hash to give the same result as Prometheus.
+		mod := binary.BigEndian.Uint64(hash[8:]) % cfg.Modulus
+		b.set(cfg.TargetLabel, strconv.FormatUint(mod, 10))
+	case LabelMap:
+		for _, l := range slices.Clone(*b) {
+			if cfg.Regex.MatchString(l.Name) {
+				b.set(cfg.Regex.ReplaceAllString(l.Name, cfg.Replacement), l.Value)
+			}
+		}
+	case LabelDrop:
+		*b = slices.DeleteFunc(*b, func(l Label) bool {
+			return cfg.Regex.MatchString(l.Name)
+		})
+	case LabelKeep:
+		*b = slices.DeleteFunc(*b, func(l Label) bool {
+			return !cfg.Regex.MatchString(l.Name)
+		})
+	default:
+		panic(fmt.Errorf("relabel: unknown relabel action type %q", cfg.Action))
+	}
+
+	return true
+}
+
+// Families applies the relabel configurations to every series of the families. The metric name
+// is the __name__ label, so series can be renamed. Series without a valid name, and series that
+// are renamed to a family of another type, are dropped. The input families are not modified.
+func Families(families []*dto.MetricFamily, cfgs []*Config) []*dto.MetricFamily {
+	if len(cfgs) == 0 {
+		return families
+	}
+
+	var (
+		result []*dto.MetricFamily
+		byName = map[string]*dto.MetricFamily{}
+	)
+
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			labels := make([]Label, 0, len(m.GetLabel())+1)
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, Label{Name: lp.GetName(), Value: lp.GetValue()})
+			}
+
+			labels = append(labels, Label{Name: MetricNameLabel, Value: mf.GetName()})
+			slices.SortFunc(labels, func(a, b Label) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+
+			labels, keep := Process(labels, cfgs...)
+			if !keep {
+				continue
+			}
+
+			b := builder(labels)
+			name := b.get(MetricNameLabel)
+			b.del(MetricNameLabel)
+
+			if !labelNameRegexp.MatchString(strings.ReplaceAll(name, ":", "_")) {
+				continue
+			}
+
+			target, ok := byName[name]
+			if !ok {
+				target = &dto.MetricFamily{Name: proto.String(name), Help: mf.Help, Type: mf.Type, Unit: mf.Unit}
+				byName[name] = target
+				result = append(result, target)
+			} else if target.GetType() != mf.GetType() {
+				continue
+			}
+
+			target.Metric = append(target.Metric, withLabels(m, b))
+		}
+	}
+
+	return slices.DeleteFunc(result, func(mf *dto.MetricFamily) bool {
+		return len(mf.GetMetric()) == 0
+	})
+}
+
+// withLabels returns a copy of m with the labels. The values are shared with m.
+func withLabels(m *dto.Metric, labels []Label) *dto.Metric {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+	}
+
+	return &dto.Metric{
+		Label:       pairs,
+		Gauge:       m.Gauge,
+		Counter:     m.Counter,
+		Summary:     m.Summary,
+		Untyped:     m.Untyped,
+		Histogram:   m.Histogram,
+		TimestampMs: m.TimestampMs,
+	}
+}
+
+// Gatherer returns a prometheus.Gatherer that relabels the families of g.
+func Gatherer(g prometheus.Gatherer, cfgs []*Config) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+
+		return Families(families, cfgs), err
+	})
+}
@@ -0,0 +1,501 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package relabel
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func fromMap(m map[string]string) []Label {
+	labels := make([]Label, 0, len(m))
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		labels = append(labels, Label{Name: name, Value: m[name]})
+	}
+
+	return labels
+}
+
+// config returns a Config with the defaults, overridden by c.
+func config(c Config) *Config {
+	result := DefaultConfig()
+
+	if c.SourceLabels != nil {
+		result.SourceLabels = c.SourceLabels
+	}
+
+	if c.Separator != "" {
+		result.Separator = c.Separator
+	}
+
+	if c.Regex.Regexp != nil {
+		result.Regex = c.Regex
+	}
+
+	if c.TargetLabel != "" {
+		result.TargetLabel = c.TargetLabel
+	}
+
+	if c.Replacement != "" {
+		result.Replacement = c.Replacement
+	}
+
+	if c.Action != "" {
+		result.Action = c.Action
+	}
+
+	result.Modulus = c.Modulus
+
+	return &result
+}
+
+// The test cases are taken from the relabel package of Prometheus.
+func TestProcess(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input   map[string]string
+		relabel []Config
+		output  map[string]string
+		drop    bool
+	}{
+		{
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			relabel: []Config{{
+				SourceLabels: []string{"a"},
+				Regex:        MustNewRegexp("f(.*)"),
+				TargetLabel:  "d",
+				Separator:    ";",
+				Replacement:  "ch${1}",
+				Action:       Replace,
+			}},
+			output: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "choo"},
+		},
+		{
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			relabel: []Config{
+				{
+					SourceLabels: []string{"a"},
+					Regex:        MustNewRegexp("f(.*)"),
+					TargetLabel:  "d",
+					Separator:    ";",
+					Replacement:  "ch${1}-ch${1}",
+					Action:       Replace,
+				},
+				{
+					SourceLabels: []string{"a", "b"},
+					Regex:        MustNewRegexp("f(.*);(.*)r"),
+					TargetLabel:  "a",
+					Separator:    ";",
+					Replacement:  "b${1}${2}m", // boobam
+					Action:       Replace,
+				},
+				{
+					SourceLabels: []string{"d", "a"},
+					Regex:        MustNewRegexp("(.*);(.*)"),
+					TargetLabel:  "e",
+					Separator:    ";",
+					Replacement:  "${1}${2}", // choo-choo + boobam
+					Action:       Replace,
+				},
+			},
+			output: map[string]string{"a": "boobam", "b": "bar", "c": "baz", "d": "choo-choo", "e": "choo-chooboobam"},
+		},
+		{
+			input: map[string]string{"a": "foo"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp(".*o.*"), Action: Drop},
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("f(.*)"), TargetLabel: "d", Separator: ";", Replacement: "ch$1", Action: Replace},
+			},
+			drop: true,
+		},
+		{
+			input: map[string]string{"a": "foo", "b": "bar"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp(".*o.*"), Action: Drop},
+			},
+			drop: true,
+		},
+		{
+			input: map[string]string{"a": "abc"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp(".*(b).*"), TargetLabel: "d", Separator: ";", Replacement: "$1", Action: Replace},
+			},
+			output: map[string]string{"a": "abc", "d": "b"},
+		},
+		{
+			input: map[string]string{"a": "foo"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("no-match"), Action: Drop},
+			},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			input: map[string]string{"a": "foo"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("f|o"), Action: Drop},
+			},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			input: map[string]string{"a": "foo"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("no-match"), Action: Keep},
+			},
+			drop: true,
+		},
+		{
+			input: map[string]string{"a": "foo"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("f.*"), Action: Keep},
+			},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			// No replacement must be applied if there is no match.
+			input: map[string]string{"a": "boo"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("f"), TargetLabel: "b", Replacement: "bar", Action: Replace},
+			},
+			output: map[string]string{"a": "boo"},
+		},
+		{
+			// Blank replacement should delete the label.
+			input: map[string]string{"a": "foo", "f": "baz"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("(f).*"), TargetLabel: "$1", Replacement: "$2", Action: Replace},
+			},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			relabel: []Config{
+				{SourceLabels: []string{"c"}, TargetLabel: "d", Separator: ";", Action: HashMod, Modulus: 1000},
+			},
+			output: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "976"},
+		},
+		{
+			input: map[string]string{"a": "foo\nbar"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, TargetLabel: "b", Separator: ";", Action: HashMod, Modulus: 1000},
+			},
+			output: map[string]string{"a": "foo\nbar", "b": "734"},
+		},
+		{
+			input: map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			relabel: []Config{
+				{Regex: MustNewRegexp("(b.*)"), Replacement: "bar_${1}", Action: LabelMap},
+			},
+			output: map[string]string{"a": "foo", "b1": "bar", "b2": "baz", "bar_b1": "bar", "bar_b2": "baz"},
+		},
+		{
+			input: map[string]string{"a": "foo", "__meta_my_bar": "aaa", "__meta_my_baz": "bbb", "__meta_other": "ccc"},
+			relabel: []Config{
+				{Regex: MustNewRegexp("__meta_(my.*)"), Replacement: "${1}", Action: LabelMap},
+			},
+			output: map[string]string{"a": "foo", "__meta_my_bar": "aaa", "__meta_my_baz": "bbb", "__meta_other": "ccc", "my_bar": "aaa", "my_baz": "bbb"},
+		},
+		{
+			// valid case
+			input: map[string]string{"a": "some-name-value"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("some-([^-]+)-([^,]+)"), Action: Replace, Replacement: "${2}", TargetLabel: "${1}"},
+			},
+			output: map[string]string{"a": "some-name-value", "name": "value"},
+		},
+		{
+			// invalid replacement ""
+			input: map[string]string{"a": "some-name-value"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("some-([^-]+)-([^,]+)"), Action: Replace, Replacement: "${3}", TargetLabel: "${1}"},
+			},
+			output: map[string]string{"a": "some-name-value"},
+		},
+		{
+			// invalid target_labels
+			input: map[string]string{"a": "some-name-0"},
+			relabel: []Config{
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("some-([^-]+)-([^,]+)"), Action: Replace, Replacement: "${1}", TargetLabel: "${3}"},
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("some-([^-]+)-([^,]+)"), Action: Replace, Replacement: "${1}", TargetLabel: "${3}"},
+				{SourceLabels: []string{"a"}, Regex: MustNewRegexp("some-([^-]+)(-[^,]+)"), Action: Replace, Replacement: "${1}", TargetLabel: "${3}"},
+			},
+			output: map[string]string{"a": "some-name-0"},
+		},
+		{
+			// more complex real-life like usecase
+			input: map[string]string{"__meta_sd_tags": "path:/secret,job:some-job,label:foo=bar"},
+			relabel: []Config{
+				{SourceLabels: []string{"__meta_sd_tags"}, Regex: MustNewRegexp("(?:.+,|^)path:(/[^,]+).*"), Action: Replace, Replacement: "${1}", TargetLabel: "__metrics_path__"},
+				{SourceLabels: []string{"__meta_sd_tags"}, Regex: MustNewRegexp("(?:.+,|^)job:([^,]+).*"), Action: Replace, Replacement: "${1}", TargetLabel: "job"},
+				{SourceLabels: []string{"__meta_sd_tags"}, Regex: MustNewRegexp("(?:.+,|^)label:([^=]+)=([^,]+).*"), Action: Replace, Replacement: "${2}", TargetLabel: "${1}"},
+			},
+			output: map[string]string{
+				"__meta_sd_tags":   "path:/secret,job:some-job,label:foo=bar",
+				"__metrics_path__": "/secret",
+				"job":              "some-job",
+				"foo":              "bar",
+			},
+		},
+		{
+			input: map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			relabel: []Config{
+				{Regex: MustNewRegexp("(b.*)"), Action: LabelKeep},
+			},
+			output: map[string]string{"b1": "bar", "b2": "baz"},
+		},
+		{
+			input: map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			relabel: []Config{
+				{Regex: MustNewRegexp("(b.*)"), Action: LabelDrop},
+			},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			input: map[string]string{"foo": "bAr123Foo"},
+			relabel: []Config{
+				{SourceLabels: []string{"foo"}, Action: Uppercase, TargetLabel: "foo_uppercase"},
+				{SourceLabels: []string{"foo"}, Action: Lowercase, TargetLabel: "foo_lowercase"},
+			},
+			output: map[string]string{"foo": "bAr123Foo", "foo_lowercase": "bar123foo", "foo_uppercase": "BAR123FOO"},
+		},
+		{
+			input: map[string]string{"__tmp_port": "1234", "__port1": "1234", "__port2": "5678"},
+			relabel: []Config{
+				{SourceLabels: []string{"__tmp_port"}, Action: KeepEqual, TargetLabel: "__port1"},
+			},
+			output: map[string]string{"__tmp_port": "1234", "__port1": "1234", "__port2": "5678"},
+		},
+		{
+			input: map[string]string{"__tmp_port": "1234", "__port1": "1234", "__port2": "5678"},
+			relabel: []Config{
+				{SourceLabels: []string{"__tmp_port"}, Action: DropEqual, TargetLabel: "__port1"},
+			},
+			drop: true,
+		},
+		{
+			input: map[string]string{"__tmp_port": "1234", "__port1": "1234", "__port2": "5678"},
+			relabel: []Config{
+				{SourceLabels: []string{"__tmp_port"}, Action: DropEqual, TargetLabel: "__port2"},
+			},
+			output: map[string]string{"__tmp_port": "1234", "__port1": "1234", "__port2": "5678"},
+		},
+		{
+			input: map[string]string{"__tmp_port": "1234", "__port1": "1234", "__port2": "5678"},
+			relabel: []Config{
+				{SourceLabels: []string{"__tmp_port"}, Action: KeepEqual, TargetLabel: "__port2"},
+			},
+			drop: true,
+		},
+	}
+
+	for i, test := range tests {
+		cfgs := make([]*Config, 0, len(test.relabel))
+
+		for _, c := range test.relabel {
+			cfg := config(c)
+			require.NoError(t, cfg.Validate(), "test %d", i)
+
+			cfgs = append(cfgs, cfg)
+		}
+
+		input := fromMap(test.input)
+
+		result, keep := Process(input, cfgs...)
+		require.Equal(t, fromMap(test.input), input, "test %d modified its input", i)
+
+		if test.drop {
+			require.False(t, keep, "test %d", i)
+
+			continue
+		}
+
+		require.True(t, keep, "test %d", i)
+		require.Equal(t, fromMap(test.output), result, "test %d", i)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		config   string
+		expected string
+	}{
+		{
+			config:   `{action: hashmod, source_labels: [a], target_label: b}`,
+			expected: "relabel configuration for hashmod requires non-zero modulus",
+		},
+		{
+			config:   `{action: replace, source_labels: [a]}`,
+			expected: "relabel configuration for replace action requires 'target_label' value",
+		},
+		{
+			config:   `{action: lowercase, source_labels: [a]}`,
+			expected: "relabel configuration for lowercase action requires 'target_label' value",
+		},
+		{
+			config:   `{action: replace, source_labels: [a], target_label: 0foo}`,
+			expected: `"0foo" is invalid 'target_label' for replace action`,
+		},
+		{
+			config:   `{action: replace, source_labels: [a], target_label: "0${1}"}`,
+			expected: `"0${1}" is invalid 'target_label' for replace action`,
+		},
+		{
+			config:   `{action: uppercase, source_labels: [a], target_label: "${1}"}`,
+			expected: `"${1}" is invalid 'target_label' for uppercase action`,
+		},
+		{
+			config:   `{action: lowercase, source_labels: [a], target_label: b, replacement: c}`,
+			expected: "'replacement' can not be set for lowercase action",
+		},
+		{
+			config:   `{action: labelmap, replacement: "l-$1"}`,
+			expected: `"l-$1" is invalid 'replacement' for labelmap action`,
+		},
+		{
+			config:   `{action: labeldrop, source_labels: [a], regex: b}`,
+			expected: "labeldrop action requires only 'regex', and no other fields",
+		},
+		{
+			config:   `{action: keepequal, source_labels: [a], target_label: b, regex: c}`,
+			expected: "keepequal action requires only 'source_labels' and `target_label`, and no other fields",
+		},
+		{
+			config:   `{action: explode}`,
+			expected: `unknown relabel action "explode"`,
+		},
+		{
+			config:   `{source_labels: [a], regex: "(", target_label: b}`,
+			expected: "error parsing regexp",
+		},
+		{
+			config:   `{source_labels: [a-b], target_label: b}`,
+			expected: `"a-b" is not a valid label name`,
+		},
+	} {
+		var cfg Config
+
+		err := yaml.Unmarshal([]byte(test.config), &cfg)
+		require.ErrorContains(t, err, test.expected, test.config)
+	}
+}
+
+func TestUnmarshalYAML(t *testing.T) {
+	t.Parallel()
+
+	var cfgs []*Config
+
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- source_labels: [__name__]
+  regex: windows_cpu_.*
+  action: keep
+- target_label: site
+  replacement: lab
+- regex: "core"
+  action: LabelDrop
+`), &cfgs))
+
+	require.Len(t, cfgs, 3)
+	require.Equal(t, Keep, cfgs[0].Action)
+	require.Equal(t, ";", cfgs[0].Separator)
+	require.True(t, cfgs[0].Regex.MatchString("windows_cpu_time_total"))
+	require.False(t, cfgs[0].Regex.MatchString("x_windows_cpu_time_total"))
+	require.Equal(t, Replace, cfgs[1].Action)
+	require.Equal(t, "(.*)", cfgs[1].Regex.String())
+	require.Equal(t, "lab", cfgs[1].Replacement)
+	require.Equal(t, LabelDrop, cfgs[2].Action)
+}
+
+func TestGatherer(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	cpu := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_cpu_time_total", Help: "A test counter"}, []string{"core", "mode"})
+	renamed := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_processor_time_total", Help: "Another test counter"}, []string{"core", "mode"})
+	memory := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_Memory_bytes", Help: "A test gauge"})
+	registry.MustRegister(cpu, renamed, memory)
+
+	cpu.WithLabelValues("0,0", "idle").Add(1)
+	cpu.WithLabelValues("0,0", "user").Add(2)
+	cpu.WithLabelValues("0,1", "user").Add(3)
+	renamed.WithLabelValues("0,2", "user").Add(4)
+	memory.Set(5)
+
+	var cfgs []*Config
+
+	require.NoError(t, yaml.Unmarshal([]byte(`
+- source_labels: [mode]
+  regex: idle
+  action: drop
+- source_labels: [__name__]
+  regex: test_processor_(.*)
+  target_label: __name__
+  replacement: test_cpu_$1
+- source_labels: [core]
+  regex: (\d+),(\d+)
+  target_label: core
+  replacement: $2
+- source_labels: [__name__]
+  target_label: __name__
+  action: lowercase
+`), &cfgs))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	snapshot := make([]string, 0, len(families))
+	for _, mf := range families {
+		snapshot = append(snapshot, mf.String())
+	}
+
+	relabeled, err := Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	}), cfgs).Gather()
+	require.NoError(t, err)
+
+	for i, mf := range families {
+		require.Equal(t, snapshot[i], mf.String(), "relabeling modified the gathered families")
+	}
+
+	slices.SortFunc(relabeled, func(a, b *dto.MetricFamily) int {
+		return cmp.Compare(a.GetName(), b.GetName())
+	})
+
+	require.NoError(t, testutil.GatherAndCompare(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return relabeled, nil
+	}), strings.NewReader(`# HELP test_cpu_time_total A test counter
+# TYPE test_cpu_time_total counter
+test_cpu_time_total{core="0",mode="user"} 2
+test_cpu_time_total{core="1",mode="user"} 3
+test_cpu_time_total{core="2",mode="user"} 4
+# HELP test_memory_bytes A test gauge
+# TYPE test_memory_bytes gauge
+test_memory_bytes 5
+`)))
+}
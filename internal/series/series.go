@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package series provides helpers for the series of gathered metric families.
+package series
+
+import (
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Key identifies a series within its family. The labels of gathered metrics are sorted,
+// so equal label sets have equal keys.
+func Key(m *dto.Metric) string {
+	var b strings.Builder
+
+	for _, lp := range m.GetLabel() {
+		b.WriteString(lp.GetName())
+		b.WriteByte(0)
+		b.WriteString(lp.GetValue())
+		b.WriteByte(0)
+	}
+
+	return b.String()
+}
+
+// Value returns the value of a gauge, counter or untyped metric. It returns false for
+// histograms and summaries.
+func Value(metricType dto.MetricType, m *dto.Metric) (float64, bool) {
+	switch metricType {
+	case dto.MetricType_GAUGE:
+		return m.GetGauge().GetValue(), true
+	case dto.MetricType_COUNTER:
+		return m.GetCounter().GetValue(), true
+	case dto.MetricType_UNTYPED:
+		return m.GetUntyped().GetValue(), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,482 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package file writes snapshots to a rotating set of local files in the OpenMetrics text format,
+// so they can be inspected after the fact or backfilled with
+// "promtool tsdb create-blocks-from openmetrics".
+//
+// The active file always ends with "# EOF". Each snapshot is merged into it, with the timestamp of
+// the snapshot on every sample, so the samples of a family stay below its metadata. The samples are
+// appended to a segment file per family, and the active file is assembled from the segments and
+// replaced atomically. Once the active file reaches the maximum size, it is renamed after the
+// current time, and optionally compressed with gzip.
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultMaxSize is the default size at which the active file is rotated.
+	DefaultMaxSize = 10 * 1024 * 1024
+	// DefaultMaxFiles is the default number of rotated files that are kept.
+	DefaultMaxFiles = 10
+
+	eof = "# EOF\n"
+	// segmentsSuffix names the directory of the segments the active file is assembled from.
+	segmentsSuffix = ".segments"
+	// tmpSuffix names the file the active file is assembled in.
+	tmpSuffix = ".tmp"
+	// rotatedTimeFormat names rotated files. It sorts chronologically and is a valid Windows file name.
+	rotatedTimeFormat = "20060102T150405.000Z"
+	gzipExtension     = ".gz"
+)
+
+// Config configures a file Client.
+type Config struct {
+	// Path is the path of the active file, for example C:\ProgramData\windows_agent_collector\metrics.om.
+	Path string
+	// MaxSize is the size in bytes at which the active file is rotated. Defaults to DefaultMaxSize.
+	MaxSize int64
+	// MaxFiles is the number of rotated files that are kept. Defaults to DefaultMaxFiles.
+	MaxFiles int
+	// Compress compresses rotated files with gzip.
+	Compress bool
+}
+
+// Client writes snapshots to files.
+type Client struct {
+	config Config
+
+	mu sync.Mutex
+	// active holds the segments of the active file, nil until the first snapshot.
+	active *segments
+	// now returns the time rotated files are named after.
+	now func() time.Time
+}
+
+// New returns a new Client. The directory of the file is created if it does not exist.
+func New(config Config) (*Client, error) {
+	if config.Path == "" {
+		return nil, errors.New("file path is required")
+	}
+
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultMaxSize
+	}
+
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = DefaultMaxFiles
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create metrics file directory: %w", err)
+	}
+
+	return &Client{config: config, now: time.Now}, nil
+}
+
+// Send implements delivery.Sender. It adds the snapshot to the active file and rotates the file
+// if it reached the maximum size.
+func (c *Client) Send(_ context.Context, snapshot delivery.Snapshot) error {
+	families, err := encode(snapshot)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active == nil {
+		// The active file of a previous run is complete, as it is replaced atomically, but its
+		// samples can't be merged with new ones without parsing it, so it is rotated.
+		if info, err := os.Stat(c.config.Path); err == nil && info.Size() > 0 {
+			if err = c.rotate(); err != nil {
+				return err
+			}
+		}
+
+		if c.active, err = newSegments(c.config.Path + segmentsSuffix); err != nil {
+			return err
+		}
+	}
+
+	if !c.active.compatible(families) {
+		// A family changed its metadata, which can't be expressed in a single file.
+		if err = c.rotate(); err != nil {
+			return err
+		}
+
+		if err = c.active.reset(); err != nil {
+			return err
+		}
+	}
+
+	if err = c.active.add(families); err != nil {
+		return err
+	}
+
+	size, err := c.active.write(c.config.Path)
+	if err != nil {
+		return err
+	}
+
+	if size < c.config.MaxSize {
+		return nil
+	}
+
+	if err = c.rotate(); err != nil {
+		return err
+	}
+
+	return c.active.reset()
+}
+
+// rotate renames the active file after the current time, compresses it if configured and removes
+// the oldest rotated files.
+func (c *Client) rotate() error {
+	ext := filepath.Ext(c.config.Path)
+	prefix := strings.TrimSuffix(c.config.Path, ext) + "-"
+	rotated := prefix + c.now().UTC().Format(rotatedTimeFormat) + ext
+
+	if err := os.Rename(c.config.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate metrics file: %w", err)
+	}
+
+	if c.config.Compress {
+		if err := compress(rotated); err != nil {
+			return fmt.Errorf("failed to compress metrics file: %w", err)
+		}
+	}
+
+	matches, err := filepath.Glob(globEscape(prefix) + "*" + globEscape(ext) + "*")
+	if err != nil {
+		return fmt.Errorf("failed to list rotated metrics files: %w", err)
+	}
+
+	var files []string
+
+	for _, match := range matches {
+		name := strings.TrimSuffix(strings.TrimSuffix(match, gzipExtension), ext)
+		if _, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(name, prefix)); err == nil {
+			files = append(files, match)
+		}
+	}
+
+	slices.Sort(files)
+
+	var errs []error
+
+	for _, name := range files[:max(len(files)-c.config.MaxFiles, 0)] {
+		if err := os.Remove(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove rotated metrics files: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// compress replaces name by name.gz.
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = src.Close()
+	}()
+
+	dst, err := os.Create(name + gzipExtension)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(name + gzipExtension)
+
+		return err
+	}
+
+	_ = src.Close()
+
+	return os.Remove(name)
+}
+
+// globEscape escapes the meta characters of filepath.Match. Windows paths can't contain them,
+// apart from "[" and "]".
+func globEscape(s string) string {
+	return strings.NewReplacer("[", "[[]", "]", "[]]").Replace(s)
+}
+
+// family holds the encoded samples of a metric family in a snapshot.
+type family struct {
+	name string
+	// metadata are the HELP, TYPE and UNIT lines of the family.
+	metadata []byte
+	samples  []byte
+}
+
+// encode encodes the families of a snapshot in the OpenMetrics text format. Samples without a
+// timestamp get the timestamp of the snapshot.
+func encode(snapshot delivery.Snapshot) ([]*family, error) {
+	var families []*family
+
+	timestamp := proto.Int64(snapshot.Timestamp.UnixMilli())
+
+	for _, mf := range snapshot.Families {
+		// The families of a snapshot are shared, so the timestamps are set on a copy.
+		mf = proto.Clone(mf).(*dto.MetricFamily) //nolint:forcetypeassert
+
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs == nil {
+				m.TimestampMs = timestamp
+			}
+		}
+
+		if len(mf.GetMetric()) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+
+		if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, mf); err != nil {
+			return nil, fmt.Errorf("failed to encode metrics: %w", err)
+		}
+
+		metadata, samples := splitMetadata(buf.Bytes())
+		families = append(families, &family{name: mf.GetName(), metadata: metadata, samples: samples})
+	}
+
+	return families, nil
+}
+
+// splitMetadata splits an encoded family into its leading comment lines and its samples.
+func splitMetadata(b []byte) ([]byte, []byte) {
+	var n int
+
+	for bytes.HasPrefix(b[n:], []byte("# ")) {
+		i := bytes.IndexByte(b[n:], '\n')
+		if i < 0 {
+			break
+		}
+
+		n += i + 1
+	}
+
+	return b[:n], b[n:]
+}
+
+// segments are the families of the active file. OpenMetrics requires the metadata of a family to
+// appear once, followed by all of its samples, so the samples of each family are appended to a
+// segment file in dir, and the active file is assembled from the segments after every snapshot.
+// Only the metadata is kept in memory.
+type segments struct {
+	dir      string
+	families []*segment
+	index    map[string]*segment
+}
+
+type segment struct {
+	metadata []byte
+	path     string
+}
+
+// newSegments returns empty segments in dir. Segments of a previous run are removed.
+func newSegments(dir string) (*segments, error) {
+	s := &segments{dir: dir}
+
+	return s, s.reset()
+}
+
+// reset removes all segments.
+func (s *segments) reset() error {
+	s.families = nil
+	s.index = make(map[string]*segment)
+
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("failed to remove metrics file segments: %w", err)
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create metrics file segments: %w", err)
+	}
+
+	return nil
+}
+
+// compatible reports whether the families have the same metadata as those already in the file.
+func (s *segments) compatible(families []*family) bool {
+	for _, f := range families {
+		if existing, ok := s.index[f.name]; ok && !bytes.Equal(existing.metadata, f.metadata) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// add appends the samples of the families to their segments.
+func (s *segments) add(families []*family) error {
+	for _, f := range families {
+		seg, ok := s.index[f.name]
+		if !ok {
+			seg = &segment{
+				metadata: bytes.Clone(f.metadata),
+				path:     filepath.Join(s.dir, strconv.Itoa(len(s.families))),
+			}
+
+			s.index[f.name] = seg
+			s.families = append(s.families, seg)
+		}
+
+		if err := appendFile(seg.path, f.samples); err != nil {
+			return fmt.Errorf("failed to write metrics file segment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// write assembles the segments, followed by "# EOF", in a temporary file that replaces the file
+// at path once it is synced, so a crash never leaves a truncated file. It returns the size.
+func (s *segments) write(path string) (int64, error) {
+	tmp := path + tmpSuffix
+
+	size, err := s.writeFile(tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+
+		return 0, fmt.Errorf("failed to write metrics file: %w", err)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+
+		return 0, fmt.Errorf("failed to write metrics file: %w", err)
+	}
+
+	return size, nil
+}
+
+func (s *segments) writeFile(name string) (int64, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	w := bufio.NewWriter(f)
+
+	var size int64
+
+	for _, seg := range s.families {
+		n, err := w.Write(seg.metadata)
+		size += int64(n)
+
+		if err != nil {
+			return 0, err
+		}
+
+		written, err := copyFile(w, seg.path)
+		size += written
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.WriteString(eof)
+	size += int64(n)
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err == nil {
+		err = f.Close()
+	}
+
+	return size, err
+}
+
+func appendFile(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+func copyFile(w io.Writer, name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return io.Copy(w, f)
+}
@@ -0,0 +1,317 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package file
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func testSnapshot(t *testing.T, timestamp time.Time) delivery.Snapshot {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"})
+	gauge.Set(1.5)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_requests_total", Help: "A test counter"})
+	counter.Add(3)
+
+	registry.MustRegister(gauge, counter)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	snapshot.Timestamp = timestamp
+
+	return snapshot
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "metrics.om")
+
+	client, err := New(Config{Path: path})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Send(context.Background(), testSnapshot(t, time.UnixMilli(1700000000500))))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, `# HELP test_gauge A test gauge
+# TYPE test_gauge gauge
+test_gauge 1.5 1.7000000005e+09
+# HELP test_requests A test counter
+# TYPE test_requests counter
+test_requests_total 3.0 1.7000000005e+09
+# EOF
+`, string(b))
+}
+
+func TestSendAppend(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "metrics.om")
+
+	client, err := New(Config{Path: path})
+	require.NoError(t, err)
+
+	first := testSnapshot(t, time.UnixMilli(1700000000000))
+	second := testSnapshot(t, time.UnixMilli(1700000030000))
+
+	// The second snapshot has a new series and a new family.
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "test_duration_seconds",
+		Help:    "A test histogram",
+		Buckets: []float64{1},
+	}, []string{"core"})
+	histogram.WithLabelValues("0").Observe(0.5)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(histogram)
+
+	extra, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	second.Families = append(second.Families, extra.Families...)
+
+	require.NoError(t, client.Send(context.Background(), first))
+	require.NoError(t, client.Send(context.Background(), second))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, `# HELP test_gauge A test gauge
+# TYPE test_gauge gauge
+test_gauge 1.5 1.7e+09
+test_gauge 1.5 1.70000003e+09
+# HELP test_requests A test counter
+# TYPE test_requests counter
+test_requests_total 3.0 1.7e+09
+test_requests_total 3.0 1.70000003e+09
+# HELP test_duration_seconds A test histogram
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{core="0",le="1.0"} 1 1.70000003e+09
+test_duration_seconds_bucket{core="0",le="+Inf"} 1 1.70000003e+09
+test_duration_seconds_sum{core="0"} 0.5 1.70000003e+09
+test_duration_seconds_count{core="0"} 1 1.70000003e+09
+# EOF
+`, string(b))
+	requireOpenMetrics(t, b)
+}
+
+func TestSendExistingFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.om")
+
+	// The active file of a previous run is rotated instead of being merged with. The run was
+	// interrupted while it assembled the next file, which is discarded with its segments.
+	require.NoError(t, os.WriteFile(path, []byte("test_gauge 1.0 1.6e+09\n# EOF\n"), 0o600))
+	require.NoError(t, os.WriteFile(path+tmpSuffix, []byte("test_gauge 1.0 1.6e+09\ntest_ga"), 0o600))
+	require.NoError(t, os.MkdirAll(path+segmentsSuffix, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(path+segmentsSuffix, "0"), []byte("test_gauge 1.0 1.6e+09\n"), 0o600))
+
+	client, err := New(Config{Path: path})
+	require.NoError(t, err)
+
+	client.now = func() time.Time {
+		return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	require.NoError(t, client.Send(context.Background(), testSnapshot(t, time.UnixMilli(1700000000000))))
+
+	b, err := os.ReadFile(filepath.Join(dir, "metrics-20240102T030405.000Z.om"))
+	require.NoError(t, err)
+	require.Equal(t, "test_gauge 1.0 1.6e+09\n# EOF\n", string(b))
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "1.6e+09")
+	requireOpenMetrics(t, b)
+
+	_, err = os.Stat(path + tmpSuffix)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSendMetadataChanged(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.om")
+
+	client, err := New(Config{Path: path})
+	require.NoError(t, err)
+
+	client.now = func() time.Time {
+		return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	snapshot := testSnapshot(t, time.UnixMilli(1700000000000))
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	// The family keeps its name but changes its help, so the file is rotated first.
+	snapshot = testSnapshot(t, time.UnixMilli(1700000030000))
+	snapshot.Families[0].Help = proto.String("Another test gauge")
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	b, err := os.ReadFile(filepath.Join(dir, "metrics-20240102T030405.000Z.om"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "test_gauge 1.5 1.7e+09\n")
+	requireOpenMetrics(t, b)
+
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "# HELP test_gauge Another test gauge\n# TYPE test_gauge gauge\ntest_gauge 1.5 1.70000003e+09\n")
+	require.NotContains(t, string(b), "1.7e+09")
+	requireOpenMetrics(t, b)
+}
+
+// requireOpenMetrics checks the structure OpenMetrics parsers rely on: the file ends with a single
+// "# EOF", the metadata of every family appears once and before all of its samples, the samples of a
+// family are not interrupted by another family and the samples of a series have increasing timestamps.
+func requireOpenMetrics(t *testing.T, b []byte) {
+	t.Helper()
+
+	text, ok := strings.CutSuffix(string(b), "\n# EOF\n")
+	require.True(t, ok, "the file must end with # EOF")
+	require.NotContains(t, text, "# EOF")
+
+	var (
+		current   string
+		seen      = map[string]bool{}
+		metadata  = map[string]bool{}
+		timestamp = map[string]float64{}
+	)
+
+	for _, line := range strings.Split(text, "\n") {
+		if comment, ok := strings.CutPrefix(line, "# "); ok {
+			fields := strings.Fields(comment)
+			require.GreaterOrEqual(t, len(fields), 2, line)
+
+			if fields[1] != current {
+				require.False(t, seen[fields[1]], "family %s appears twice", fields[1])
+
+				current = fields[1]
+				seen[current] = true
+			}
+
+			require.False(t, metadata[fields[0]+" "+current], "duplicate %s", line)
+			metadata[fields[0]+" "+current] = true
+
+			continue
+		}
+
+		require.NotEmpty(t, current, "sample %q without metadata", line)
+
+		name := line[:strings.IndexAny(line, "{ ")]
+		require.True(t, strings.HasPrefix(name, current), "sample %q outside of family %s", line, current)
+
+		series := line[:strings.LastIndexByte(line[:strings.LastIndexByte(line, ' ')], ' ')]
+
+		ts, err := strconv.ParseFloat(line[strings.LastIndexByte(line, ' ')+1:], 64)
+		require.NoError(t, err)
+		require.Greater(t, ts, timestamp[series], "timestamps of %s are not increasing", series)
+
+		timestamp[series] = ts
+	}
+}
+
+func TestSendRotate(t *testing.T) {
+	t.Parallel()
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "metrics.om")
+
+		// Every snapshot exceeds the maximum size, so the file is rotated after each one.
+		client, err := New(Config{Path: path, MaxSize: 1, MaxFiles: 2, Compress: compress})
+		require.NoError(t, err)
+
+		now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		client.now = func() time.Time {
+			now = now.Add(time.Second)
+
+			return now
+		}
+
+		for i := range 4 {
+			require.NoError(t, client.Send(context.Background(), testSnapshot(t, time.UnixMilli(1700000000000+int64(i)*1000))))
+		}
+
+		// An unrelated file is not removed.
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "metrics-notes.om"), nil, 0o600))
+		require.NoError(t, client.Send(context.Background(), testSnapshot(t, time.UnixMilli(1700000004000))))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		suffix := ".om"
+		if compress {
+			suffix = ".om.gz"
+		}
+
+		require.Equal(t, []string{
+			"metrics-20240102T030409.000Z" + suffix,
+			"metrics-20240102T030410.000Z" + suffix,
+			"metrics-notes.om",
+			"metrics.om.segments",
+		}, names)
+
+		f, err := os.Open(filepath.Join(dir, names[1]))
+		require.NoError(t, err)
+
+		var r io.Reader = f
+		if compress {
+			r, err = gzip.NewReader(f)
+			require.NoError(t, err)
+		}
+
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		require.True(t, strings.HasSuffix(string(b), "test_requests_total 3.0 1.700000004e+09\n# EOF\n"), string(b))
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{})
+	require.Error(t, err)
+}
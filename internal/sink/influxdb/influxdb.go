@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package influxdb sends snapshots as InfluxDB line protocol, either to the InfluxDB v2 write API
+// or to a UDP listener, such as the socket_listener input of Telegraf.
+//
+// Spec: https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink"
+)
+
+const (
+	// DefaultBatchSize is the number of lines per write request recommended by InfluxDB.
+	DefaultBatchSize = 5000
+	// maxDatagramSize keeps UDP datagrams below the common Ethernet MTU, so they are not fragmented.
+	maxDatagramSize = 1400
+
+	contentType = "text/plain; charset=utf-8"
+	fieldKey    = "value"
+)
+
+// Config configures an InfluxDB Client.
+type Config struct {
+	// URL is the base URL of InfluxDB, for example http://influxdb:8086, or the address of a UDP
+	// listener, for example udp://telegraf:8094.
+	URL    string
+	Org    string
+	Bucket string
+	// Token and TokenFile authenticate with an InfluxDB API token. TokenFile is read for every write.
+	Token     string
+	TokenFile string
+	// BatchSize is the maximum number of lines per write request. Defaults to DefaultBatchSize.
+	BatchSize int
+	// Tags are added to every line that does not already have a tag of the same name.
+	Tags map[string]string
+}
+
+// Client sends snapshots as line protocol.
+type Client struct {
+	config Config
+	client delivery.Doer
+	// writeURL is the URL of the v2 write API. Empty for UDP.
+	writeURL string
+	// udpAddr is the address of the UDP listener. Empty for HTTP.
+	udpAddr string
+}
+
+// New returns a new Client. If client is nil, http.DefaultClient is used.
+// Responses with a non-2xx status code are returned as *delivery.StatusError.
+func New(config Config, client delivery.Doer) (*Client, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	c := &Client{config: config, client: delivery.NewStatusClient(client)}
+
+	switch u.Scheme {
+	case "udp":
+		if u.Port() == "" {
+			return nil, errors.New("invalid InfluxDB URL: UDP address requires a port")
+		}
+
+		c.udpAddr = u.Host
+	case "http", "https":
+		if config.Org == "" || config.Bucket == "" {
+			return nil, errors.New("InfluxDB write API requires an org and a bucket")
+		}
+
+		u = u.JoinPath("api", "v2", "write")
+		u.RawQuery = url.Values{
+			"org":       {config.Org},
+			"bucket":    {config.Bucket},
+			"precision": {"ns"},
+		}.Encode()
+
+		c.writeURL = u.String()
+	default:
+		return nil, fmt.Errorf("invalid InfluxDB URL: unsupported scheme %q", u.Scheme)
+	}
+
+	return c, nil
+}
+
+// Send implements delivery.Sender.
+func (c *Client) Send(ctx context.Context, snapshot delivery.Snapshot) error {
+	lines := Encode(snapshot, c.config.Tags)
+
+	if c.udpAddr != "" {
+		return c.sendUDP(ctx, lines)
+	}
+
+	for start := 0; start < len(lines); start += c.config.BatchSize {
+		if err := c.write(ctx, lines[start:min(start+c.config.BatchSize, len(lines))]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write sends a batch of lines to the v2 write API.
+func (c *Client) write(ctx context.Context, lines [][]byte) error {
+	body := bytes.Join(lines, []byte("\n"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create InfluxDB write request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	token := c.config.Token
+	if c.config.TokenFile != "" {
+		b, err := os.ReadFile(c.config.TokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read InfluxDB token file: %w", err)
+		}
+
+		token = strings.TrimSpace(string(b))
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// sendUDP sends the lines in datagrams of up to maxDatagramSize bytes. Longer lines are sent on their own.
+func (c *Client) sendUDP(ctx context.Context, lines [][]byte) error {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", c.udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to InfluxDB UDP listener: %w", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+	}
+
+	var datagram []byte
+
+	flush := func() error {
+		if len(datagram) == 0 {
+			return nil
+		}
+
+		_, err := conn.Write(datagram)
+		datagram = datagram[:0]
+
+		return err
+	}
+
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+len(line)+1 > maxDatagramSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+
+		datagram = append(datagram, line...)
+		datagram = append(datagram, '\n')
+	}
+
+	return flush()
+}
+
+// Encode encodes a snapshot as line protocol, one line per sample, without trailing newlines.
+//
+// The measurement is the sample name, the labels are tags and the value is the "value" field.
+// Timestamps have nanosecond precision. Samples with a NaN or infinite value can't be represented
+// and are skipped, as are labels with an empty value or a value ending with a backslash.
+func Encode(snapshot delivery.Snapshot, tags map[string]string) [][]byte {
+	extra := make([]sink.Label, 0, len(tags))
+	for name, value := range tags {
+		extra = append(extra, sink.Label{Name: name, Value: value})
+	}
+
+	samples := sink.Samples(snapshot)
+	lines := make([][]byte, 0, len(samples))
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+
+		line := []byte(measurementEscaper.Replace(sample.Name))
+
+		for _, l := range sink.WithLabels(sample.Labels, extra...) {
+			if l.Value == "" || strings.HasSuffix(l.Value, `\`) {
+				continue
+			}
+
+			line = append(line, ',')
+			line = append(line, tagEscaper.Replace(l.Name)...)
+			line = append(line, '=')
+			line = append(line, tagEscaper.Replace(l.Value)...)
+		}
+
+		line = append(line, ' ')
+		line = append(line, fieldKey...)
+		line = append(line, '=')
+		line = strconv.AppendFloat(line, sample.Value, 'g', -1, 64)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, sample.Timestamp.UnixNano(), 10)
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+//nolint:gochecknoglobals
+var (
+	// measurementEscaper escapes measurements. Line breaks can't be escaped, so they are written as "\n".
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	// tagEscaper escapes tag keys and values.
+	tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+)
@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package influxdb_test
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink/influxdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "windows_net_bytes", Help: "A test gauge"}, []string{"nic", "empty", "path"})
+	gauge.WithLabelValues("Intel(R) Ethernet, Port=1", "", `C:\`).Set(1.5)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "windows_cpu_time_total", Help: "A test counter"})
+	counter.Add(1e6)
+
+	nan := prometheus.NewGauge(prometheus.GaugeOpts{Name: "windows_nan", Help: "A NaN gauge"})
+	nan.Set(math.NaN())
+
+	registry.MustRegister(gauge, counter, nan)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	snapshot.Timestamp = time.Unix(1700000000, 0)
+
+	var lines []string
+	for _, line := range influxdb.Encode(snapshot, map[string]string{"agent_id": "agent 001", "nic": "other"}) {
+		lines = append(lines, string(line))
+	}
+
+	require.Equal(t, []string{
+		`windows_cpu_time_total,agent_id=agent\ 001,nic=other value=1e+06 1700000000000000000`,
+		`windows_net_bytes,agent_id=agent\ 001,nic=Intel(R)\ Ethernet\,\ Port\=1 value=1.5 1700000000000000000`,
+	}, lines)
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	var (
+		requests      []*http.Request
+		bodies        []string
+		authorization []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		authorization = append(authorization, r.Header.Get("Authorization"))
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600))
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"}, []string{"core"})
+	for _, core := range []string{"0", "1", "2"} {
+		gauge.WithLabelValues(core).Set(1)
+	}
+
+	registry.MustRegister(gauge)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	client, err := influxdb.New(influxdb.Config{
+		URL:       server.URL + "/influx",
+		Org:       "noc",
+		Bucket:    "windows",
+		TokenFile: tokenFile,
+		BatchSize: 2,
+	}, server.Client())
+	require.NoError(t, err)
+
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	// Three lines are sent in two batches.
+	require.Len(t, requests, 2)
+	require.Equal(t, "/influx/api/v2/write", requests[0].URL.Path)
+	require.Equal(t, "bucket=windows&org=noc&precision=ns", requests[0].URL.RawQuery)
+	require.Equal(t, []string{"Token s3cret", "Token s3cret"}, authorization)
+	require.Equal(t, 2, strings.Count(bodies[0], "\n")+1)
+	require.Equal(t, 1, strings.Count(bodies[1], "\n")+1)
+}
+
+func TestSendUDP(t *testing.T) {
+	t.Parallel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"}, []string{"label"})
+	for i := range 20 {
+		gauge.WithLabelValues(strings.Repeat("x", 100) + string(rune('a'+i))).Set(1)
+	}
+
+	registry.MustRegister(gauge)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	client, err := influxdb.New(influxdb.Config{URL: "udp://" + conn.LocalAddr().String()}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	// The lines are batched into datagrams that fit the MTU.
+	var (
+		lines     int
+		datagrams int
+		buf       = make([]byte, 65536)
+	)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	for lines < 20 {
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.LessOrEqual(t, n, 1400)
+
+		datagrams++
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+
+	require.Equal(t, 20, lines)
+	require.Greater(t, datagrams, 1)
+	require.Less(t, datagrams, 20)
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, config := range []influxdb.Config{
+		{URL: "tcp://influxdb:8086"},
+		{URL: "udp://telegraf"},
+		{URL: "http://influxdb:8086", Org: "noc"},
+	} {
+		_, err := influxdb.New(config, nil)
+		require.Error(t, err, config.URL)
+	}
+}
@@ -0,0 +1,667 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package mqtt publishes snapshots to an MQTT broker, and the status of the agent to a retained topic
+// that the broker sets to "offline" through the last will if the agent disappears.
+//
+// Spec: https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// FormatJSON publishes the samples of a snapshot as a JSON document.
+	FormatJSON = "json"
+	// FormatText publishes a snapshot in the Prometheus text format.
+	FormatText = "text"
+
+	// DefaultTopic and DefaultStatusTopic are the default topic templates.
+	DefaultTopic       = "agents/{agent_id}/metrics"
+	DefaultStatusTopic = "agents/{agent_id}/status"
+	// DefaultKeepAlive is the default interval of keep alive pings.
+	DefaultKeepAlive = time.Minute
+	// DefaultPingTimeout is the default time to wait for the response to a keep alive ping.
+	DefaultPingTimeout = 10 * time.Second
+
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// Config configures an MQTT Client.
+type Config struct {
+	// URL is the address of the broker, for example mqtt://broker:1883 or mqtts://broker:8883.
+	URL      string
+	ClientID string
+	Username string
+	Password string
+	// Topic and StatusTopic are templates, in which {name} is replaced by the value of the label name.
+	// The status topic is not used if it is empty.
+	Topic       string
+	StatusTopic string
+	// Format is FormatJSON or FormatText.
+	Format string
+	QoS    byte
+	// KeepAlive is the interval of keep alive pings. The broker publishes the last will if it
+	// does not hear from the client for one and a half times this interval.
+	KeepAlive time.Duration
+	// PingTimeout is the time to wait for the response to a keep alive ping. Without a response, the
+	// connection is considered lost, for example after the broker went away without closing it.
+	PingTimeout time.Duration
+	// TLS is used for mqtts:// URLs.
+	TLS *tls.Config
+	// Labels are added to every sample that does not already have a label of the same name,
+	// and are available to the topic templates.
+	Labels map[string]string
+}
+
+// Client publishes snapshots to an MQTT broker. The connection is opened by the first Send,
+// and opened again by the next Send if it was lost.
+type Client struct {
+	config      Config
+	addr        string
+	useTLS      bool
+	topic       string
+	statusTopic string
+
+	// mu serializes publishes and guards conn and lastID.
+	mu     sync.Mutex
+	conn   *conn
+	lastID uint16
+}
+
+// New returns a new Client.
+func New(config Config) (*Client, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT URL: %w", err)
+	}
+
+	c := &Client{config: config, addr: u.Host}
+
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "mqtts", "ssl", "tls":
+		if u.Port() == "" {
+			c.addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+
+		c.useTLS = true
+	default:
+		return nil, fmt.Errorf("invalid MQTT URL: unsupported scheme %q", u.Scheme)
+	}
+
+	switch {
+	case config.Format != FormatJSON && config.Format != FormatText:
+		return nil, fmt.Errorf("unknown MQTT payload format %q", config.Format)
+	case config.QoS > 2:
+		return nil, fmt.Errorf("invalid MQTT QoS %d", config.QoS)
+	case config.ClientID == "" || len(config.ClientID) > math.MaxUint16:
+		return nil, errors.New("invalid MQTT client ID")
+	case config.Password != "" && config.Username == "":
+		return nil, errors.New("MQTT password requires a user name")
+	}
+
+	if c.config.KeepAlive <= 0 {
+		c.config.KeepAlive = DefaultKeepAlive
+	}
+
+	if c.config.PingTimeout <= 0 {
+		c.config.PingTimeout = DefaultPingTimeout
+	}
+
+	if c.topic, err = expandTopic(config.Topic, config.Labels); err != nil {
+		return nil, err
+	}
+
+	if config.StatusTopic != "" {
+		if c.statusTopic, err = expandTopic(config.StatusTopic, config.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Send implements delivery.Sender. It publishes the snapshot to the topic, not retained.
+func (c *Client) Send(ctx context.Context, snapshot delivery.Snapshot) error {
+	payload, err := Encode(snapshot, c.config.Format, c.config.Labels)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = c.publish(ctx, conn, c.topic, payload, false); err != nil {
+		conn.close(err)
+		c.conn = nil
+
+		return err
+	}
+
+	return nil
+}
+
+// Close publishes the offline status and disconnects from the broker. A clean disconnect
+// discards the last will, so the offline status is published explicitly.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	conn := c.conn
+	c.conn = nil
+
+	var err error
+	if c.statusTopic != "" {
+		err = c.publish(ctx, conn, c.statusTopic, []byte(statusOffline), true)
+	}
+
+	if err == nil {
+		err = conn.write(ctx, encodePacket(packetDisconnect, 0, nil))
+	}
+
+	conn.close(errors.New("client closed"))
+
+	return err
+}
+
+// connect returns the current connection, or opens a new one and publishes the online status.
+func (c *Client) connect(ctx context.Context) (*conn, error) {
+	if c.conn != nil {
+		select {
+		case <-c.conn.done:
+			c.conn = nil
+		default:
+			return c.conn, nil
+		}
+	}
+
+	var (
+		netConn net.Conn
+		err     error
+	)
+
+	if c.useTLS {
+		dialer := &tls.Dialer{Config: c.config.TLS}
+		netConn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	} else {
+		var dialer net.Dialer
+		netConn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	connect := connectPacket{
+		clientID:  c.config.ClientID,
+		username:  c.config.Username,
+		password:  c.config.Password,
+		keepAlive: uint16(min(c.config.KeepAlive/time.Second, math.MaxUint16)), //nolint:gosec // bounded by min
+	}
+
+	if c.statusTopic != "" {
+		connect.willTopic = c.statusTopic
+		connect.willMessage = []byte(statusOffline)
+		connect.willQoS = c.config.QoS
+		connect.willRetain = true
+	}
+
+	conn, err := handshake(ctx, netConn, connect)
+	if err != nil {
+		_ = netConn.Close()
+
+		return nil, err
+	}
+
+	go conn.keepAlive(c.config.KeepAlive, c.config.PingTimeout)
+
+	if c.statusTopic != "" {
+		if err = c.publish(ctx, conn, c.statusTopic, []byte(statusOnline), true); err != nil {
+			conn.close(err)
+
+			return nil, err
+		}
+	}
+
+	c.conn = conn
+
+	return conn, nil
+}
+
+// publish publishes a message and waits for the acknowledgement of the QoS level.
+func (c *Client) publish(ctx context.Context, conn *conn, topic string, payload []byte, retain bool) error {
+	qos := c.config.QoS
+	if qos == 0 {
+		return conn.write(ctx, encodePublish(topic, payload, 0, retain, 0))
+	}
+
+	// Packet identifiers must not be 0.
+	c.lastID++
+	if c.lastID == 0 {
+		c.lastID = 1
+	}
+
+	id := c.lastID
+
+	acks := conn.expect(id)
+	defer conn.forget(id)
+
+	if err := conn.write(ctx, encodePublish(topic, payload, qos, retain, id)); err != nil {
+		return err
+	}
+
+	if qos == 1 {
+		return conn.wait(ctx, acks, packetPubAck)
+	}
+
+	if err := conn.wait(ctx, acks, packetPubRec); err != nil {
+		return err
+	}
+
+	if err := conn.write(ctx, encodeAck(packetPubRel, 0x02, id)); err != nil {
+		return err
+	}
+
+	return conn.wait(ctx, acks, packetPubComp)
+}
+
+// conn is an established connection to the broker.
+type conn struct {
+	netConn net.Conn
+
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	acks map[uint16]chan packet
+	err  error
+	// done is closed when the connection is closed, err holds the reason.
+	done chan struct{}
+	// pingResp receives the responses to keep alive pings.
+	pingResp chan struct{}
+}
+
+// handshake sends the CONNECT packet, waits for the CONNACK packet and starts reading
+// from the connection.
+func handshake(ctx context.Context, netConn net.Conn, connect connectPacket) (*conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+
+	if _, err := netConn.Write(connect.encode()); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	reader := bufio.NewReader(netConn)
+
+	connAck, err := readPacket(reader, maxBrokerPacketSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	if connAck.kind != packetConnAck || len(connAck.body) != 2 {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: unexpected packet type %d", connAck.kind)
+	}
+
+	if code := connAck.body[1]; code != 0 {
+		return nil, &ConnectError{ReturnCode: code}
+	}
+
+	_ = netConn.SetDeadline(time.Time{})
+
+	c := &conn{
+		netConn:  netConn,
+		acks:     make(map[uint16]chan packet),
+		done:     make(chan struct{}),
+		pingResp: make(chan struct{}, 1),
+	}
+
+	go c.read(reader)
+
+	return c, nil
+}
+
+// read dispatches acknowledgements until the connection is closed.
+func (c *conn) read(reader *bufio.Reader) {
+	for {
+		p, err := readPacket(reader, maxBrokerPacketSize)
+		if err != nil {
+			c.close(&connectionLostError{err: err})
+
+			return
+		}
+
+		switch p.kind {
+		case packetPubAck, packetPubRec, packetPubComp:
+			c.mu.Lock()
+			acks, ok := c.acks[p.packetID()]
+			c.mu.Unlock()
+
+			// Duplicate acknowledgements must not block the reader.
+			if ok {
+				select {
+				case acks <- p:
+				default:
+				}
+			}
+		case packetPingResp:
+			select {
+			case c.pingResp <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// keepAlive sends a ping every interval until the connection is closed. The connection is closed
+// if the broker does not respond within timeout, so a half-open connection does not silently drop
+// publishes with QoS 0.
+func (c *conn) keepAlive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		// Discard a late response to the previous ping.
+		select {
+		case <-c.pingResp:
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := c.write(ctx, encodePacket(packetPingReq, 0, nil))
+
+		cancel()
+
+		if err != nil {
+			c.close(err)
+
+			return
+		}
+
+		timer := time.NewTimer(timeout)
+
+		select {
+		case <-c.done:
+			timer.Stop()
+
+			return
+		case <-c.pingResp:
+			timer.Stop()
+		case <-timer.C:
+			c.close(&connectionLostError{err: errPingTimeout})
+
+			return
+		}
+	}
+}
+
+func (c *conn) write(ctx context.Context, b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	_ = c.netConn.SetWriteDeadline(deadline)
+
+	if _, err := c.netConn.Write(b); err != nil {
+		return &connectionLostError{err: err}
+	}
+
+	return nil
+}
+
+// expect registers a channel for the acknowledgements of a packet identifier.
+func (c *conn) expect(id uint16) chan packet {
+	acks := make(chan packet, 2)
+
+	c.mu.Lock()
+	c.acks[id] = acks
+	c.mu.Unlock()
+
+	return acks
+}
+
+func (c *conn) forget(id uint16) {
+	c.mu.Lock()
+	delete(c.acks, id)
+	c.mu.Unlock()
+}
+
+// wait waits for the acknowledgement of the given kind. A repeated PUBREC while waiting for the
+// PUBCOMP is a duplicate of the acknowledgement that was already answered and is skipped.
+func (c *conn) wait(ctx context.Context, acks chan packet, kind byte) error {
+	for {
+		select {
+		case p := <-acks:
+			if p.kind == packetPubRec && kind == packetPubComp {
+				continue
+			}
+
+			if p.kind != kind {
+				return fmt.Errorf("unexpected MQTT packet type %d, expected %d", p.kind, kind)
+			}
+
+			return nil
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *conn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	c.err = err
+	close(c.done)
+
+	_ = c.netConn.Close()
+}
+
+// connectionLostError is returned if the connection to the broker is lost. The next attempt
+// opens a new connection, so it is retryable.
+type connectionLostError struct {
+	err error
+}
+
+func (e *connectionLostError) Error() string {
+	return "connection to MQTT broker lost: " + e.err.Error()
+}
+
+func (e *connectionLostError) Unwrap() error {
+	return e.err
+}
+
+func (e *connectionLostError) Retryable() bool {
+	return true
+}
+
+//nolint:gochecknoglobals
+var (
+	placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+	errPingTimeout = errors.New("no response to keep alive ping")
+)
+
+// expandTopic replaces the {name} placeholders of a topic template by the value of the label name.
+func expandTopic(template string, labels map[string]string) (string, error) {
+	var err error
+
+	topic := placeholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+
+		value, ok := labels[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("MQTT topic %q: unknown label %q", template, name)
+		}
+
+		return value
+	})
+
+	switch {
+	case err != nil:
+		return "", err
+	case topic == "" || len(topic) > math.MaxUint16:
+		return "", fmt.Errorf("MQTT topic %q: invalid length", template)
+	case strings.ContainsAny(topic, "+#\x00"):
+		return "", fmt.Errorf("MQTT topic %q: %q must not contain wildcards", template, topic)
+	}
+
+	return topic, nil
+}
+
+// jsonPayload is the payload of the json format.
+type jsonPayload struct {
+	// Timestamp is the time of the snapshot in milliseconds since the epoch.
+	Timestamp int64        `json:"timestamp"`
+	Samples   []jsonSample `json:"samples"`
+}
+
+type jsonSample struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// Encode encodes a snapshot as a message payload in the given format, with labels added to every sample.
+//
+// The json format holds one entry per sample, with histograms and summaries expanded into their
+// series. JSON can't represent NaN and infinite values, so these samples are skipped.
+func Encode(snapshot delivery.Snapshot, format string, labels map[string]string) ([]byte, error) {
+	extra := make([]sink.Label, 0, len(labels))
+	for name, value := range labels {
+		extra = append(extra, sink.Label{Name: name, Value: value})
+	}
+
+	if format == FormatText {
+		var buf bytes.Buffer
+
+		encoder := expfmt.NewEncoder(&buf, expfmt.NewFormat(expfmt.TypeTextPlain))
+
+		for _, mf := range snapshot.Families {
+			if err := encoder.Encode(withLabels(mf, extra)); err != nil {
+				return nil, fmt.Errorf("failed to encode MQTT payload: %w", err)
+			}
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	payload := jsonPayload{
+		Timestamp: snapshot.Timestamp.UnixMilli(),
+		Samples:   []jsonSample{},
+	}
+
+	for _, sample := range sink.Samples(snapshot) {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+
+		sampleLabels := make(map[string]string)
+		for _, l := range sink.WithLabels(sample.Labels, extra...) {
+			sampleLabels[l.Name] = l.Value
+		}
+
+		payload.Samples = append(payload.Samples, jsonSample{
+			Name:      sample.Name,
+			Type:      strings.ToLower(sample.Type.String()),
+			Labels:    sampleLabels,
+			Value:     sample.Value,
+			Timestamp: sample.Timestamp.UnixMilli(),
+		})
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode MQTT payload: %w", err)
+	}
+
+	return b, nil
+}
+
+// withLabels returns a copy of mf with the extra labels added to every metric that does not
+// already have them. The families of a snapshot are shared, so they are not modified.
+func withLabels(mf *dto.MetricFamily, extra []sink.Label) *dto.MetricFamily {
+	if len(extra) == 0 {
+		return mf
+	}
+
+	mf = proto.Clone(mf).(*dto.MetricFamily) //nolint:forcetypeassert
+
+	for _, m := range mf.GetMetric() {
+		for _, l := range extra {
+			if !slices.ContainsFunc(m.GetLabel(), func(lp *dto.LabelPair) bool { return lp.GetName() == l.Name }) {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(l.Name), Value: proto.String(l.Value)})
+			}
+		}
+
+		slices.SortFunc(m.Label, func(a, b *dto.LabelPair) int {
+			return strings.Compare(a.GetName(), b.GetName())
+		})
+	}
+
+	return mf
+}
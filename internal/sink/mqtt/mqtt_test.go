@@ -0,0 +1,477 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// message is a message received by the broker.
+type message struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+}
+
+// broker is a minimal MQTT broker that records the connects and messages of its clients.
+type broker struct {
+	listener net.Listener
+	// returnCode is sent in the CONNACK packet.
+	returnCode byte
+
+	mu sync.Mutex
+	// closeAfterPublish closes the connection instead of acknowledging messages that are not a status.
+	closeAfterPublish bool
+	// ignorePings does not respond to keep alive pings, like a broker behind a half-open connection.
+	ignorePings bool
+	// duplicateAcks sends every acknowledgement three times.
+	duplicateAcks bool
+	connects      []connectPacket
+	messages      []message
+	disconnects   int
+}
+
+func newBroker(t *testing.T) *broker {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	b := &broker{listener: listener}
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go b.serve(c)
+		}
+	}()
+
+	return b
+}
+
+func (b *broker) url() string {
+	return "mqtt://" + b.listener.Addr().String()
+}
+
+func (b *broker) serve(c net.Conn) {
+	defer func() {
+		_ = c.Close()
+	}()
+
+	reader := bufio.NewReader(c)
+
+	for {
+		p, err := readPacket(reader, math.MaxInt32)
+		if err != nil {
+			return
+		}
+
+		switch p.kind {
+		case packetConnect:
+			b.mu.Lock()
+			b.connects = append(b.connects, parseConnect(p.body))
+			b.mu.Unlock()
+
+			_, _ = c.Write(encodePacket(packetConnAck, 0, []byte{0, b.returnCode}))
+		case packetPublish:
+			qos := p.flags >> 1 & 0x03
+			topicLength := int(binary.BigEndian.Uint16(p.body))
+			m := message{topic: string(p.body[2 : 2+topicLength]), qos: qos, retain: p.flags&0x01 != 0}
+
+			rest := p.body[2+topicLength:]
+
+			var id uint16
+			if qos > 0 {
+				id = binary.BigEndian.Uint16(rest)
+				rest = rest[2:]
+			}
+
+			m.payload = string(rest)
+
+			b.mu.Lock()
+			b.messages = append(b.messages, m)
+			closeConn := b.closeAfterPublish && !strings.HasSuffix(m.topic, "/status")
+			b.mu.Unlock()
+
+			if closeConn {
+				return
+			}
+
+			switch qos {
+			case 1:
+				b.ack(c, encodeAck(packetPubAck, 0, id))
+			case 2:
+				b.ack(c, encodeAck(packetPubRec, 0, id))
+			}
+		case packetPubRel:
+			b.ack(c, encodeAck(packetPubComp, 0, p.packetID()))
+		case packetPingReq:
+			b.mu.Lock()
+			ignore := b.ignorePings
+			b.mu.Unlock()
+
+			if !ignore {
+				_, _ = c.Write(encodePacket(packetPingResp, 0, nil))
+			}
+		case packetDisconnect:
+			b.mu.Lock()
+			b.disconnects++
+			b.mu.Unlock()
+
+			return
+		}
+	}
+}
+
+func (b *broker) ack(c net.Conn, ack []byte) {
+	b.mu.Lock()
+	count := 1
+	if b.duplicateAcks {
+		count = 3
+	}
+	b.mu.Unlock()
+
+	for range count {
+		_, _ = c.Write(ack)
+	}
+}
+
+func (b *broker) state() ([]connectPacket, []message, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]connectPacket(nil), b.connects...), append([]message(nil), b.messages...), b.disconnects
+}
+
+// parseConnect decodes the body of a CONNECT packet.
+func parseConnect(body []byte) connectPacket {
+	next := func() []byte {
+		length := int(binary.BigEndian.Uint16(body))
+		field := body[2 : 2+length]
+		body = body[2+length:]
+
+		return field
+	}
+
+	next() // protocol name
+
+	flags := body[1]
+	c := connectPacket{keepAlive: binary.BigEndian.Uint16(body[2:])}
+	body = body[4:]
+
+	c.clientID = string(next())
+
+	if flags&connectWill != 0 {
+		c.willTopic = string(next())
+		c.willMessage = next()
+		c.willQoS = flags >> 3 & 0x03
+		c.willRetain = flags&connectWillRetain != 0
+	}
+
+	if flags&connectUsername != 0 {
+		c.username = string(next())
+	}
+
+	if flags&connectPassword != 0 {
+		c.password = string(next())
+	}
+
+	return c
+}
+
+func testSnapshot(t *testing.T) delivery.Snapshot {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"}, []string{"core"})
+	gauge.WithLabelValues("0").Set(1.5)
+
+	registry.MustRegister(gauge)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	snapshot.Timestamp = time.UnixMilli(1700000000000)
+
+	return snapshot
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	for _, qos := range []byte{0, 1, 2} {
+		t.Run(fmt.Sprintf("qos %d", qos), func(t *testing.T) {
+			t.Parallel()
+
+			b := newBroker(t)
+
+			client, err := New(Config{
+				URL:         b.url(),
+				ClientID:    "windows_agent_collector_agent_001",
+				Username:    "agent",
+				Password:    "secret",
+				Topic:       DefaultTopic,
+				StatusTopic: DefaultStatusTopic,
+				Format:      FormatJSON,
+				QoS:         qos,
+				KeepAlive:   30 * time.Second,
+				Labels:      map[string]string{"agent_id": "agent_001", "job": "windows"},
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, client.Send(context.Background(), testSnapshot(t)))
+			require.NoError(t, client.Send(context.Background(), testSnapshot(t)))
+			require.NoError(t, client.Close(context.Background()))
+
+			require.Eventually(t, func() bool {
+				_, _, disconnects := b.state()
+
+				return disconnects == 1
+			}, 5*time.Second, 10*time.Millisecond)
+
+			connects, messages, _ := b.state()
+
+			require.Equal(t, []connectPacket{{
+				clientID:    "windows_agent_collector_agent_001",
+				username:    "agent",
+				password:    "secret",
+				keepAlive:   30,
+				willTopic:   "agents/agent_001/status",
+				willMessage: []byte("offline"),
+				willQoS:     qos,
+				willRetain:  true,
+			}}, connects)
+
+			payload := `{"timestamp":1700000000000,"samples":[{"name":"test_gauge","type":"gauge","labels":{"agent_id":"agent_001","core":"0","job":"windows"},"value":1.5,"timestamp":1700000000000}]}`
+
+			require.Equal(t, []message{
+				{topic: "agents/agent_001/status", payload: "online", qos: qos, retain: true},
+				{topic: "agents/agent_001/metrics", payload: payload, qos: qos},
+				{topic: "agents/agent_001/metrics", payload: payload, qos: qos},
+				{topic: "agents/agent_001/status", payload: "offline", qos: qos, retain: true},
+			}, messages)
+		})
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	t.Parallel()
+
+	b := newBroker(t)
+	b.closeAfterPublish = true
+
+	client, err := New(Config{
+		URL:      b.url(),
+		ClientID: "agent",
+		Topic:    "agents/{agent_id}/metrics",
+		Format:   FormatText,
+		QoS:      1,
+		Labels:   map[string]string{"agent_id": "agent_001"},
+	})
+	require.NoError(t, err)
+
+	// The broker closes the connection before the acknowledgement.
+	err = client.Send(context.Background(), testSnapshot(t))
+	require.Error(t, err)
+	require.True(t, delivery.IsRetryable(err), err)
+
+	b.mu.Lock()
+	b.closeAfterPublish = false
+	b.mu.Unlock()
+
+	require.NoError(t, client.Send(context.Background(), testSnapshot(t)))
+
+	connects, messages, _ := b.state()
+	require.Len(t, connects, 2)
+	require.Len(t, messages, 2)
+	require.Equal(t, `# HELP test_gauge A test gauge
+# TYPE test_gauge gauge
+test_gauge{agent_id="agent_001",core="0"} 1.5
+`, messages[1].payload)
+}
+
+func TestClientPingTimeout(t *testing.T) {
+	t.Parallel()
+
+	b := newBroker(t)
+	b.ignorePings = true
+	b.duplicateAcks = true
+
+	client, err := New(Config{
+		URL:         b.url(),
+		ClientID:    "agent",
+		Topic:       "agents/agent_001/metrics",
+		Format:      FormatText,
+		QoS:         2,
+		KeepAlive:   20 * time.Millisecond,
+		PingTimeout: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// Duplicate acknowledgements don't block the client.
+	for range 3 {
+		require.NoError(t, client.Send(context.Background(), testSnapshot(t)))
+	}
+
+	// Without a response to the ping, the connection is closed and opened again by the next send.
+	client.mu.Lock()
+	conn := client.conn
+	client.mu.Unlock()
+
+	select {
+	case <-conn.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+
+	require.ErrorIs(t, conn.err, errPingTimeout)
+	require.True(t, delivery.IsRetryable(conn.err))
+
+	require.NoError(t, client.Send(context.Background(), testSnapshot(t)))
+
+	connects, messages, _ := b.state()
+	require.Len(t, connects, 2)
+	require.Len(t, messages, 4)
+}
+
+func TestClientConnectError(t *testing.T) {
+	t.Parallel()
+
+	for code, retryable := range map[byte]bool{3: true, 5: false} {
+		b := newBroker(t)
+		b.returnCode = code
+
+		client, err := New(Config{URL: b.url(), ClientID: "agent", Topic: "metrics", Format: FormatJSON})
+		require.NoError(t, err)
+
+		err = client.Send(context.Background(), testSnapshot(t))
+
+		var connectErr *ConnectError
+		require.ErrorAs(t, err, &connectErr)
+		require.Equal(t, code, connectErr.ReturnCode)
+		require.Equal(t, retryable, delivery.IsRetryable(err))
+	}
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	t.Parallel()
+
+	// A PUBACK with the largest remaining length of 256 MiB.
+	reader := bufio.NewReader(strings.NewReader("\x40\xff\xff\xff\x7f"))
+
+	_, err := readPacket(reader, maxBrokerPacketSize)
+	require.ErrorContains(t, err, "exceeds the maximum size")
+}
+
+func TestEncodeJSON(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "A test histogram", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+
+	registry.MustRegister(histogram)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	b, err := Encode(snapshot, FormatJSON, nil)
+	require.NoError(t, err)
+
+	var payload jsonPayload
+	require.NoError(t, json.Unmarshal(b, &payload))
+
+	var names []string
+	for _, sample := range payload.Samples {
+		require.Equal(t, "histogram", sample.Type)
+
+		names = append(names, sample.Name+fmt.Sprint(sample.Labels))
+	}
+
+	require.Equal(t, []string{
+		"test_seconds_bucketmap[le:1]",
+		"test_seconds_bucketmap[le:+Inf]",
+		"test_seconds_summap[]",
+		"test_seconds_countmap[]",
+	}, names)
+}
+
+func TestExpandTopic(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{"agent_id": "agent_001", "site": "berlin", "wildcard": "a+b"}
+
+	topic, err := expandTopic("sites/{site}/agents/{agent_id}/metrics", labels)
+	require.NoError(t, err)
+	require.Equal(t, "sites/berlin/agents/agent_001/metrics", topic)
+
+	for _, template := range []string{"agents/{unknown}", "agents/{wildcard}", "agents/#", ""} {
+		_, err = expandTopic(template, labels)
+		require.Error(t, err, template)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	valid := Config{URL: "mqtt://broker", ClientID: "agent", Topic: "metrics", Format: FormatJSON}
+
+	for name, modify := range map[string]func(c *Config){
+		"scheme":   func(c *Config) { c.URL = "http://broker" },
+		"format":   func(c *Config) { c.Format = "xml" },
+		"qos":      func(c *Config) { c.QoS = 3 },
+		"clientID": func(c *Config) { c.ClientID = "" },
+		"password": func(c *Config) { c.Password = "secret" },
+		"topic":    func(c *Config) { c.StatusTopic = "status/{unknown}" },
+	} {
+		config := valid
+		modify(&config)
+
+		_, err := New(config)
+		require.Error(t, err, name)
+	}
+
+	client, err := New(valid)
+	require.NoError(t, err)
+	require.Equal(t, "broker:1883", client.addr)
+}
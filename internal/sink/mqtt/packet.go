@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types of MQTT 3.1.1.
+const (
+	packetConnect    byte = 1
+	packetConnAck    byte = 2
+	packetPublish    byte = 3
+	packetPubAck     byte = 4
+	packetPubRec     byte = 5
+	packetPubRel     byte = 6
+	packetPubComp    byte = 7
+	packetPingReq    byte = 12
+	packetPingResp   byte = 13
+	packetDisconnect byte = 14
+)
+
+// Flags of the CONNECT packet.
+const (
+	connectCleanSession byte = 0x02
+	connectWill         byte = 0x04
+	connectWillRetain   byte = 0x20
+	connectPassword     byte = 0x40
+	connectUsername     byte = 0x80
+)
+
+// protocolLevel is the protocol level of MQTT 3.1.1.
+const protocolLevel = 4
+
+// maxBrokerPacketSize is the largest packet accepted from the broker. The client does not
+// subscribe to any topic, so the broker only sends small acknowledgements.
+const maxBrokerPacketSize = 64 * 1024
+
+// packet is a decoded MQTT control packet.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// packetID returns the packet identifier of acknowledgement packets.
+func (p packet) packetID() uint16 {
+	if len(p.body) < 2 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(p.body)
+}
+
+// connectPacket holds the fields of a CONNECT packet.
+type connectPacket struct {
+	clientID    string
+	username    string
+	password    string
+	keepAlive   uint16
+	willTopic   string
+	willMessage []byte
+	willQoS     byte
+	willRetain  bool
+}
+
+func (c connectPacket) encode() []byte {
+	flags := connectCleanSession
+
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel, 0)
+	body = binary.BigEndian.AppendUint16(body, c.keepAlive)
+	body = appendString(body, c.clientID)
+
+	if c.willTopic != "" {
+		flags |= connectWill | c.willQoS<<3
+		if c.willRetain {
+			flags |= connectWillRetain
+		}
+
+		body = appendString(body, c.willTopic)
+		body = appendBytes(body, c.willMessage)
+	}
+
+	if c.username != "" {
+		flags |= connectUsername
+
+		body = appendString(body, c.username)
+
+		if c.password != "" {
+			flags |= connectPassword
+
+			body = appendString(body, c.password)
+		}
+	}
+
+	// The flags follow the protocol name and level.
+	body[7] = flags
+
+	return encodePacket(packetConnect, 0, body)
+}
+
+// encodePublish returns a PUBLISH packet. The packet identifier is only used if qos is greater than 0.
+func encodePublish(topic string, payload []byte, qos byte, retain bool, id uint16) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+
+	body := appendString(nil, topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+
+	body = append(body, payload...)
+
+	return encodePacket(packetPublish, flags, body)
+}
+
+// encodeAck returns a packet that only holds a packet identifier, such as PUBREL.
+func encodeAck(kind, flags byte, id uint16) []byte {
+	return encodePacket(kind, flags, binary.BigEndian.AppendUint16(nil, id))
+}
+
+func encodePacket(kind, flags byte, body []byte) []byte {
+	b := []byte{kind<<4 | flags&0x0f}
+
+	// The remaining length is a variable length integer with 7 bits per byte.
+	length := len(body)
+
+	for {
+		digit := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			digit |= 0x80
+		}
+
+		b = append(b, digit)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(b, body...)
+}
+
+// readPacket reads a packet with a remaining length of at most maxLength bytes.
+func readPacket(r *bufio.Reader, maxLength int) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	length, multiplier := 0, 1
+
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet{}, errors.New("malformed remaining length")
+		}
+
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > maxLength {
+		return packet{}, fmt.Errorf("packet of %d bytes exceeds the maximum size of %d bytes", length, maxLength)
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data))) //nolint:gosec // lengths are checked by New
+
+	return append(b, data...)
+}
+
+// ConnectError is returned if the broker refuses the connection.
+type ConnectError struct {
+	ReturnCode byte
+}
+
+func (e *ConnectError) Error() string {
+	reasons := map[byte]string{
+		1: "unacceptable protocol version",
+		2: "client identifier rejected",
+		3: "server unavailable",
+		4: "bad user name or password",
+		5: "not authorized",
+	}
+
+	reason, ok := reasons[e.ReturnCode]
+	if !ok {
+		reason = fmt.Sprintf("return code %d", e.ReturnCode)
+	}
+
+	return "MQTT broker refused the connection: " + reason
+}
+
+// Retryable reports whether the connection may be accepted if it is attempted again.
+// Only an unavailable server is a transient failure.
+func (e *ConnectError) Retryable() bool {
+	return e.ReturnCode == 3
+}
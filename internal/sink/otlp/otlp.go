@@ -0,0 +1,327 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package otlp sends snapshots to an OpenTelemetry OTLP/HTTP metrics endpoint,
+// such as the OpenTelemetry Collector.
+//
+// Spec: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	contentType = "application/x-protobuf"
+	scopeName   = "github.com/Brownster/agent-windows"
+
+	// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+	aggregationTemporalityCumulative = 2
+)
+
+// Config configures an OTLP Client.
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	// ResourceAttributes describe the agent, for example service.name and host.name.
+	// Metric labels with the same name and value as a resource attribute are not repeated on each data point.
+	ResourceAttributes map[string]string
+}
+
+// Client sends snapshots to an OTLP/HTTP endpoint.
+type Client struct {
+	config Config
+	client delivery.Doer
+	// start is the start time of cumulative data points without a created timestamp.
+	start time.Time
+}
+
+// New returns a new Client. If client is nil, http.DefaultClient is used.
+// Responses with a non-2xx status code are returned as *delivery.StatusError.
+func New(config Config, client delivery.Doer) *Client {
+	return &Client{
+		config: config,
+		client: delivery.NewStatusClient(client),
+		start:  time.Now(),
+	}
+}
+
+// Send implements delivery.Sender.
+func (c *Client) Send(ctx context.Context, snapshot delivery.Snapshot) error {
+	var body bytes.Buffer
+
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write(Encode(snapshot, c.config.ResourceAttributes, c.start)); err != nil {
+		return fmt.Errorf("failed to compress OTLP request: %w", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress OTLP request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "gzip")
+
+	if c.config.Username != "" && c.config.Password != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Encode encodes a snapshot as an uncompressed ExportMetricsServiceRequest protobuf message.
+//
+// Counters become cumulative monotonic sums, gauges and untyped metrics become gauges. Histograms
+// and summaries keep their type. Cumulative data points start at the created timestamp of the metric,
+// or at start if the metric has none.
+func Encode(snapshot delivery.Snapshot, resourceAttributes map[string]string, start time.Time) []byte {
+	var resource []byte
+
+	for _, name := range sortedKeys(resourceAttributes) {
+		resource = appendKeyValue(resource, 1, name, resourceAttributes[name])
+	}
+
+	var scope []byte
+	scope = appendString(scope, 1, scopeName)
+	scope = appendString(scope, 2, version.Version)
+
+	var scopeMetrics []byte
+	scopeMetrics = appendMessage(scopeMetrics, 1, scope)
+
+	for _, mf := range snapshot.Families {
+		if metric := encodeMetric(mf, snapshot.Timestamp, resourceAttributes, start); metric != nil {
+			scopeMetrics = appendMessage(scopeMetrics, 2, metric)
+		}
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+// encodeMetric encodes a metric family as an OTLP Metric. It returns nil if the family has no metrics.
+func encodeMetric(mf *dto.MetricFamily, timestamp time.Time, resourceAttributes map[string]string, start time.Time) []byte {
+	if len(mf.GetMetric()) == 0 {
+		return nil
+	}
+
+	var points []byte
+
+	for _, m := range mf.GetMetric() {
+		pointTime := timestamp
+		if m.TimestampMs != nil {
+			pointTime = time.UnixMilli(m.GetTimestampMs())
+		}
+
+		var point []byte
+
+		// The attributes are field 7 of all data points but HistogramDataPoint.
+		attributesField := protowire.Number(7)
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			point = appendFixed64(point, 2, startTime(m.GetCounter().GetCreatedTimestamp().AsTime(), start, pointTime))
+			point = appendFixed64(point, 3, uint64(pointTime.UnixNano()))
+			point = appendDouble(point, 4, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			point = appendFixed64(point, 3, uint64(pointTime.UnixNano()))
+			point = appendDouble(point, 4, m.GetGauge().GetValue())
+		case dto.MetricType_SUMMARY:
+			summary := m.GetSummary()
+
+			point = appendFixed64(point, 2, startTime(summary.GetCreatedTimestamp().AsTime(), start, pointTime))
+			point = appendFixed64(point, 3, uint64(pointTime.UnixNano()))
+			point = appendFixed64(point, 4, summary.GetSampleCount())
+			point = appendDouble(point, 5, summary.GetSampleSum())
+
+			for _, q := range summary.GetQuantile() {
+				var quantile []byte
+				quantile = appendDouble(quantile, 1, q.GetQuantile())
+				quantile = appendDouble(quantile, 2, q.GetValue())
+
+				point = appendMessage(point, 6, quantile)
+			}
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			histogram := m.GetHistogram()
+
+			// OTLP buckets hold the count of their own range, Prometheus buckets are cumulative.
+			// The +Inf bucket is implicit in OTLP.
+			var (
+				bounds     []byte
+				counts     []byte
+				cumulative uint64
+			)
+
+			for _, b := range histogram.GetBucket() {
+				if math.IsInf(b.GetUpperBound(), +1) {
+					continue
+				}
+
+				bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+				counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-cumulative)
+				cumulative = b.GetCumulativeCount()
+			}
+
+			counts = protowire.AppendFixed64(counts, histogram.GetSampleCount()-cumulative)
+
+			point = appendFixed64(point, 2, startTime(histogram.GetCreatedTimestamp().AsTime(), start, pointTime))
+			point = appendFixed64(point, 3, uint64(pointTime.UnixNano()))
+			point = appendFixed64(point, 4, histogram.GetSampleCount())
+			point = appendDouble(point, 5, histogram.GetSampleSum())
+			point = appendMessage(point, 6, counts)
+			point = appendMessage(point, 7, bounds)
+
+			attributesField = 9
+		default:
+			point = appendFixed64(point, 3, uint64(pointTime.UnixNano()))
+			point = appendDouble(point, 4, m.GetUntyped().GetValue())
+		}
+
+		for _, lp := range m.GetLabel() {
+			if value, ok := resourceAttributes[lp.GetName()]; ok && value == lp.GetValue() {
+				continue
+			}
+
+			point = appendKeyValue(point, attributesField, lp.GetName(), lp.GetValue())
+		}
+
+		points = appendMessage(points, 1, point)
+	}
+
+	var metric []byte
+	metric = appendString(metric, 1, mf.GetName())
+	metric = appendString(metric, 2, mf.GetHelp())
+	metric = appendString(metric, 3, mf.GetUnit())
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		points = appendVarint(points, 2, aggregationTemporalityCumulative)
+		points = appendVarint(points, 3, 1) // is_monotonic
+
+		metric = appendMessage(metric, 7, points)
+	case dto.MetricType_SUMMARY:
+		metric = appendMessage(metric, 11, points)
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		points = appendVarint(points, 2, aggregationTemporalityCumulative)
+
+		metric = appendMessage(metric, 9, points)
+	default:
+		metric = appendMessage(metric, 5, points)
+	}
+
+	return metric
+}
+
+// startTime returns the start time of a cumulative data point in Unix nanoseconds.
+// The start time must not be after the time of the data point, which happens for buffered
+// snapshots of a previous run of the agent.
+func startTime(created, start, pointTime time.Time) uint64 {
+	if created.Unix() > 0 {
+		start = created
+	}
+
+	if start.After(pointTime) {
+		start = pointTime
+	}
+
+	return uint64(start.UnixNano())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	slices.SortFunc(keys, strings.Compare)
+
+	return keys
+}
+
+// appendKeyValue appends a KeyValue message with a string value as field num.
+func appendKeyValue(b []byte, num protowire.Number, key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+
+	var keyValue []byte
+	keyValue = appendString(keyValue, 1, key)
+	keyValue = appendMessage(keyValue, 2, anyValue)
+
+	return appendMessage(b, num, keyValue)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, msg)
+}
+
+// appendString appends a string field. Empty strings are omitted, like proto3 does.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendString(b, s)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
@@ -0,0 +1,297 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package otlp_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink/otlp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metric is a decoded OTLP Metric with a single data point.
+type metric struct {
+	name        string
+	kind        protowire.Number
+	monotonic   bool
+	temporality uint64
+	attributes  map[string]string
+	startTime   uint64
+	time        uint64
+	value       float64
+	count       uint64
+	buckets     []uint64
+	bounds      []float64
+}
+
+// decodeRequest decodes the resource attributes and metrics of an ExportMetricsServiceRequest.
+func decodeRequest(t *testing.T, buf []byte) (map[string]string, []metric) {
+	t.Helper()
+
+	resource := map[string]string{}
+
+	var metrics []metric
+
+	forEachField(t, buf, func(_ protowire.Number, resourceMetrics []byte) {
+		forEachField(t, resourceMetrics, func(num protowire.Number, value []byte) {
+			switch num {
+			case 1:
+				forEachField(t, value, func(_ protowire.Number, keyValue []byte) {
+					decodeKeyValue(t, keyValue, resource)
+				})
+			case 2:
+				forEachField(t, value, func(num protowire.Number, value []byte) {
+					if num == 2 {
+						metrics = append(metrics, decodeMetric(t, value))
+					}
+				})
+			}
+		})
+	})
+
+	return resource, metrics
+}
+
+func decodeMetric(t *testing.T, buf []byte) metric {
+	t.Helper()
+
+	m := metric{attributes: map[string]string{}}
+
+	forEachField(t, buf, func(num protowire.Number, value []byte) {
+		switch num {
+		case 1:
+			m.name = string(value)
+		case 5, 7, 9, 11:
+			m.kind = num
+
+			forEachField(t, value, func(num protowire.Number, value []byte) {
+				switch num {
+				case 1:
+					decodePoint(t, value, &m)
+				case 2:
+					m.temporality, _ = protowire.ConsumeVarint(value)
+				case 3:
+					v, _ := protowire.ConsumeVarint(value)
+					m.monotonic = v == 1
+				}
+			})
+		}
+	})
+
+	return m
+}
+
+func decodePoint(t *testing.T, buf []byte, m *metric) {
+	t.Helper()
+
+	attributesField := protowire.Number(7)
+	if m.kind == 9 {
+		attributesField = 9
+	}
+
+	forEachField(t, buf, func(num protowire.Number, value []byte) {
+		fixed, _ := protowire.ConsumeFixed64(value)
+
+		switch {
+		case num == attributesField:
+			decodeKeyValue(t, value, m.attributes)
+		case num == 2:
+			m.startTime = fixed
+		case num == 3:
+			m.time = fixed
+		case num == 4 && (m.kind == 5 || m.kind == 7):
+			m.value = math.Float64frombits(fixed)
+		case num == 4:
+			m.count = fixed
+		case num == 5:
+			m.value = math.Float64frombits(fixed)
+		case num == 6 && m.kind == 9:
+			for len(value) > 0 {
+				v, n := protowire.ConsumeFixed64(value)
+				m.buckets = append(m.buckets, v)
+				value = value[n:]
+			}
+		case num == 7 && m.kind == 9:
+			for len(value) > 0 {
+				v, n := protowire.ConsumeFixed64(value)
+				m.bounds = append(m.bounds, math.Float64frombits(v))
+				value = value[n:]
+			}
+		}
+	})
+}
+
+func decodeKeyValue(t *testing.T, buf []byte, result map[string]string) {
+	t.Helper()
+
+	var key, value string
+
+	forEachField(t, buf, func(num protowire.Number, field []byte) {
+		if num == 1 {
+			key = string(field)
+
+			return
+		}
+
+		forEachField(t, field, func(_ protowire.Number, anyValue []byte) {
+			value = string(anyValue)
+		})
+	})
+
+	result[key] = value
+}
+
+// forEachField calls fn with the raw value of each field. Length-delimited values are unwrapped.
+func forEachField(t *testing.T, buf []byte, fn func(num protowire.Number, value []byte)) {
+	t.Helper()
+
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		require.GreaterOrEqual(t, n, 0)
+		buf = buf[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, buf)
+		require.GreaterOrEqual(t, n, 0)
+
+		value := buf[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+
+		fn(num, value)
+		buf = buf[n:]
+	}
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	var (
+		headers http.Header
+		body    []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+
+		body, err = io.ReadAll(gz)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "test_total",
+		Help:        "A test counter",
+		ConstLabels: prometheus.Labels{"agent_id": "agent_001"},
+	}, []string{"nic"})
+	counter.WithLabelValues("eth0").Add(5)
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_bytes", Help: "A test gauge"})
+	gauge.Set(42)
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "A test histogram", Buckets: []float64{1, 2}})
+	histogram.Observe(0.5)
+	histogram.Observe(1.5)
+	histogram.Observe(3)
+
+	registry.MustRegister(counter, gauge, histogram)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	snapshot.Timestamp = time.Unix(1700000000, 0)
+
+	client := otlp.New(otlp.Config{
+		URL:      server.URL,
+		Username: "user",
+		Password: "pass",
+		ResourceAttributes: map[string]string{
+			"agent_id":     "agent_001",
+			"host.name":    "ws-0042",
+			"service.name": "windows_agent",
+		},
+	}, server.Client())
+
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	require.Equal(t, "gzip", headers.Get("Content-Encoding"))
+	require.Equal(t, "application/x-protobuf", headers.Get("Content-Type"))
+
+	resource, metrics := decodeRequest(t, body)
+	require.Equal(t, map[string]string{
+		"agent_id":     "agent_001",
+		"host.name":    "ws-0042",
+		"service.name": "windows_agent",
+	}, resource)
+
+	require.Len(t, metrics, 3)
+
+	// Gauges stay gauges.
+	require.Equal(t, "test_bytes", metrics[0].name)
+	require.Equal(t, protowire.Number(5), metrics[0].kind)
+	require.InDelta(t, 42, metrics[0].value, 0)
+	require.Equal(t, uint64(1700000000*time.Second), metrics[0].time)
+
+	// Histogram buckets are not cumulative, the +Inf bucket is implicit.
+	require.Equal(t, "test_seconds", metrics[1].name)
+	require.Equal(t, protowire.Number(9), metrics[1].kind)
+	require.Equal(t, uint64(2), metrics[1].temporality)
+	require.Equal(t, uint64(3), metrics[1].count)
+	require.Equal(t, []float64{1, 2}, metrics[1].bounds)
+	require.Equal(t, []uint64{1, 1, 1}, metrics[1].buckets)
+
+	// Counters become cumulative monotonic sums. Labels that are resource attributes are not repeated.
+	require.Equal(t, "test_total", metrics[2].name)
+	require.Equal(t, protowire.Number(7), metrics[2].kind)
+	require.True(t, metrics[2].monotonic)
+	require.Equal(t, uint64(2), metrics[2].temporality)
+	require.InDelta(t, 5, metrics[2].value, 0)
+	require.Equal(t, map[string]string{"nic": "eth0"}, metrics[2].attributes)
+	require.NotZero(t, metrics[2].startTime)
+	require.LessOrEqual(t, metrics[2].startTime, metrics[2].time)
+}
+
+func TestSendError(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "invalid metric", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := otlp.New(otlp.Config{URL: server.URL}, server.Client())
+
+	err := client.Send(context.Background(), delivery.Snapshot{Timestamp: time.Now()})
+	require.ErrorContains(t, err, "invalid metric")
+	require.False(t, delivery.IsRetryable(err))
+}
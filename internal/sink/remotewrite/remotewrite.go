@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package remotewrite sends snapshots to a Prometheus remote write (v1) endpoint,
+// such as Mimir, Thanos Receive or VictoriaMetrics.
+//
+// Spec: https://prometheus.io/docs/specs/prw/remote_write_spec/
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	contentType = "application/x-protobuf"
+	version     = "0.1.0"
+)
+
+// Config configures a remote write Client.
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	// ExternalLabels are added to every series that does not already have a label of the same name.
+	ExternalLabels map[string]string
+}
+
+// Client sends snapshots to a remote write endpoint.
+type Client struct {
+	config Config
+	client delivery.Doer
+}
+
+// New returns a new Client. If client is nil, http.DefaultClient is used.
+// Responses with a non-2xx status code are returned as *delivery.StatusError.
+func New(config Config, client delivery.Doer) *Client {
+	return &Client{
+		config: config,
+		client: delivery.NewStatusClient(client),
+	}
+}
+
+// Send implements delivery.Sender.
+func (c *Client) Send(ctx context.Context, snapshot delivery.Snapshot) error {
+	body := snappy.Encode(nil, Encode(snapshot, c.config.ExternalLabels))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create remote write request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", version)
+
+	if c.config.Username != "" && c.config.Password != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// Encode encodes a snapshot as an uncompressed prometheus.WriteRequest protobuf message.
+func Encode(snapshot delivery.Snapshot, externalLabels map[string]string) []byte {
+	extra := make([]sink.Label, 0, len(externalLabels))
+	for name, value := range externalLabels {
+		extra = append(extra, sink.Label{Name: name, Value: value})
+	}
+
+	var buf []byte
+
+	for _, sample := range sink.Samples(snapshot) {
+		labels := sink.WithLabels(sample.Labels, append(extra, sink.Label{Name: "__name__", Value: sample.Name})...)
+
+		var series []byte
+
+		for _, l := range labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.Name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.Value)
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.Value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sample.Timestamp.UnixMilli()))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, series)
+	}
+
+	for _, mf := range snapshot.Families {
+		var metadata []byte
+		metadata = protowire.AppendTag(metadata, 1, protowire.VarintType)
+		metadata = protowire.AppendVarint(metadata, metadataType(mf.GetType()))
+		metadata = protowire.AppendTag(metadata, 2, protowire.BytesType)
+		metadata = protowire.AppendString(metadata, mf.GetName())
+		metadata = protowire.AppendTag(metadata, 4, protowire.BytesType)
+		metadata = protowire.AppendString(metadata, mf.GetHelp())
+
+		buf = protowire.AppendTag(buf, 3, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, metadata)
+	}
+
+	return buf
+}
+
+// metadataType maps a metric type to prometheus.MetricMetadata.MetricType.
+func metadataType(t dto.MetricType) uint64 {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return 1
+	case dto.MetricType_GAUGE:
+		return 2
+	case dto.MetricType_HISTOGRAM:
+		return 3
+	case dto.MetricType_GAUGE_HISTOGRAM:
+		return 4
+	case dto.MetricType_SUMMARY:
+		return 5
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,200 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package remotewrite_test
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink/remotewrite"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type series struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the time series of a prometheus.WriteRequest.
+func decodeWriteRequest(t *testing.T, buf []byte) []series {
+	t.Helper()
+
+	var result []series
+
+	forEachField(t, buf, func(num protowire.Number, value []byte) {
+		if num != 1 {
+			return
+		}
+
+		s := series{labels: map[string]string{}}
+
+		forEachField(t, value, func(num protowire.Number, value []byte) {
+			switch num {
+			case 1:
+				var name, labelValue string
+
+				forEachField(t, value, func(num protowire.Number, value []byte) {
+					if num == 1 {
+						name = string(value)
+					} else {
+						labelValue = string(value)
+					}
+				})
+
+				s.labels[name] = labelValue
+			case 2:
+				forEachField(t, value, func(num protowire.Number, value []byte) {
+					if num == 1 {
+						v, _ := protowire.ConsumeFixed64(value)
+						s.value = math.Float64frombits(v)
+					} else {
+						v, _ := protowire.ConsumeVarint(value)
+						s.timestamp = int64(v)
+					}
+				})
+			}
+		})
+
+		result = append(result, s)
+	})
+
+	return result
+}
+
+// forEachField calls fn with the raw value of each field. Length-delimited values are unwrapped.
+func forEachField(t *testing.T, buf []byte, fn func(num protowire.Number, value []byte)) {
+	t.Helper()
+
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		require.GreaterOrEqual(t, n, 0)
+		buf = buf[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, buf)
+		require.GreaterOrEqual(t, n, 0)
+
+		value := buf[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+
+		fn(num, value)
+		buf = buf[n:]
+	}
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	var (
+		headers http.Header
+		body    []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		compressed, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		body, err = snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "A test counter"}, []string{"nic"})
+	counter.WithLabelValues("eth0").Add(5)
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "A test histogram", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+
+	registry.MustRegister(counter, histogram)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	snapshot.Timestamp = time.UnixMilli(1700000000000)
+
+	client := remotewrite.New(remotewrite.Config{
+		URL:            server.URL,
+		Username:       "user",
+		Password:       "pass",
+		ExternalLabels: map[string]string{"agent_id": "agent_001", "job": "windows_agent"},
+	}, server.Client())
+
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	require.Equal(t, "snappy", headers.Get("Content-Encoding"))
+	require.Equal(t, "application/x-protobuf", headers.Get("Content-Type"))
+	require.Equal(t, "0.1.0", headers.Get("X-Prometheus-Remote-Write-Version"))
+	require.True(t, strings.HasPrefix(headers.Get("Authorization"), "Basic "))
+
+	got := decodeWriteRequest(t, body)
+	require.Len(t, got, 5)
+
+	require.Equal(t, series{
+		labels: map[string]string{
+			"__name__": "test_seconds_bucket",
+			"agent_id": "agent_001",
+			"job":      "windows_agent",
+			"le":       "1",
+		},
+		value:     1,
+		timestamp: 1700000000000,
+	}, got[0])
+
+	require.Equal(t, series{
+		labels: map[string]string{
+			"__name__": "test_total",
+			"agent_id": "agent_001",
+			"job":      "windows_agent",
+			"nic":      "eth0",
+		},
+		value:     5,
+		timestamp: 1700000000000,
+	}, got[4])
+}
+
+func TestSendError(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := remotewrite.New(remotewrite.Config{URL: server.URL}, server.Client())
+
+	err := client.Send(context.Background(), delivery.Snapshot{Timestamp: time.Now()})
+	require.ErrorContains(t, err, "out of order sample")
+	require.False(t, delivery.IsRetryable(err))
+}
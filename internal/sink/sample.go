@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package sink contains helpers shared by the output sinks.
+package sink
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Label is a label name and value pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single flattened series value. Histograms and summaries are expanded
+// into their classic _bucket, _sum and _count series, and quantiles.
+type Sample struct {
+	// Name is the series name, including any _bucket, _sum or _count suffix.
+	Name string
+	// Family is the name of the metric family the sample belongs to.
+	Family string
+	// Type is the type of the metric family.
+	Type dto.MetricType
+	// Labels are sorted by name.
+	Labels    []Label
+	Value     float64
+	Timestamp time.Time
+}
+
+// Samples flattens the metric families of a snapshot into samples. Samples without
+// an explicit timestamp get the timestamp of the snapshot.
+func Samples(snapshot delivery.Snapshot) []Sample {
+	var samples []Sample
+
+	for _, mf := range snapshot.Families {
+		name := mf.GetName()
+
+		for _, m := range mf.GetMetric() {
+			timestamp := snapshot.Timestamp
+			if m.TimestampMs != nil {
+				timestamp = time.UnixMilli(m.GetTimestampMs())
+			}
+
+			labels := make([]Label, 0, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, Label{Name: lp.GetName(), Value: lp.GetValue()})
+			}
+
+			slices.SortFunc(labels, func(a, b Label) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+
+			add := func(suffix string, value float64, extra ...Label) {
+				sampleLabels := labels
+				if len(extra) > 0 {
+					sampleLabels = WithLabels(labels, extra...)
+				}
+
+				samples = append(samples, Sample{
+					Name:      name + suffix,
+					Family:    name,
+					Type:      mf.GetType(),
+					Labels:    sampleLabels,
+					Value:     value,
+					Timestamp: timestamp,
+				})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := m.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add("", q.GetValue(), Label{Name: "quantile", Value: FormatFloat(q.GetQuantile())})
+				}
+
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := m.GetHistogram()
+				infSeen := false
+
+				for _, b := range histogram.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+
+					add("_bucket", float64(b.GetCumulativeCount()), Label{Name: "le", Value: FormatFloat(b.GetUpperBound())})
+				}
+
+				if !infSeen {
+					add("_bucket", float64(histogram.GetSampleCount()), Label{Name: "le", Value: "+Inf"})
+				}
+
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+
+	return samples
+}
+
+// WithLabels returns a copy of labels with extra labels added, sorted by name.
+// Existing labels take precedence over extra labels with the same name.
+func WithLabels(labels []Label, extra ...Label) []Label {
+	result := slices.Clone(labels)
+
+	for _, l := range extra {
+		if !slices.ContainsFunc(result, func(existing Label) bool { return existing.Name == l.Name }) {
+			result = append(result, l)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return result
+}
+
+// FormatFloat formats a float like the Prometheus text format does.
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
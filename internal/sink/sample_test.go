@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package sink_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSamples(t *testing.T) {
+	t.Parallel()
+
+	timestamp := time.UnixMilli(1700000000000)
+
+	snapshot := delivery.Snapshot{
+		Timestamp: timestamp,
+		Families: []*dto.MetricFamily{
+			{
+				Name: proto.String("test_summary"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{{
+					Label: []*dto.LabelPair{{Name: proto.String("nic"), Value: proto.String("eth0")}},
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(2),
+						SampleSum:   proto.Float64(3),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(1.5)}},
+					},
+				}},
+			},
+			{
+				Name: proto.String("test_gauge"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{
+					Gauge:       &dto.Gauge{Value: proto.Float64(42)},
+					TimestampMs: proto.Int64(1600000000000),
+				}},
+			},
+		},
+	}
+
+	nic := sink.Label{Name: "nic", Value: "eth0"}
+
+	require.Equal(t, []sink.Sample{
+		{
+			Name: "test_summary", Family: "test_summary", Type: dto.MetricType_SUMMARY,
+			Labels: []sink.Label{nic, {Name: "quantile", Value: "0.5"}}, Value: 1.5, Timestamp: timestamp,
+		},
+		{
+			Name: "test_summary_sum", Family: "test_summary", Type: dto.MetricType_SUMMARY,
+			Labels: []sink.Label{nic}, Value: 3, Timestamp: timestamp,
+		},
+		{
+			Name: "test_summary_count", Family: "test_summary", Type: dto.MetricType_SUMMARY,
+			Labels: []sink.Label{nic}, Value: 2, Timestamp: timestamp,
+		},
+		{
+			Name: "test_gauge", Family: "test_gauge", Type: dto.MetricType_GAUGE,
+			Labels: []sink.Label{}, Value: 42, Timestamp: time.UnixMilli(1600000000000),
+		},
+	}, sink.Samples(snapshot))
+}
+
+func TestWithLabels(t *testing.T) {
+	t.Parallel()
+
+	labels := []sink.Label{{Name: "job", Value: "metric"}}
+
+	require.Equal(t, []sink.Label{
+		{Name: "agent_id", Value: "agent_001"},
+		{Name: "job", Value: "metric"},
+	}, sink.WithLabels(labels, sink.Label{Name: "job", Value: "external"}, sink.Label{Name: "agent_id", Value: "agent_001"}))
+
+	require.Len(t, labels, 1)
+}
@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package statsd sends snapshots to a StatsD server over UDP, with labels as DogStatsD tags,
+// for example to a local Datadog agent.
+//
+// Spec: https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultMaxPacketSize is the UDP payload size recommended by Datadog. It fits the common
+// Ethernet MTU, so packets are not fragmented.
+const DefaultMaxPacketSize = 1432
+
+// Config configures a StatsD Client.
+type Config struct {
+	// URL is the address of the StatsD server, for example udp://127.0.0.1:8125.
+	URL string
+	// MaxPacketSize is the maximum size of a UDP packet. Defaults to DefaultMaxPacketSize.
+	MaxPacketSize int
+	// Tags are added to every metric that does not already have a tag of the same name.
+	Tags map[string]string
+}
+
+// Client sends snapshots to a StatsD server.
+type Client struct {
+	config Config
+	addr   string
+
+	mu sync.Mutex
+	// counters holds the last value of each counter series, keyed by seriesKey.
+	counters map[string]float64
+}
+
+// New returns a new Client.
+func New(config Config) (*Client, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid StatsD URL: %w", err)
+	}
+
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("invalid StatsD URL: unsupported scheme %q", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		return nil, errors.New("invalid StatsD URL: UDP address requires a port")
+	}
+
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = DefaultMaxPacketSize
+	}
+
+	return &Client{config: config, addr: u.Host}, nil
+}
+
+// Send implements delivery.Sender.
+//
+// Counters are sent as the increment since the previous snapshot, so the first snapshot only
+// records their values.
+func (c *Client) Send(ctx context.Context, snapshot delivery.Snapshot) error {
+	c.mu.Lock()
+	lines, counters := Encode(snapshot, c.config.Tags, c.counters)
+	c.mu.Unlock()
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", c.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to StatsD server: %w", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+	}
+
+	var packet []byte
+
+	flush := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+
+		_, err := conn.Write(packet)
+		packet = packet[:0]
+
+		return err
+	}
+
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > c.config.MaxPacketSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+
+		packet = append(packet, line...)
+	}
+
+	if err = flush(); err != nil {
+		return err
+	}
+
+	// The previous values are only replaced once the increments are sent, so a failed
+	// send is included in the increments of the next one.
+	c.mu.Lock()
+	c.counters = counters
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Encode encodes a snapshot as StatsD metrics, one per sample, and returns them together with
+// the values of the counter series.
+//
+// Gauges, untyped metrics and summary quantiles are sent as gauges (|g). Counters and the _sum,
+// _count and _bucket series of histograms and summaries are sent as counts (|c) of the increment
+// since previous, which holds the values returned by the previous call. Series without a previous
+// value are not sent, and a decrease is treated as a reset to zero. Labels are sent as DogStatsD
+// tags, except labels with an empty value. Samples with a NaN or infinite value are skipped.
+func Encode(snapshot delivery.Snapshot, tags map[string]string, previous map[string]float64) ([][]byte, map[string]float64) {
+	extra := make([]sink.Label, 0, len(tags))
+	for name, value := range tags {
+		extra = append(extra, sink.Label{Name: name, Value: value})
+	}
+
+	samples := sink.Samples(snapshot)
+	lines := make([][]byte, 0, len(samples))
+	counters := make(map[string]float64)
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+
+		labels := sink.WithLabels(sample.Labels, extra...)
+		value := sample.Value
+		metricType := "g"
+
+		if isCumulative(sample) {
+			key := seriesKey(sample.Name, labels)
+			counters[key] = sample.Value
+
+			last, ok := previous[key]
+			if !ok {
+				continue
+			}
+
+			if value >= last {
+				value -= last
+			}
+
+			metricType = "c"
+		}
+
+		line := []byte(nameReplacer.Replace(sample.Name))
+		line = append(line, ':')
+		line = append(line, sink.FormatFloat(value)...)
+		line = append(line, '|')
+		line = append(line, metricType...)
+
+		separator := "|#"
+
+		for _, l := range labels {
+			if l.Value == "" {
+				continue
+			}
+
+			line = append(line, separator...)
+			line = append(line, tagReplacer.Replace(l.Name)...)
+			line = append(line, ':')
+			line = append(line, tagReplacer.Replace(l.Value)...)
+
+			separator = ","
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, counters
+}
+
+// isCumulative reports whether a sample is a cumulative count.
+func isCumulative(sample sink.Sample) bool {
+	switch sample.Type {
+	case dto.MetricType_COUNTER:
+		return true
+	case dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+		return sample.Name != sample.Family
+	default:
+		return false
+	}
+}
+
+// seriesKey identifies a series by its name and labels.
+func seriesKey(name string, labels []sink.Label) string {
+	var b strings.Builder
+
+	b.WriteString(name)
+
+	for _, l := range labels {
+		b.WriteByte(0)
+		b.WriteString(l.Name)
+		b.WriteByte(0)
+		b.WriteString(l.Value)
+	}
+
+	return b.String()
+}
+
+//nolint:gochecknoglobals
+var (
+	// nameReplacer replaces the characters that separate the parts of a metric.
+	nameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+	// tagReplacer replaces the characters that separate tags and the parts of a metric.
+	tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
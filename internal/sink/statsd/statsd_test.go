@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package statsd_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"github.com/Brownster/agent-windows/internal/sink/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "windows_net_bytes", Help: "A test gauge"}, []string{"nic", "empty"})
+	gauge.WithLabelValues("Intel(R) Ethernet, #1|2", "").Set(-1.5)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "windows_cpu_time_total", Help: "A test counter"})
+	counter.Add(10)
+
+	registry.MustRegister(gauge, counter)
+
+	tags := map[string]string{"agent_id": "agent_001"}
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	// The first snapshot only records the value of the counter.
+	lines, counters := statsd.Encode(snapshot, tags, nil)
+	require.Equal(t, []string{
+		"windows_net_bytes:-1.5|g|#agent_id:agent_001,nic:Intel(R) Ethernet_ _1_2",
+	}, toStrings(lines))
+
+	counter.Add(2.5)
+
+	snapshot, err = delivery.Gather(registry)
+	require.NoError(t, err)
+
+	lines, counters = statsd.Encode(snapshot, tags, counters)
+	require.Equal(t, []string{
+		"windows_cpu_time_total:2.5|c|#agent_id:agent_001",
+		"windows_net_bytes:-1.5|g|#agent_id:agent_001,nic:Intel(R) Ethernet_ _1_2",
+	}, toStrings(lines))
+
+	// A counter that decreased was reset, so its whole value is the increment.
+	registry.Unregister(counter)
+
+	counter = prometheus.NewCounter(prometheus.CounterOpts{Name: "windows_cpu_time_total", Help: "A test counter"})
+	counter.Add(4)
+	registry.MustRegister(counter)
+
+	snapshot, err = delivery.Gather(registry)
+	require.NoError(t, err)
+
+	lines, _ = statsd.Encode(snapshot, tags, counters)
+	require.Contains(t, toStrings(lines), "windows_cpu_time_total:4|c|#agent_id:agent_001")
+}
+
+func TestEncodeHistogram(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_seconds", Help: "A test histogram", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+
+	registry.MustRegister(histogram)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	_, counters := statsd.Encode(snapshot, nil, nil)
+
+	histogram.Observe(2)
+
+	snapshot, err = delivery.Gather(registry)
+	require.NoError(t, err)
+
+	lines, _ := statsd.Encode(snapshot, nil, counters)
+	require.Equal(t, []string{
+		"test_seconds_bucket:0|c|#le:1",
+		"test_seconds_bucket:1|c|#le:+Inf",
+		"test_seconds_sum:2|c",
+		"test_seconds_count:1|c",
+	}, toStrings(lines))
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"}, []string{"label"})
+	for i := range 20 {
+		gauge.WithLabelValues(strings.Repeat("x", 100) + string(rune('a'+i))).Set(1)
+	}
+
+	registry.MustRegister(gauge)
+
+	snapshot, err := delivery.Gather(registry)
+	require.NoError(t, err)
+
+	client, err := statsd.New(statsd.Config{URL: "udp://" + conn.LocalAddr().String(), MaxPacketSize: 512})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Send(context.Background(), snapshot))
+
+	// The metrics are batched into packets of up to MaxPacketSize bytes.
+	var (
+		metrics int
+		packets int
+		buf     = make([]byte, 65536)
+	)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	for metrics < 20 {
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.LessOrEqual(t, n, 512)
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			require.True(t, strings.HasPrefix(line, "test_gauge:1|g|#label:"), line)
+
+			metrics++
+		}
+
+		packets++
+	}
+
+	require.Equal(t, 20, metrics)
+	require.Greater(t, packets, 1)
+	require.Less(t, packets, 20)
+}
+
+func TestNewInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, url := range []string{"tcp://127.0.0.1:8125", "udp://127.0.0.1", "127.0.0.1:8125"} {
+		_, err := statsd.New(statsd.Config{URL: url})
+		require.Error(t, err, url)
+	}
+}
+
+func toStrings(lines [][]byte) []string {
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		result = append(result, string(line))
+	}
+
+	return result
+}
@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package validate checks the gathered metric families before they are delivered. A Pushgateway
+// rejects a push with a single inconsistent family, so invalid families are quarantined instead:
+// they are left out of the gather, and the rest is delivered.
+package validate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/Brownster/agent-windows/internal/series"
+	"github.com/Brownster/agent-windows/internal/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Reasons that rejected families are counted under.
+const (
+	// ReasonInvalidName is a family with an invalid metric or label name.
+	ReasonInvalidName = "invalid_name"
+	// ReasonDuplicateFamily is a family that was gathered more than once.
+	ReasonDuplicateFamily = "duplicate_family"
+	// ReasonDuplicateSeries is a family with two series of the same labels.
+	ReasonDuplicateSeries = "duplicate_series"
+	// ReasonInconsistentLabels is a family whose series have different or duplicate label names.
+	ReasonInconsistentLabels = "inconsistent_labels"
+	// ReasonInvalidValue is a family with a NaN or infinite value.
+	ReasonInvalidValue = "invalid_value"
+	// ReasonGatherError is reported for errors of the wrapped gatherer, which already left out the
+	// offending metrics.
+	ReasonGatherError = "gather_error"
+)
+
+//nolint:gochecknoglobals
+var (
+	reasons = []string{
+		ReasonInvalidName, ReasonDuplicateFamily, ReasonDuplicateSeries, ReasonInconsistentLabels,
+		ReasonInvalidValue, ReasonGatherError,
+	}
+
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Validator is a prometheus.Gatherer that quarantines the invalid families of the wrapped
+// gatherer. Every rejection is logged and counted once, and again if it recurs after the family
+// was valid. It implements prometheus.Collector to report the rejections.
+type Validator struct {
+	gatherer prometheus.Gatherer
+	logger   *slog.Logger
+
+	mu sync.Mutex
+	// reported are the rejections that were logged, by family name and reason, or by error for
+	// ReasonGatherError.
+	reported    map[rejection]bool
+	rejections  map[string]float64
+	quarantined map[string]float64
+
+	rejectionsDesc  *prometheus.Desc
+	quarantinedDesc *prometheus.Desc
+}
+
+type rejection struct {
+	family, reason string
+}
+
+// New returns a Validator.
+func New(logger *slog.Logger, gatherer prometheus.Gatherer) *Validator {
+	return &Validator{
+		gatherer:    gatherer,
+		logger:      logger,
+		reported:    map[rejection]bool{},
+		rejections:  map[string]float64{},
+		quarantined: map[string]float64{},
+
+		rejectionsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "validation_rejections_total"),
+			"Number of rejected metric families, counted once until the family is valid again.",
+			[]string{"reason"},
+			nil,
+		),
+		quarantinedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(types.Namespace, "agent", "validation_quarantined_families"),
+			"Number of metric families left out of the last gather.",
+			[]string{"reason"},
+			nil,
+		),
+	}
+}
+
+// Gather implements prometheus.Gatherer. Errors of the wrapped gatherer are only returned if it
+// returned no families.
+func (v *Validator) Gather() ([]*dto.MetricFamily, error) {
+	// The wrapped gatherer may collect v, so v.mu must not be held.
+	families, err := v.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return nil, err
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(families))
+	rejected := map[rejection]string{}
+	seen := make(map[string]bool, len(families))
+
+	for _, mf := range families {
+		name := mf.GetName()
+
+		var reason, detail string
+
+		if seen[name] {
+			reason, detail = ReasonDuplicateFamily, "the family was gathered more than once"
+		} else {
+			reason, detail = check(mf)
+		}
+
+		seen[name] = true
+
+		if reason != "" {
+			rejected[rejection{family: name, reason: reason}] = detail
+
+			continue
+		}
+
+		result = append(result, mf)
+	}
+
+	if err != nil {
+		rejected[rejection{reason: ReasonGatherError}] = err.Error()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	clear(v.quarantined)
+
+	for r, detail := range rejected {
+		if r.reason != ReasonGatherError {
+			v.quarantined[r.reason]++
+		}
+
+		key := r
+		if r.reason == ReasonGatherError {
+			key.family = detail
+		}
+
+		if v.reported[key] {
+			continue
+		}
+
+		v.reported[key] = true
+		v.rejections[r.reason]++
+
+		if r.reason == ReasonGatherError {
+			v.logger.LogAttrs(context.Background(), slog.LevelWarn, "Gathered metrics are incomplete",
+				slog.Any("err", err),
+			)
+
+			continue
+		}
+
+		v.logger.LogAttrs(context.Background(), slog.LevelWarn, "Quarantined invalid metric family",
+			slog.String("family", r.family),
+			slog.String("reason", r.reason),
+			slog.String("detail", detail),
+		)
+	}
+
+	// Families that are valid again, and errors after a gather without errors, are reported again
+	// when they recur.
+	for key := range v.reported {
+		if key.reason == ReasonGatherError {
+			if err == nil {
+				delete(v.reported, key)
+			}
+
+			continue
+		}
+
+		if _, ok := rejected[key]; !ok && seen[key.family] {
+			delete(v.reported, key)
+		}
+	}
+
+	return result, nil
+}
+
+// check returns the reason and a description if mf is invalid, or "" if it is valid.
+func check(mf *dto.MetricFamily) (string, string) {
+	if !metricNameRegexp.MatchString(mf.GetName()) {
+		return ReasonInvalidName, fmt.Sprintf("%q is not a valid metric name", mf.GetName())
+	}
+
+	var labelNames []string
+
+	keys := make(map[string]bool, len(mf.GetMetric()))
+
+	for i, m := range mf.GetMetric() {
+		names := make([]string, 0, len(m.GetLabel()))
+
+		for _, lp := range m.GetLabel() {
+			if !labelNameRegexp.MatchString(lp.GetName()) {
+				return ReasonInvalidName, fmt.Sprintf("%q is not a valid label name", lp.GetName())
+			}
+
+			names = append(names, lp.GetName())
+		}
+
+		slices.Sort(names)
+
+		if len(slices.Compact(slices.Clone(names))) != len(names) {
+			return ReasonInconsistentLabels, fmt.Sprintf("a series has a duplicate label in %v", names)
+		}
+
+		if i == 0 {
+			labelNames = names
+		} else if !slices.Equal(labelNames, names) {
+			return ReasonInconsistentLabels, fmt.Sprintf("label names %v and %v", labelNames, names)
+		}
+
+		key := series.Key(m)
+		if keys[key] {
+			return ReasonDuplicateSeries, fmt.Sprintf("the labels %v were gathered more than once", m.GetLabel())
+		}
+
+		keys[key] = true
+
+		if value, ok := series.Value(mf.GetType(), m); ok && (math.IsNaN(value) || math.IsInf(value, 0)) {
+			return ReasonInvalidValue, fmt.Sprintf("the series with the labels %v has the value %v", m.GetLabel(), value)
+		}
+	}
+
+	return "", ""
+}
+
+// Describe implements prometheus.Collector.
+func (v *Validator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.rejectionsDesc
+	ch <- v.quarantinedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (v *Validator) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, reason := range reasons {
+		ch <- prometheus.MustNewConstMetric(v.rejectionsDesc, prometheus.CounterValue, v.rejections[reason], reason)
+
+		if reason != ReasonGatherError {
+			ch <- prometheus.MustNewConstMetric(v.quarantinedDesc, prometheus.GaugeValue, v.quarantined[reason], reason)
+		}
+	}
+}
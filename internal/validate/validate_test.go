@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package validate
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func family(name string, labels ...map[string]string) *dto.MetricFamily {
+	mf := &dto.MetricFamily{Name: proto.String(name), Help: proto.String("A test gauge"), Type: dto.MetricType_GAUGE.Enum()}
+
+	for _, l := range labels {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+		for _, name := range []string{"a", "b", "core"} {
+			if value, ok := l[name]; ok {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+			}
+		}
+
+		mf.Metric = append(mf.Metric, m)
+	}
+
+	return mf
+}
+
+func names(families []*dto.MetricFamily) []string {
+	result := make([]string, 0, len(families))
+	for _, mf := range families {
+		result = append(result, mf.GetName())
+	}
+
+	return result
+}
+
+func TestValidator(t *testing.T) {
+	t.Parallel()
+
+	nan := family("test_nan", map[string]string{"core": "0"})
+	nan.Metric[0].Gauge.Value = proto.Float64(math.NaN())
+
+	inf := family("test_inf")
+	inf.Metric = []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(math.Inf(1))}}}
+	inf.Type = dto.MetricType_COUNTER.Enum()
+
+	families := []*dto.MetricFamily{
+		family("test_valid", map[string]string{"a": "1"}, map[string]string{"a": "2"}),
+		family("test_inconsistent", map[string]string{"a": "1"}, map[string]string{"a": "1", "b": "2"}),
+		family("test_duplicate_series", map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "1", "b": "2"}),
+		family("test-invalid-name"),
+		family("test_invalid_label", map[string]string{"core": "0"}),
+		family("test_duplicate_family"),
+		family("test_duplicate_family"),
+		nan,
+		inf,
+	}
+	families[4].Metric[0].Label[0].Name = proto.String("0core")
+
+	var logs bytes.Buffer
+
+	v := New(slog.New(slog.NewTextHandler(&logs, nil)), prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	}))
+
+	for range 2 {
+		result, err := v.Gather()
+		require.NoError(t, err)
+		require.Equal(t, []string{"test_valid", "test_duplicate_family"}, names(result))
+	}
+
+	require.Equal(t, 7, strings.Count(logs.String(), "Quarantined invalid metric family"), logs.String())
+
+	require.NoError(t, testutil.CollectAndCompare(v, strings.NewReader(`# HELP windows_agent_validation_quarantined_families Number of metric families left out of the last gather.
+# TYPE windows_agent_validation_quarantined_families gauge
+windows_agent_validation_quarantined_families{reason="duplicate_family"} 1
+windows_agent_validation_quarantined_families{reason="duplicate_series"} 1
+windows_agent_validation_quarantined_families{reason="inconsistent_labels"} 1
+windows_agent_validation_quarantined_families{reason="invalid_name"} 2
+windows_agent_validation_quarantined_families{reason="invalid_value"} 2
+# HELP windows_agent_validation_rejections_total Number of rejected metric families, counted once until the family is valid again.
+# TYPE windows_agent_validation_rejections_total counter
+windows_agent_validation_rejections_total{reason="duplicate_family"} 1
+windows_agent_validation_rejections_total{reason="duplicate_series"} 1
+windows_agent_validation_rejections_total{reason="gather_error"} 0
+windows_agent_validation_rejections_total{reason="inconsistent_labels"} 1
+windows_agent_validation_rejections_total{reason="invalid_name"} 2
+windows_agent_validation_rejections_total{reason="invalid_value"} 2
+`)))
+
+	// A family that is valid again is reported again when it is rejected.
+	families = []*dto.MetricFamily{family("test_nan", map[string]string{"core": "0"})}
+
+	_, err := v.Gather()
+	require.NoError(t, err)
+
+	families = []*dto.MetricFamily{nan}
+
+	_, err = v.Gather()
+	require.NoError(t, err)
+	require.Equal(t, 3.0, v.rejections[ReasonInvalidValue])
+}
+
+func TestValidatorGatherError(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "A test gauge"})
+	registry.MustRegister(gauge, prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "test_failing", Help: "A test gauge"}, func() float64 {
+		return 1
+	}))
+
+	var logs bytes.Buffer
+
+	failing := errors.New("collector failed")
+	v := New(slog.New(slog.NewTextHandler(&logs, nil)), prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+
+		return families[1:], failing
+	}))
+
+	for range 3 {
+		families, err := v.Gather()
+		require.NoError(t, err)
+		require.Equal(t, []string{"test_gauge"}, names(families))
+	}
+
+	require.Equal(t, 1, strings.Count(logs.String(), "collector failed"), logs.String())
+	require.Equal(t, 1.0, v.rejections[ReasonGatherError])
+
+	// Without families, the error is returned.
+	v = New(slog.New(slog.DiscardHandler), prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, failing
+	}))
+
+	_, err := v.Gather()
+	require.ErrorIs(t, err, failing)
+}
@@ -0,0 +1,291 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+// Package web serves the metrics of the agent over HTTP, for troubleshooting on the machine
+// and for Prometheus servers that scrape the agent.
+//
+// The web configuration file uses the tls_server_config and basic_auth_users sections of the
+// Prometheus exporter-toolkit. Passwords are hashed with bcrypt.
+//
+// Spec: https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Brownster/agent-windows/internal/delivery"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	shutdownTimeout = 5 * time.Second
+
+	// dummyHash is the bcrypt hash of "dummy" with the default cost.
+	dummyHash = "$2a$10$v7Jko0vCgmq4U8vL6aQcHu.c/lmL2g.Pmr1a7Is9O.9N8AuobdD8S"
+)
+
+//nolint:gochecknoglobals
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// Config is the content of the web configuration file.
+type Config struct {
+	TLSServerConfig *TLSConfig `yaml:"tls_server_config"`
+	// BasicAuthUsers maps user names to bcrypt password hashes.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// TLSConfig is the tls_server_config section of the web configuration file.
+type TLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+	MaxVersion     string `yaml:"max_version"`
+}
+
+// LoadConfig reads and validates a web configuration file. An empty path returns an empty configuration.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open web configuration file: %w", err)
+		}
+
+		defer func() {
+			_ = f.Close()
+		}()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+
+		if err = decoder.Decode(config); err != nil {
+			return nil, fmt.Errorf("invalid web configuration file: %w", err)
+		}
+	}
+
+	for user, hash := range config.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid password hash of user %q: %w", user, err)
+		}
+	}
+
+	if config.TLSServerConfig != nil {
+		if _, err := config.TLSServerConfig.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// tlsConfig returns the *tls.Config of the server. The certificate is read again for every
+// handshake, so a renewed certificate is used without a restart.
+func (c *TLSConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls_server_config requires cert_file and key_file")
+	}
+
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	clientAuth, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", c.ClientAuthType)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuth,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+
+			return &cert, err
+		},
+	}
+
+	var err error
+
+	if c.MinVersion != "" {
+		if tlsConfig.MinVersion, err = delivery.ParseTLSVersion(c.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.MaxVersion != "" {
+		if tlsConfig.MaxVersion, err = delivery.ParseTLSVersion(c.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", c.ClientCAFile)
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", c.ClientAuthType)
+	}
+
+	return tlsConfig, nil
+}
+
+// authenticate wraps handler with basic authentication if users are configured.
+func (c *Config) authenticate(handler http.Handler) http.Handler {
+	if len(c.BasicAuthUsers) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			hash, known := c.BasicAuthUsers[user]
+			if !known {
+				// Unknown users are compared with a dummy hash, so they take as long as known users.
+				hash = dummyHash
+			}
+
+			if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err == nil && known {
+				handler.ServeHTTP(w, r)
+
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="windows_agent_collector"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// Server serves the metrics of the agent.
+type Server struct {
+	logger   *slog.Logger
+	listener net.Listener
+	server   *http.Server
+	useTLS   bool
+}
+
+// New loads the web configuration file and listens on address. The handler is only served
+// by Serve, so errors in the configuration and busy ports are reported before the agent starts.
+func New(logger *slog.Logger, address, configFile string, handler http.Handler) (*Server, error) {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           config.authenticate(handler),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelDebug),
+	}
+
+	if config.TLSServerConfig != nil {
+		if server.TLSConfig, err = config.TLSServerConfig.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	return &Server{logger: logger, listener: listener, server: server, useTLS: server.TLSConfig != nil}, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve serves requests until ctx is done.
+func (s *Server) Serve(ctx context.Context) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		if s.useTLS {
+			errCh <- s.server.ServeTLS(s.listener, "", "")
+		} else {
+			errCh <- s.server.Serve(s.listener)
+		}
+	}()
+
+	s.logger.LogAttrs(ctx, slog.LevelInfo, "Listening on "+s.listener.Addr().String(),
+		slog.Bool("tls", s.useTLS),
+	)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+
+	if err := s.server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// IsLocal reports whether address only accepts connections from the local machine.
+func IsLocal(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
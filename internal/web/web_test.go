@@ -0,0 +1,228 @@
+// SPDX-License-Identifier: Apache-2.0
+//
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// helloHash is the hash of the password "Hello world!".
+const helloHash = "$2a$10$bwucJdZip3cwjCluuM1wP.wA2WFm21oMM7aTHlL6hlySBdgfZQVm6"
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and returns the paths of the
+// certificate and key files and a pool that trusts the certificate.
+func writeCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agent"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return writeFile(t, dir, "agent.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))),
+		writeFile(t, dir, "agent.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))),
+		pool
+}
+
+func startServer(t *testing.T, configFile string) *Server {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "metrics")
+	})
+
+	server, err := New(slog.New(slog.DiscardHandler), "127.0.0.1:0", configFile, handler)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- server.Serve(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return server
+}
+
+func get(t *testing.T, client *http.Client, url, user, password string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.StatusCode, string(body)
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	server := startServer(t, "")
+
+	status, body := get(t, http.DefaultClient, "http://"+server.Addr().String()+"/metrics", "", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "metrics", body)
+}
+
+func TestServerBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	configFile := writeFile(t, t.TempDir(), "web.yml", "basic_auth_users:\n  prometheus: "+helloHash+"\n")
+	url := "http://" + startServer(t, configFile).Addr().String() + "/metrics"
+
+	for _, tc := range []struct {
+		user, password string
+		status         int
+	}{
+		{"prometheus", "Hello world!", http.StatusOK},
+		{"prometheus", "wrong", http.StatusUnauthorized},
+		{"unknown", "Hello world!", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		status, _ := get(t, http.DefaultClient, url, tc.user, tc.password)
+		require.Equal(t, tc.status, status, tc.user+":"+tc.password)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeCertificate(t, dir)
+	configFile := writeFile(t, dir, "web.yml", "tls_server_config:\n  cert_file: "+certFile+"\n  key_file: "+keyFile+"\n  min_version: TLS13\n")
+
+	server := startServer(t, configFile)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+
+	status, body := get(t, client, "https://"+server.Addr().String()+"/metrics", "", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "metrics", body)
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS12}}}
+
+	_, err := client.Get("https://" + server.Addr().String() + "/metrics") //nolint:noctx
+	require.Error(t, err)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeCertificate(t, dir)
+
+	for name, content := range map[string]string{
+		"unknown field":  "http_server_config:\n  http2: false\n",
+		"password hash":  "basic_auth_users:\n  prometheus: $5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n",
+		"missing key":    "tls_server_config:\n  cert_file: " + certFile + "\n",
+		"client auth":    "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n  client_auth_type: Always\n",
+		"missing CA":     "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n  client_auth_type: RequireAndVerifyClientCert\n",
+		"tls version":    "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n  min_version: SSL3\n",
+		"missing cert":   "tls_server_config:\n  cert_file: " + filepath.Join(dir, "missing.crt") + "\n  key_file: " + keyFile + "\n",
+		"invalid client": "tls_server_config:\n  cert_file: " + certFile + "\n  key_file: " + keyFile + "\n  client_ca_file: " + keyFile + "\n",
+	} {
+		_, err := LoadConfig(writeFile(t, dir, "web.yml", content))
+		require.Error(t, err, name)
+	}
+
+	_, err := LoadConfig(filepath.Join(dir, "missing.yml"))
+	require.Error(t, err)
+}
+
+func TestIsLocal(t *testing.T) {
+	t.Parallel()
+
+	for address, local := range map[string]bool{
+		"localhost:9182": true,
+		"127.0.0.1:9182": true,
+		"[::1]:9182":     true,
+		":9182":          false,
+		"0.0.0.0:9182":   false,
+		"10.0.0.1:9182":  false,
+		"localhost":      false,
+	} {
+		require.Equal(t, local, IsLocal(address), address)
+	}
+}
@@ -116,6 +116,17 @@ func (c *Collection) Enable(collectors []string) error {
 	return nil
 }
 
+// Subset returns a collection of the named collectors that shares them with c.
+func (c *Collection) Subset(collectors []string) (Collection, error) {
+	subset := *c
+
+	if err := subset.Enable(collectors); err != nil {
+		return Collection{}, err
+	}
+
+	return subset, nil
+}
+
 // Build initializes all collectors in the collection.
 func (c *Collection) Build(ctx context.Context, logger *slog.Logger) error {
 	app, err := mi.ApplicationInitialize()